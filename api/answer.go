@@ -3,6 +3,8 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,7 +16,6 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
 	"gorm.io/gorm"
 )
 
@@ -34,14 +35,23 @@ type Answer struct {
 	Replies       []Answer  `json:"replies"`
 	CanIDelete    bool      `json:"can_i_delete"`
 	IVoted        VoteValue `json:"i_voted"`
+
+	State string `json:"state"`
+	// RemovalReason and HoldReason are only shown to the author of the answer
+	RemovalReason string `json:"removal_reason,omitempty"`
+	HoldReason    string `json:"hold_reason,omitempty"`
 }
 
-const RepliesDepth = 2
+type DeleteAnswerRequest struct {
+	Reason string `json:"reason"`
+}
 
-// createVotesSubquery creates a reusable subquery for vote counting
-func createVotesSubquery(db *gorm.DB) *gorm.DB {
+// createVotesSubquery creates a reusable subquery for vote counting. Votes of
+// shadow-banned users are only counted for themselves.
+func createVotesSubquery(db *gorm.DB, requesterID int) *gorm.DB {
 	return db.Table("votes").
 		Select("votes.answer_id, COUNT(CASE votes.vote WHEN ? THEN 1 ELSE NULL END) as upvotes, COUNT(CASE votes.vote WHEN ? THEN 1 ELSE NULL END) as downvotes", VoteUp, VoteDown).
+		Where("votes.user_id NOT IN (?) OR votes.user_id = ?", util.ShadowBannedUsersSubquery(db), requesterID).
 		Group("votes.answer_id")
 }
 
@@ -52,15 +62,33 @@ func applyVoteJoins(query *gorm.DB, votesSubquery *gorm.DB) *gorm.DB {
 		Joins("LEFT JOIN (?) vote_counts ON vote_counts.answer_id = answers.id", votesSubquery)
 }
 
+// visibleAnswersScope hides the answers waiting for review and the ones of
+// shadow-banned users from everyone but their author
+func visibleAnswersScope(requesterID int) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("(answers.state <> ? AND answers.user_id NOT IN (?)) OR answers.user_id = ?",
+			models.AnswerStatePending, util.ShadowBannedUsersSubquery(db), requesterID)
+	}
+}
+
 // createPreloadFunction creates the preload function with vote joins
-func createPreloadFunction(votesSubquery *gorm.DB) func(db *gorm.DB) *gorm.DB {
+func createPreloadFunction(votesSubquery *gorm.DB, requesterID int) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		return applyVoteJoins(db, votesSubquery)
+		return applyVoteJoins(db, votesSubquery).Scopes(visibleAnswersScope(requesterID))
+	}
+}
+
+// preloadReplies preloads depth levels of replies. Every level is preloaded
+// explicitly, as GORM applies the preload conditions only to the deepest
+// level of a nested preload.
+func preloadReplies(query *gorm.DB, depth int, preload func(db *gorm.DB) *gorm.DB) *gorm.DB {
+	for i := 1; i <= depth; i++ {
+		query = query.Preload(strings.TrimSuffix(strings.Repeat("Replies.", i), "."), preload)
 	}
+	return query
 }
 
-func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID int) (*Answer, error) {
-	db := util.GetDb()
+func ConvertAnswerToAPI(db *gorm.DB, answer models.Answer, isMemberOrAdmin bool, requesterID int) (*Answer, error) {
 	usr, err := util.GetUserByID(db, answer.UserId)
 	if err != nil {
 		return nil, err
@@ -71,9 +99,10 @@ func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID
 		return nil, err
 	}
 
-	var avatar, username, content string
+	var avatar, username, content, removalReason, holdReason string
+	isAuthor := int(answer.UserId) == requesterID
 
-	if answer.State != models.AnswerStateVisible {
+	if answer.State != models.AnswerStateVisible && !isAuthor {
 		username = "[deleted]"
 		avatar = util.DeletedURL
 		content = "[deleted]"
@@ -87,6 +116,11 @@ func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID
 		content = latestVersion.Content
 	}
 
+	if isAuthor {
+		removalReason = answer.RemovalReason
+		holdReason = answer.HoldReason
+	}
+
 	var voteValue VoteValue
 	var vote models.Vote
 	err = db.Where("answer_id = ? AND user_id = ?", answer.ID, requesterID).First(&vote).Error
@@ -103,7 +137,7 @@ func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID
 	// recursively convert replies
 	var replies []Answer
 	for _, reply := range answer.Replies {
-		reply, err := ConvertAnswerToAPI(reply, isMemberOrAdmin, requesterID)
+		reply, err := ConvertAnswerToAPI(db, reply, isMemberOrAdmin, requesterID)
 		if err != nil {
 			return nil, err
 		}
@@ -122,8 +156,11 @@ func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID
 		Upvotes:       answer.Upvotes,
 		Downvotes:     answer.Downvotes,
 		Replies:       replies,
-		CanIDelete:    isMemberOrAdmin || int(answer.UserId) == requesterID,
+		CanIDelete:    isMemberOrAdmin || isAuthor,
 		IVoted:        voteValue,
+		State:         answer.State.String(),
+		RemovalReason: removalReason,
+		HoldReason:    holdReason,
 	}, nil
 
 }
@@ -135,6 +172,7 @@ func ConvertAnswerToAPI(answer models.Answer, isMemberOrAdmin bool, requesterID
 // @Produce		json
 // @Success		200	{object}	Answer
 // @Failure		400	{object}	httputil.ApiError
+// @Failure		429	{object}	httputil.ApiError
 // @Router			/answers [post]
 func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 	// Check method POST is used
@@ -142,7 +180,7 @@ func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 
 	var ans models.PostAnswerRequest
@@ -170,6 +208,13 @@ func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	filterResult := util.GetContentFilter().Check(ans.Content)
+	if filterResult.Verdict == util.FilterVerdictReject {
+		recordFilterResult(db, user.ID, nil, filterResult)
+		httputil.WriteError(res, http.StatusBadRequest, "the answer has been rejected by the content filter")
+		return
+	}
+
 	answer := models.Answer{
 		Question:  ans.Question,
 		Parent:    ans.Parent,
@@ -178,13 +223,28 @@ func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		Downvotes: 0,
 		Anonymous: ans.Anonymous,
 	}
+	if filterResult.Verdict == util.FilterVerdictHold {
+		answer.State = models.AnswerStatePending
+		answer.HoldReason = util.HoldReasonContentFilter
+	} else {
+		holdReason, err := util.CheckTrustPolicy(db, user.ID, ans.Content, true)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "error while checking the trust policy", "user", user, "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "could not insert the answer")
+			return
+		}
+		if holdReason != "" {
+			answer.State = models.AnswerStatePending
+			answer.HoldReason = holdReason
+		}
+	}
 
 	var version models.AnswerVersion
 
 	err = db.Transaction(func(tx *gorm.DB) error {
 		// Create answer
 		if err := tx.Create(&answer).Error; err != nil {
-			slog.Error("error while creating the answer", "answer", answer, "err", err)
+			slog.ErrorContext(req.Context(), "error while creating the answer", "answer", answer, "err", err)
 			return err
 		}
 
@@ -195,21 +255,26 @@ func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		}
 
 		if err := tx.Create(&version).Error; err != nil {
-			slog.Error("error while creating the answer version", "answer", answer, "version", version, "err", err)
+			slog.ErrorContext(req.Context(), "error while creating the answer version", "answer", answer, "version", version, "err", err)
 			return err
 		}
 
-		return nil
+		event := NewAuditEvent(req, models.AuditActionCreated, models.AuditTargetAnswer, strconv.FormatUint(uint64(answer.ID), 10))
+		event.After = util.AuditSummary(answerSummary(&answer))
+		return util.RecordAuditEvent(tx, event)
 	})
 
 	if err != nil {
 		httputil.WriteError(res, http.StatusBadRequest, "could not insert the answer")
 		return
 	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(quest.Document))
+
+	recordFilterResult(db, user.ID, &answer.ID, filterResult)
 
 	usr, err := util.GetOrCreateUserByID(db, user.ID, user.Username)
 	if err != nil {
-		slog.Error("error while getting or creating the user-alias association", "user", user, "err", err)
+		slog.ErrorContext(req.Context(), "error while getting or creating the user-alias association", "user", user, "err", err)
 		httputil.WriteError(res, http.StatusBadRequest, "could not insert the answer")
 		return
 	}
@@ -237,13 +302,16 @@ func PostAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		Downvotes:     answer.Downvotes,
 		CanIDelete:    true,
 		IVoted:        0,
+		State:         answer.State.String(),
+		HoldReason:    answer.HoldReason,
 	})
 }
 
 // @Summary		Delete an answer
-// @Description	Given an andwer ID, delete the answer
+// @Description	Given an andwer ID, delete the answer. Admins can specify the reason of the removal, which is shown to the author.
 // @Tags			answer
-// @Param			id	path	string	true	"Answer id"
+// @Param			id		path	string				true	"Answer id"
+// @Param			body	body	DeleteAnswerRequest	false	"Removal reason"
 // @Produce		json
 // @Success		200	{object}	nil
 // @Failure		400	{object}	httputil.ApiError
@@ -255,7 +323,7 @@ func DelAnswerHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	user := middleware.MustGetUser(req)
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	rawAnsID := muxie.GetParam(res, "id")
 
 	aID, err := strconv.ParseUint(rawAnsID, 10, 0)
@@ -266,15 +334,29 @@ func DelAnswerHandler(res http.ResponseWriter, req *http.Request) {
 
 	var answer models.Answer
 	if err := db.First(&answer, uint(aID)).Error; err != nil {
-		slog.Error("answer not found", "err", err)
+		slog.ErrorContext(req.Context(), "answer not found", "err", err)
 		httputil.WriteError(res, http.StatusNotFound, "answer not found")
 		return
 	}
 
 	if user.Role == auth.RoleUser && answer.UserId != user.ID {
-		slog.Error("you are not an admin or a member or the owner of the answer", "err", err)
-		httputil.WriteError(res, http.StatusUnauthorized, "you are not an admin or the owner of the answer")
-		return
+		var question models.Question
+		if err := db.First(&question, answer.Question).Error; err != nil {
+			slog.ErrorContext(req.Context(), "question not found", "err", err)
+			httputil.WriteError(res, http.StatusNotFound, "question not found")
+			return
+		}
+
+		canModerate, err := CanModeratePath(db, req, question.DocumentPath)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "couldn't get moderator scopes", "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "couldn't delete answer")
+			return
+		}
+		if !canModerate {
+			httputil.WriteError(res, http.StatusUnauthorized, "you are not an admin, a moderator or the owner of the answer")
+			return
+		}
 	}
 
 	if answer.State == models.AnswerStateDeletedByUser || answer.State == models.AnswerStateDeletedByAdmin {
@@ -282,21 +364,131 @@ func DelAnswerHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// the body is optional
+	var body DeleteAnswerRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		httputil.WriteError(res, http.StatusBadRequest, fmt.Sprintf("decode error: %v", err))
+		return
+	}
+
+	state := models.AnswerStateDeletedByUser
 	if user.ID != answer.UserId {
-		answer.State = models.AnswerStateDeletedByAdmin
-	} else {
-		answer.State = models.AnswerStateDeletedByUser
+		state = models.AnswerStateDeletedByAdmin
 	}
 
-	if err := db.Save(&answer).Error; err != nil {
-		slog.Error("couldn't delete answer", "err", err)
+	event := NewAuditEvent(req, models.AuditActionDeleted, models.AuditTargetAnswer, rawAnsID)
+	event.Chain = event.Chain || state == models.AnswerStateDeletedByAdmin
+	event.Before = util.AuditSummary(answerSummary(&answer))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := util.ChangeAnswerState(tx, &answer, state, user.ID, body.Reason); err != nil {
+			return err
+		}
+		event.After = util.AuditSummary(answerSummary(&answer))
+		return util.RecordAuditEvent(tx, event)
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "couldn't delete answer", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "couldn't delete answer")
 		return
 	}
+	invalidateQuestionResponses(db, answer.Question)
 
 	res.WriteHeader(http.StatusNoContent)
 }
 
+// @Summary		Restore an answer
+// @Description	Given an answer ID, make a deleted answer visible again. Admins, members and the moderators of the document can restore any answer, users only the ones they deleted themselves.
+// @Tags			answer
+// @Param			id	path	string	true	"Answer id"
+// @Produce		json
+// @Success		200	{object}	Answer
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/answers/{id}/restore [post]
+func RestoreAnswerHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	user := middleware.MustGetUser(req)
+	db := util.GetDbContext(req.Context())
+	rawAnsID := muxie.GetParam(res, "id")
+
+	aID, err := strconv.ParseUint(rawAnsID, 10, 0)
+	if err != nil {
+		httputil.WriteError(res, http.StatusBadRequest, "invalid answer id")
+		return
+	}
+
+	var answer models.Answer
+	if err := db.First(&answer, uint(aID)).Error; err != nil {
+		slog.ErrorContext(req.Context(), "answer not found", "err", err)
+		httputil.WriteError(res, http.StatusNotFound, "answer not found")
+		return
+	}
+
+	var question models.Question
+	if err := db.First(&question, answer.Question).Error; err != nil {
+		httputil.WriteError(res, http.StatusBadRequest, "the question of the answer has been deleted")
+		return
+	}
+
+	// the answers are restored by whoever could have deleted them
+	canModerate := user.Role != auth.RoleUser
+	if !canModerate {
+		canModerate, err = CanModeratePath(db, req, question.DocumentPath)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "couldn't get moderator scopes", "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "couldn't restore answer")
+			return
+		}
+	}
+
+	switch answer.State {
+	case models.AnswerStateVisible:
+		httputil.WriteError(res, http.StatusBadRequest, "the answer is not deleted")
+		return
+	case models.AnswerStatePending:
+		httputil.WriteError(res, http.StatusBadRequest, "the answer is waiting for review")
+		return
+	case models.AnswerStateDeletedByUser:
+		if !canModerate && answer.UserId != user.ID {
+			httputil.WriteError(res, http.StatusForbidden, "you are not an admin, a moderator or the owner of the answer")
+			return
+		}
+	default:
+		if !canModerate {
+			httputil.WriteError(res, http.StatusForbidden, "only admins and moderators can restore answers deleted by a moderator")
+			return
+		}
+	}
+
+	event := NewAuditEvent(req, models.AuditActionRestored, models.AuditTargetAnswer, rawAnsID)
+	event.Before = util.AuditSummary(answerSummary(&answer))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := util.ChangeAnswerState(tx, &answer, models.AnswerStateVisible, user.ID, ""); err != nil {
+			return err
+		}
+		event.After = util.AuditSummary(answerSummary(&answer))
+		return util.RecordAuditEvent(tx, event)
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "couldn't restore answer", "err", err)
+		httputil.WriteError(res, http.StatusInternalServerError, "couldn't restore answer")
+		return
+	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(question.Document))
+
+	responseData, err := ConvertAnswerToAPI(db, answer, canModerate, int(user.ID))
+	if err != nil {
+		slog.ErrorContext(req.Context(), "couldn't generate response", "err", err)
+		httputil.WriteError(res, http.StatusInternalServerError, "couldn't generate response")
+		return
+	}
+
+	httputil.WriteData(res, http.StatusOK, responseData)
+}
+
 // @Summary		Update an answer
 // @Description	Given an andwer ID, update the answer
 // @Tags			answer
@@ -312,7 +504,7 @@ func UpdateAnswerHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	user := middleware.MustGetUser(req)
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	rawAnsID := muxie.GetParam(res, "id")
 
 	aID, err := strconv.ParseUint(rawAnsID, 10, 0)
@@ -330,36 +522,75 @@ func UpdateAnswerHandler(res http.ResponseWriter, req *http.Request) {
 
 	var answer models.Answer
 	if err := db.First(&answer, uint(aID)).Error; err != nil {
-		slog.Error("answer not found", "err", err)
+		slog.ErrorContext(req.Context(), "answer not found", "err", err)
 		httputil.WriteError(res, http.StatusNotFound, "answer not found")
 		return
 	}
 
 	if answer.UserId != user.ID {
-		slog.Error("you are not the owner of the answer", "err", err)
+		slog.ErrorContext(req.Context(), "you are not the owner of the answer", "err", err)
 		httputil.WriteError(res, http.StatusUnauthorized, "you are not the owner of the answer")
 		return
 	}
 
-	if answer.State != models.AnswerStateVisible {
+	if answer.State != models.AnswerStateVisible && answer.State != models.AnswerStatePending {
 		httputil.WriteError(res, http.StatusBadRequest, "you cannot update a deleted answer")
 		return
 	}
 
-	version := models.AnswerVersion{
-		AnswerID: answer.ID,
-		Content:  body.Content,
+	filterResult := util.GetContentFilter().Check(body.Content)
+	if filterResult.Verdict == util.FilterVerdictReject {
+		recordFilterResult(db, user.ID, nil, filterResult)
+		httputil.WriteError(res, http.StatusBadRequest, "the answer has been rejected by the content filter")
+		return
 	}
 
-	if err := db.Create(&version).Error; err != nil {
-		slog.Error("couldn't update answer", "err", err)
+	holdReason := ""
+	if filterResult.Verdict == util.FilterVerdictHold {
+		holdReason = util.HoldReasonContentFilter
+	} else {
+		holdReason, err = util.CheckTrustPolicy(db, user.ID, body.Content, false)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "couldn't check the trust policy", "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "couldn't update answer")
+			return
+		}
+	}
+
+	event := NewAuditEvent(req, models.AuditActionUpdated, models.AuditTargetAnswer, rawAnsID)
+	event.Before = util.AuditSummary(answerSummary(&answer))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		version := models.AnswerVersion{
+			AnswerID: answer.ID,
+			Content:  body.Content,
+		}
+		if err := tx.Create(&version).Error; err != nil {
+			return err
+		}
+
+		if holdReason != "" && answer.State == models.AnswerStateVisible {
+			err := util.ChangeAnswerState(tx, &answer, models.AnswerStatePending, SYSTEM_USER_ID, holdReason)
+			if err != nil {
+				return err
+			}
+		}
+
+		after := answerSummary(&answer)
+		after.Version = version.ID
+		event.After = util.AuditSummary(after)
+		return util.RecordAuditEvent(tx, event)
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "couldn't update answer", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "couldn't update answer")
 		return
 	}
+	invalidateQuestionResponses(db, answer.Question)
+	recordFilterResult(db, user.ID, &answer.ID, filterResult)
 
-	responseData, err := ConvertAnswerToAPI(answer, user.Role == auth.RoleAdmin, int(user.ID))
+	responseData, err := ConvertAnswerToAPI(db, answer, user.Role == auth.RoleAdmin, int(user.ID))
 	if err != nil {
-		slog.Error("couldn't generate response", "err", err)
+		slog.ErrorContext(req.Context(), "couldn't generate response", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "couldn't generate response")
 		return
 	}
@@ -381,7 +612,7 @@ func GetRepliesHandler(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	rawQID := muxie.GetParam(res, "id")
 
 	user, err := middleware.GetUser(req)
@@ -399,32 +630,38 @@ func GetRepliesHandler(res http.ResponseWriter, req *http.Request) {
 
 	var answer models.Answer
 
-	if err := db.First(&answer, uint(aID)).Error; err != nil {
-		slog.Error("answer not found", "err", err)
+	if err := db.Scopes(visibleAnswersScope(requesterID)).First(&answer, uint(aID)).Error; err != nil {
+		slog.ErrorContext(req.Context(), "answer not found", "err", err)
 		httputil.WriteError(res, http.StatusNotFound, "answer not found")
 		return
 	}
 
+	depth, err := util.GetSetting(db, util.SettingRepliesDepth, "", 0)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "could not get the replies depth", "err", err)
+		httputil.WriteError(res, http.StatusInternalServerError, "could not fetch answers")
+		return
+	}
+
 	var replies []models.Answer
-	preloadingString := strings.Repeat("Replies.", RepliesDepth-1)
 
-	votesSubquery := createVotesSubquery(db)
-	err = applyVoteJoins(
+	votesSubquery := createVotesSubquery(db, requesterID)
+	query := applyVoteJoins(
 		db.Table("answers").
 			Where("answers.deleted_at IS NULL AND answers.parent = ?", answer.ID),
 		votesSubquery,
-	).
-		Preload(preloadingString[:len(preloadingString)-1], createPreloadFunction(votesSubquery)).
+	).Scopes(visibleAnswersScope(requesterID))
+	err = preloadReplies(query, int(depth)-1, createPreloadFunction(votesSubquery, requesterID)).
 		Find(&replies).Error
 
 	if err != nil {
-		slog.Error("could not fetch answers", "err", err)
+		slog.ErrorContext(req.Context(), "could not fetch answers", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "could not fetch answers")
 		return
 	}
 
 	answer.Replies = replies
-	responseData, err := ConvertAnswerToAPI(answer, isMemberOrAdmin, requesterID)
+	responseData, err := ConvertAnswerToAPI(db, answer, isMemberOrAdmin, requesterID)
 	if err != nil {
 		httputil.WriteError(res, http.StatusInternalServerError, "could not create response")
 		return
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type AppealRequest struct {
+	Message string `json:"message"`
+}
+
+type AppealReviewRequest struct {
+	Accept bool   `json:"accept"`
+	Reply  string `json:"reply"`
+}
+
+type Appeal struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	BanID         uint                `json:"ban_id"`
+	Username      string              `json:"username"`
+	UserAvatarURL string              `json:"user_avatar_url"`
+	Message       string              `json:"message"`
+	Status        models.AppealStatus `json:"status"`
+
+	Reply      string     `json:"reply,omitempty"`
+	ReviewedBy string     `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+}
+
+func dbAppealToAppeal(db *gorm.DB, a *models.Appeal) Appeal {
+	appeal := Appeal{
+		ID:            a.ID,
+		CreatedAt:     a.CreatedAt,
+		BanID:         a.BanID,
+		Username:      getUsernameOrSystem(db, a.UserID),
+		UserAvatarURL: util.GetPublicAvatarURL(a.UserID),
+		Message:       a.Message,
+		Status:        a.Status,
+		Reply:         a.Reply,
+		ReviewedAt:    a.ReviewedAt,
+	}
+	if a.ReviewedBy != nil {
+		appeal.ReviewedBy = getUsernameOrSystem(db, *a.ReviewedBy)
+	}
+	return appeal
+}
+
+func appealSummary(a *models.Appeal) map[string]any {
+	return map[string]any{
+		"ban_id": a.BanID,
+		"status": a.Status,
+		"reply":  a.Reply,
+	}
+}
+
+// @Summary		Appeal a ban
+// @Description	Submit an appeal against the ban currently in effect for the logged user, only one appeal per ban is allowed
+// @Tags			moderation
+// @Param			appeal	body	AppealRequest	true	"Appeal message"
+// @Produce		json
+// @Success		200	{object}	Appeal
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/appeals [post]
+func PostAppealHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AppealRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	if req.Message == "" {
+		httputil.WriteError(w, http.StatusBadRequest, "message is required")
+		return
+	}
+
+	user := middleware.MustGetUser(r)
+	db := util.GetDbContext(r.Context())
+
+	var appeal *models.Appeal
+	err = db.Transaction(func(tx *gorm.DB) error {
+		appeal, err = util.SubmitAppeal(tx, user.ID, req.Message)
+		if err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, r, models.AuditActionCreated, models.AuditTargetAppeal,
+			strconv.FormatUint(uint64(appeal.ID), 10), nil, appealSummary(appeal))
+	})
+	if errors.Is(err, util.ErrUserNotBanned) || errors.Is(err, util.ErrAppealAlreadySubmitted) {
+		httputil.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to submit appeal")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to submit appeal")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, dbAppealToAppeal(db, appeal))
+}
+
+// @Summary		Get appeals
+// @Description	Admins get the appeals queue, optionally filtered by status, other users get their own appeals
+// @Tags			moderation
+// @Param			status	query	string	false	"Appeal status (pending, accepted or rejected)"
+// @Produce		json
+// @Success		200	{object}	[]Appeal
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/appeals [get]
+func GetAppealsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := middleware.MustGetUser(r)
+	db := util.GetDbContext(r.Context())
+
+	var appeals []models.Appeal
+	var err error
+	if middleware.GetAdmin(r) {
+		status := models.AppealStatus(r.URL.Query().Get("status"))
+		switch status {
+		case "", models.AppealStatusPending, models.AppealStatusAccepted, models.AppealStatusRejected:
+		default:
+			httputil.WriteError(w, http.StatusBadRequest, "invalid status")
+			return
+		}
+		appeals, err = util.GetAppeals(db, status)
+	} else {
+		appeals, err = util.GetAppealsByUser(db, user.ID)
+	}
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get appeals")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get appeals")
+		return
+	}
+
+	returnAppeals := make([]Appeal, 0, len(appeals))
+	for _, appeal := range appeals {
+		returnAppeals = append(returnAppeals, dbAppealToAppeal(db, &appeal))
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnAppeals)
+}
+
+// @Summary		Review an appeal
+// @Description	Accept or reject an appeal with a reply message, accepting it lifts the ban
+// @Tags			moderation
+// @Param			id		path	string				true	"Appeal id"
+// @Param			review	body	AppealReviewRequest	true	"Review outcome"
+// @Produce		json
+// @Success		200	{object}	Appeal
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/appeals/{id} [post]
+func ReviewAppealHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	appealID, err := strconv.ParseUint(muxie.GetParam(w, "id"), 10, 0)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid appeal id")
+		return
+	}
+
+	var req AppealReviewRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	admin := middleware.MustGetUser(r)
+	db := util.GetDbContext(r.Context())
+
+	var appeal *models.Appeal
+	err = db.Transaction(func(tx *gorm.DB) error {
+		appeal, err = util.ReviewAppeal(tx, uint(appealID), admin.ID, req.Accept, req.Reply)
+		if err != nil {
+			return err
+		}
+
+		action := models.AuditActionRejected
+		if req.Accept {
+			action = models.AuditActionApproved
+		}
+		return RecordAuditEvent(tx, r, action, models.AuditTargetAppeal, strconv.FormatUint(appealID, 10),
+			map[string]models.AppealStatus{"status": models.AppealStatusPending}, appealSummary(appeal))
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		httputil.WriteError(w, http.StatusNotFound, "appeal not found")
+		return
+	} else if errors.Is(err, util.ErrAppealAlreadyReviewed) {
+		httputil.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to review appeal")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to review appeal")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, dbAppealToAppeal(db, appeal))
+}
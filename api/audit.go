@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"gorm.io/gorm"
+)
+
+// moderationActions are added to the hash chain whoever performs them
+var moderationActions = map[models.AuditAction]bool{
+	models.AuditActionApproved:       true,
+	models.AuditActionRejected:       true,
+	models.AuditActionDismissed:      true,
+	models.AuditActionBanned:         true,
+	models.AuditActionUnbanned:       true,
+	models.AuditActionShadowBanned:   true,
+	models.AuditActionShadowUnbanned: true,
+	models.AuditActionWarned:         true,
+	models.AuditActionGranted:        true,
+	models.AuditActionRevoked:        true,
+}
+
+// NewAuditEvent returns an audit event for a change made by the requester,
+// or by the system user if the request is not authenticated. Moderation
+// actions and the changes made by admins and members are added to the hash
+// chain, handlers set Chain themselves for moderators acting on other users'
+// content.
+func NewAuditEvent(r *http.Request, action models.AuditAction, targetType models.AuditTargetType, targetID string) *models.AuditEvent {
+	var actorID uint = SYSTEM_USER_ID
+	if user, err := middleware.GetUser(r); err == nil {
+		actorID = user.ID
+	}
+
+	return &models.AuditEvent{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		RequestID:  util.RequestIDFromContext(r.Context()),
+		Chain:      moderationActions[action] || middleware.GetAdmin(r) || middleware.GetMember(r),
+	}
+}
+
+// RecordAuditEvent records a change made by the requester within the
+// transaction tx, before and after are summaries of the target and can be nil
+func RecordAuditEvent(tx *gorm.DB, r *http.Request, action models.AuditAction, targetType models.AuditTargetType, targetID string, before, after any) error {
+	event := NewAuditEvent(r, action, targetType, targetID)
+	return recordAuditEvent(tx, event, before, after)
+}
+
+func recordAuditEvent(tx *gorm.DB, event *models.AuditEvent, before, after any) error {
+	event.Before = util.AuditSummary(before)
+	event.After = util.AuditSummary(after)
+	return util.RecordAuditEvent(tx, event)
+}
+
+// answerAudit is the summary of an answer stored in the audit events
+type answerAudit struct {
+	Question      uint   `json:"question"`
+	Parent        *uint  `json:"parent,omitempty"`
+	State         string `json:"state"`
+	Anonymous     bool   `json:"anonymous"`
+	RemovalReason string `json:"removal_reason,omitempty"`
+	HoldReason    string `json:"hold_reason,omitempty"`
+	// Version is the new content version, set on updates
+	Version uint `json:"version,omitempty"`
+}
+
+func answerSummary(answer *models.Answer) answerAudit {
+	return answerAudit{
+		Question:      answer.Question,
+		Parent:        answer.Parent,
+		State:         answer.State.String(),
+		Anonymous:     answer.Anonymous,
+		RemovalReason: answer.RemovalReason,
+		HoldReason:    answer.HoldReason,
+	}
+}
+
+func reportSummary(report *models.Report) map[string]any {
+	return map[string]any{
+		"target_type": report.TargetType,
+		"target_id":   report.TargetID,
+		"cause":       report.Cause,
+		"user_id":     report.UserID,
+	}
+}
+
+func banSummary(reason string, expiresAt *time.Time) map[string]any {
+	return map[string]any{
+		"reason":     reason,
+		"expires_at": expiresAt,
+	}
+}
+
+func questionSummary(question *models.Question) map[string]any {
+	return map[string]any{
+		"document":      question.Document,
+		"document_path": question.DocumentPath,
+		"start":         question.Start,
+		"end":           question.End,
+	}
+}
+
+func moderatorScopeSummary(scope *models.ModeratorScope) map[string]any {
+	return map[string]any{
+		"user_id":     scope.UserID,
+		"path_prefix": scope.PathPrefix,
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type cacheTagsKey struct{}
+
+// tagCachedResponse tags the response with the cache tags of the data it
+// shows, so that it is invalidated when they change. Untagged responses are
+// not cached.
+func tagCachedResponse(r *http.Request, tags ...string) {
+	if collected, ok := r.Context().Value(cacheTagsKey{}).(*[]string); ok {
+		*collected = append(*collected, tags...)
+	}
+}
+
+// invalidateQuestionResponses drops the cached responses of the document of a
+// question, including the deleted ones
+func invalidateQuestionResponses(db *gorm.DB, questionID uint) {
+	documentID, err := util.GetQuestionDocument(db, questionID)
+	if err != nil {
+		// the responses expire anyway
+		return
+	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(documentID))
+}
+
+// responseBuffer holds the response of a handler, so that its validators can
+// be computed before sending it
+type responseBuffer struct {
+	muxie.ParamStore
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// flush sends the buffered response as it is
+func (b *responseBuffer) flush(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	if b.status != 0 {
+		w.WriteHeader(b.status)
+	}
+	w.Write(b.body.Bytes())
+}
+
+// serveResponse sends a response with its validators, or 304 if the ones of
+// the request match them
+func serveResponse(w http.ResponseWriter, r *http.Request, response *util.CachedResponse, public bool) {
+	w.Header().Set("ETag", response.ETag)
+	w.Header().Set("Content-Type", response.ContentType)
+	// the anonymous and the authenticated responses differ
+	w.Header().Set("Vary", "Authorization, Cookie")
+	if public {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	http.ServeContent(w, r, "", response.LastModified, bytes.NewReader(response.Body))
+}
+
+// ResponseCacheMiddleware adds ETag validators to the responses of the public
+// read endpoints and answers the conditional requests with 304. The anonymous
+// responses are served from the response cache, with Last-Modified set to the
+// time they were computed. It must follow the authentication middleware.
+func ResponseCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params, ok := w.(muxie.ParamStore)
+		if r.Method != http.MethodGet || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cache := util.GetResponseCache()
+		_, err := middleware.GetUser(r)
+		anonymous := err != nil
+		cached := anonymous && cache.Enabled()
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		if cached {
+			if response := cache.Get(key); response != nil {
+				serveResponse(w, r, response, true)
+				return
+			}
+		}
+
+		generation := cache.Generation()
+		var tags []string
+		r = r.WithContext(context.WithValue(r.Context(), cacheTagsKey{}, &tags))
+		buffer := &responseBuffer{ParamStore: params, header: http.Header{}}
+		next.ServeHTTP(buffer, r)
+		if buffer.status != http.StatusOK {
+			buffer.flush(w)
+			return
+		}
+
+		var lastModified time.Time
+		if cached {
+			lastModified = time.Now().Truncate(time.Second)
+		}
+		response := util.NewCachedResponse(buffer.body.Bytes(), buffer.header.Get("Content-Type"), lastModified)
+		if cached && len(tags) > 0 {
+			cache.Put(key, tags, generation, response)
+		}
+		for name, values := range buffer.header {
+			w.Header()[name] = values
+		}
+		serveResponse(w, r, response, anonymous)
+	})
+}
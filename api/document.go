@@ -10,6 +10,7 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
+	"gorm.io/gorm"
 )
 
 type Document struct {
@@ -48,11 +49,11 @@ func PostDocumentHandler(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusForbidden, "you are not a member or admin")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 	_, err := util.GetOrCreateUserByID(db, user.ID, user.Username)
 	if err != nil {
-		slog.With("user", user, "err", err).Error("error while getting or creating the user-alias association")
+		slog.With("user", user, "err", err).ErrorContext(req.Context(), "error while getting or creating the user-alias association")
 		httputil.WriteError(res, http.StatusBadRequest, "could not insert the answer")
 		return
 	}
@@ -77,10 +78,18 @@ func PostDocumentHandler(res http.ResponseWriter, req *http.Request) {
 		questions = append(questions, q)
 	}
 
-	if err := db.Save(questions).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(questions).Error; err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, req, models.AuditActionCreated, models.AuditTargetDocument, data.ID, nil,
+			map[string]any{"document_path": data.DocumentPath, "questions": len(questions)})
+	})
+	if err != nil {
 		httputil.WriteError(res, http.StatusInternalServerError, "couldn't create questions")
 		return
 	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(data.ID), util.DocumentListTag)
 
 	httputil.WriteData(res, http.StatusOK, Document{
 		ID:        data.ID,
@@ -92,8 +101,10 @@ func PostDocumentHandler(res http.ResponseWriter, req *http.Request) {
 // @Description	Given a document's ID, return all the questions
 // @Tags			document
 // @Param			id	path	string	true	"document id"
+// @Param			If-None-Match	header	string	false	"ETag of a previous response"
 // @Produce		json
 // @Success		200	{object}	Document
+// @Success		304	"not modified"
 // @Failure		400	{object}	httputil.ApiError
 // @Router			/documents/{id} [get]
 func GetDocumentHandler(res http.ResponseWriter, req *http.Request) {
@@ -102,7 +113,7 @@ func GetDocumentHandler(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	docID := muxie.GetParam(res, "id")
 	var dbQuestions []models.Question
 	if err := db.Where(models.Question{Document: docID}).Find(&dbQuestions).Error; err != nil {
@@ -114,6 +125,7 @@ func GetDocumentHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	tagCachedResponse(req, util.DocumentTag(docID))
 	httputil.WriteData(res, http.StatusOK, Document{
 		ID:        docID,
 		Questions: dbQuestionsToQuestions(dbQuestions),
@@ -141,8 +153,10 @@ func dbQuestionsToQuestions(q []models.Question) []Question {
 // @Description	Given a path prefix, return all the documents that have questions in that path
 // @Tags			document
 // @Param			path	query	string	true	"path prefix"
+// @Param			If-None-Match	header	string	false	"ETag of a previous response"
 // @Produce		json
 // @Success		200	{array}		string
+// @Success		304	"not modified"
 // @Failure		400	{object}	httputil.ApiError
 // @Router			/documents [get]
 func GetDocumentsWithQuestionsHandler(res http.ResponseWriter, req *http.Request) {
@@ -153,7 +167,7 @@ func GetDocumentsWithQuestionsHandler(res http.ResponseWriter, req *http.Request
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 
 	var documents []string
 
@@ -162,5 +176,6 @@ func GetDocumentsWithQuestionsHandler(res http.ResponseWriter, req *http.Request
 		return
 	}
 
+	tagCachedResponse(req, util.DocumentListTag)
 	httputil.WriteData(res, http.StatusOK, documents)
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"gorm.io/gorm"
+)
+
+type FilterHit struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Username string `json:"username"`
+	AnswerID *uint  `json:"answer_id"`
+	Verdict  string `json:"verdict"`
+	Rules    string `json:"rules"`
+	Details  string `json:"details"`
+}
+
+// recordFilterResult stores the hits of the content filter, and reports the
+// answer on behalf of the system user when it has been flagged or held
+func recordFilterResult(db *gorm.DB, userID uint, answerID *uint, result util.FilterResult) {
+	if result.Verdict == util.FilterVerdictAllow {
+		return
+	}
+
+	details := make([]string, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		details = append(details, fmt.Sprintf("%s (%s): %s", hit.Rule, hit.Verdict, hit.Detail))
+	}
+
+	hit := models.FilterHit{
+		UserID:   userID,
+		AnswerID: answerID,
+		Verdict:  string(result.Verdict),
+		Rules:    result.Rules(),
+		Details:  strings.Join(details, "\n"),
+	}
+	if err := db.Create(&hit).Error; err != nil {
+		slog.With("hit", hit, "err", err).Error("could not save content filter hit")
+	}
+	slog.With("user_id", userID, "answer_id", answerID, "verdict", result.Verdict, "rules", hit.Rules).Info("content filter matched")
+
+	if answerID == nil {
+		return
+	}
+
+	cause := fmt.Sprintf("content filter (%s): %s", result.Verdict, hit.Rules)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		report, err := util.SaveNewReport(tx, models.ReportTargetAnswer, strconv.FormatUint(uint64(*answerID), 10), cause, SYSTEM_USER_ID)
+		if err != nil {
+			return err
+		}
+		return util.RecordAuditEvent(tx, &models.AuditEvent{
+			ActorID:    SYSTEM_USER_ID,
+			Action:     models.AuditActionCreated,
+			TargetType: models.AuditTargetReport,
+			TargetID:   strconv.FormatUint(uint64(report.ID), 10),
+			After:      util.AuditSummary(reportSummary(report)),
+		})
+	})
+	if err != nil {
+		slog.With("answer_id", *answerID, "err", err).Error("could not report filtered answer")
+	}
+}
+
+// @Summary		Get content filter hits
+// @Description	Get the latest answers which matched the content filter
+// @Tags			moderation
+// @Param			limit	query	int	false	"Maximum number of hits, 100 by default"
+// @Produce		json
+// @Success		200	{object}	[]FilterHit
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/filter/hits [get]
+func GetFilterHitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	limit := 100
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		l, err := strconv.Atoi(rawLimit)
+		if err != nil || l <= 0 {
+			httputil.WriteError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = l
+	}
+
+	db := util.GetDbContext(r.Context())
+	var hits []models.FilterHit
+	if err := db.Order("created_at DESC").Limit(limit).Find(&hits).Error; err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get content filter hits")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get content filter hits")
+		return
+	}
+
+	returnHits := make([]FilterHit, 0, len(hits))
+	for _, hit := range hits {
+		returnHits = append(returnHits, FilterHit{
+			ID:        hit.ID,
+			CreatedAt: hit.CreatedAt,
+			Username:  getUsernameOrSystem(db, hit.UserID),
+			AnswerID:  hit.AnswerID,
+			Verdict:   hit.Verdict,
+			Rules:     hit.Rules,
+			Details:   hit.Details,
+		})
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnHits)
+}
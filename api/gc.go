@@ -0,0 +1,81 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/util"
+)
+
+type GCReportResponse struct {
+	Run    JobRun         `json:"run"`
+	Report *util.GCReport `json:"report"`
+}
+
+// @Summary		Get the last garbage collector report
+// @Description	Get the report of the last run of the images garbage collector: the images it quarantined, restored and purged, and why (admin only)
+// @Tags			admin
+// @Produce		json
+// @Success		200	{object}	GCReportResponse
+// @Failure		403	{object}	httputil.ApiError
+// @Failure		404	{object}	httputil.ApiError
+// @Router			/images/gc/report [get]
+func GetGCReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	run, report, err := util.GetLastGCReport(db)
+	if err != nil {
+		slog.With("err", err).ErrorContext(r.Context(), "could not get the garbage collector report")
+		httputil.WriteError(w, http.StatusInternalServerError, "could not get the garbage collector report")
+		return
+	}
+	if run == nil {
+		httputil.WriteError(w, http.StatusNotFound, "the garbage collector never ran")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, GCReportResponse{Run: dbJobRunToJobRun(db, run), Report: report})
+}
+
+// @Summary		Dry-run the garbage collector
+// @Description	Report which images the garbage collector would quarantine, restore and purge now, and why, without changing anything (admin only)
+// @Tags			admin
+// @Produce		json
+// @Success		200	{object}	util.GCReport
+// @Failure		403	{object}	httputil.ApiError
+// @Router			/images/gc/dry-run [post]
+func GCDryRunHandler(imagesPath string, config util.GarbageCollectorConfig) http.HandlerFunc {
+	config.DryRun = true
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
+
+		if !middleware.GetAdmin(r) {
+			httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+			return
+		}
+
+		report, err := util.CollectGarbage(r.Context(), imagesPath, config)
+		if err != nil {
+			slog.With("err", err).ErrorContext(r.Context(), "could not dry-run the garbage collector")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not dry-run the garbage collector")
+			return
+		}
+
+		httputil.WriteData(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/polleg/util"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// shuttingDown makes the readiness probe fail while the server is draining
+var shuttingDown atomic.Bool
+
+// SetShuttingDown makes the replica not ready anymore, before it stops
+// accepting connections
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Checks maps each dependency to "ok" or to the reason it is unavailable
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// @Summary		Liveness probe
+// @Description	Always succeeds while the process is able to serve requests
+// @Tags			health
+// @Produce		json
+// @Success		200	{object}	HealthResponse
+// @Router			/healthz [get]
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// @Summary		Readiness probe
+// @Description	Check that the database answers, the images storage is writable and the auth server is reachable. Fails while the server is shutting down.
+// @Tags			health
+// @Produce		json
+// @Success		200	{object}	HealthResponse
+// @Failure		503	{object}	HealthResponse
+// @Router			/readyz [get]
+func ReadyHandler(imagesPath string, authURI string) http.HandlerFunc {
+	client := &http.Client{Timeout: readinessTimeout}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
+
+		if shuttingDown.Load() {
+			httputil.WriteData(w, http.StatusServiceUnavailable, HealthResponse{Status: "shutting down"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		checks := map[string]error{
+			"database": util.PingDb(ctx),
+			"images":   checkImagesWritable(imagesPath),
+			"auth":     checkAuthReachable(ctx, client, authURI),
+		}
+
+		res := HealthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+		status := http.StatusOK
+		for name, err := range checks {
+			if err != nil {
+				slog.With("check", name, "err", err).WarnContext(r.Context(), "readiness check failed")
+				res.Checks[name] = err.Error()
+				res.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			res.Checks[name] = "ok"
+		}
+
+		httputil.WriteData(w, status, res)
+	}
+}
+
+func checkImagesWritable(imagesPath string) error {
+	file, err := os.CreateTemp(imagesPath, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("images storage is not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkAuthReachable only fails if the auth server can't be reached or has an
+// internal error, the status of its root is irrelevant otherwise
+func checkAuthReachable(ctx context.Context, client *http.Client, authURI string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authURI, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("auth server is unreachable: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("auth server answered with status %d", res.StatusCode)
+	}
+	return nil
+}
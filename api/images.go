@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,11 +10,15 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/cartabinaria/auth"
 	"github.com/cartabinaria/auth/pkg/httputil"
 	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/google/uuid"
 	"github.com/kataras/muxie"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"gorm.io/gorm"
 )
 
 type ImageType string
@@ -27,17 +32,34 @@ var (
 	ImageTypeJPEG ImageType = "image/jpeg"
 )
 
-const (
-	MAX_IMAGE_SIZE = 5 * 1024 * 1024   // 5 MB
-	MAX_TOTAL_SIZE = 200 * 1024 * 1024 // 200 MB per user
-	MAX_NUMBER     = 100               // 100 images per user
-)
-
 type Image struct {
 	ID  string `json:"id"`
 	URL string `json:"url"`
 }
 
+// imageQuotas are the upload limits of a user
+type imageQuotas struct {
+	maxSize      int64
+	maxTotalSize int64
+	maxNumber    int64
+}
+
+func getImageQuotas(db *gorm.DB, user auth.User) (imageQuotas, error) {
+	var quotas imageQuotas
+	for key, value := range map[util.SettingKey]*int64{
+		util.SettingMaxImageSize:  &quotas.maxSize,
+		util.SettingMaxImagesSize: &quotas.maxTotalSize,
+		util.SettingMaxImages:     &quotas.maxNumber,
+	} {
+		var err error
+		*value, err = util.GetSetting(db, key, string(user.Role), user.ID)
+		if err != nil {
+			return quotas, err
+		}
+	}
+	return quotas, nil
+}
+
 // checkFileType reads the first few bytes of a file and compares them with known signatures.
 // As it takes a reader as input, the caller should ensure to reset the reader's position if needed (e.g., using Seek).
 func checkFileType(reader io.Reader) (ImageType, error) {
@@ -59,6 +81,30 @@ func checkFileType(reader io.Reader) (ImageType, error) {
 	return "", fmt.Errorf("unsupported file type")
 }
 
+// saveImageFile copies at most maxSize+1 bytes of src to path, io.EOF is
+// returned when the whole file has been copied
+func saveImageFile(ctx context.Context, path string, src io.Reader, maxSize int64) (int64, error) {
+	_, span := util.StartSpan(ctx, "image.save", semconv.FilePath(path))
+
+	dest, err := os.Create(path)
+	if err != nil {
+		util.EndSpan(span, err)
+		return 0, err
+	}
+	written, err := io.CopyN(dest, src, maxSize+1)
+	if closeErr := dest.Close(); err == io.EOF && closeErr != nil {
+		err = closeErr
+	}
+
+	span.SetAttributes(semconv.FileSize(int(written)))
+	if err == io.EOF {
+		util.EndSpan(span, nil)
+	} else {
+		util.EndSpan(span, err)
+	}
+	return written, err
+}
+
 // @Summary		Get an image
 // @Description	Given an image ID, return the image
 // @Tags			image
@@ -84,7 +130,9 @@ func GetImageHandler(imagesPath string) http.HandlerFunc {
 
 		fullPath := filepath.Join(imagesPath, imgID)
 
+		_, span := util.StartSpan(req.Context(), "image.serve", semconv.FilePath(fullPath))
 		http.ServeFile(res, req, fullPath)
+		span.End()
 	}
 }
 
@@ -96,6 +144,7 @@ func GetImageHandler(imagesPath string) http.HandlerFunc {
 // @Produce		json
 // @Success		200	{object}	Image
 // @Failure		400	{object}	httputil.ApiError
+// @Failure		429	{object}	httputil.ApiError
 // @Router			/images [post]
 func PostImageHandler(imagesPath string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -104,126 +153,143 @@ func PostImageHandler(imagesPath string) http.HandlerFunc {
 			return
 		}
 
-		db := util.GetDb()
+		db := util.GetDbContext(r.Context())
 		user := middleware.MustGetUser(r)
 		_, err := util.GetOrCreateUserByID(db, user.ID, user.Username)
 		if err != nil {
-			slog.With("user", user, "err", err).Error("error while getting or creating the user-alias association")
+			slog.With("user", user, "err", err).ErrorContext(r.Context(), "error while getting or creating the user-alias association")
 			httputil.WriteError(w, http.StatusBadRequest, "could not insert the answer")
 			return
 		}
 
+		quotas, err := getImageQuotas(db, user)
+		if err != nil {
+			slog.With("user", user, "err", err).ErrorContext(r.Context(), "error while getting the image quotas")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not insert the image")
+			return
+		}
+
 		totalSize, err := util.GetTotalSizeOfImagesByUser(db, user.ID)
 		if err != nil {
-			slog.With("user", user, "err", err).Error("error while getting total size of images by user")
+			slog.With("user", user, "err", err).ErrorContext(r.Context(), "error while getting total size of images by user")
 			httputil.WriteError(w, http.StatusInternalServerError, "could not insert the image")
 			return
 		}
 
-		if totalSize > MAX_TOTAL_SIZE {
+		if int64(totalSize) > quotas.maxTotalSize {
+			util.ImageUploadRejections.WithLabelValues("size_quota").Inc()
 			httputil.WriteError(w, http.StatusBadRequest, "user quota exceeded")
 			return
 		}
 
 		totalNumber, err := util.GetNumberOfImagesByUser(db, user.ID)
 		if err != nil {
-			slog.With("user", user, "err", err).Error("error while getting total number of images by user")
+			slog.With("user", user, "err", err).ErrorContext(r.Context(), "error while getting total number of images by user")
 			httputil.WriteError(w, http.StatusInternalServerError, "could not insert the image")
 			return
 		}
 
-		if totalNumber >= MAX_NUMBER {
+		if totalNumber >= quotas.maxNumber {
+			util.ImageUploadRejections.WithLabelValues("count_quota").Inc()
 			httputil.WriteError(w, http.StatusBadRequest, "user image count quota exceeded")
 			return
 		}
 
 		file, fileHeader, err := r.FormFile("file")
 		if err != nil {
-			slog.With("err", err).Error("couldn't get file from form")
+			util.ImageUploadRejections.WithLabelValues("invalid_form").Inc()
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't get file from form")
 			httputil.WriteError(w, http.StatusBadRequest, "couldn't get file from form")
 			return
 		}
 		defer file.Close()
 
-		slog.With("filename", fileHeader.Filename, "size", fileHeader.Size, "Type: ", fileHeader.Header.Get("Content-Type")).Info("received file")
+		slog.With("filename", fileHeader.Filename, "size", fileHeader.Size, "Type: ", fileHeader.Header.Get("Content-Type")).InfoContext(r.Context(), "received file")
 
-		if fileHeader.Size > MAX_IMAGE_SIZE {
+		if fileHeader.Size > quotas.maxSize {
+			util.ImageUploadRejections.WithLabelValues("too_large").Inc()
 			httputil.WriteError(w, http.StatusBadRequest, "file too large")
 			return
 		}
 
 		fType := fileHeader.Header.Get("Content-Type")
 		if fType != "image/png" && fType != "image/jpeg" {
+			util.ImageUploadRejections.WithLabelValues("unsupported_type").Inc()
 			httputil.WriteError(w, http.StatusBadRequest, "unsupported file type")
 			return
 		}
 
 		if fpCheck, err := checkFileType(file); err != nil {
-			slog.With("err", err).Error("couldn't check file type")
+			util.ImageUploadRejections.WithLabelValues("invalid_file").Inc()
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't check file type")
 			httputil.WriteError(w, http.StatusBadRequest, "couldn't check file type")
 			return
 		} else if string(fpCheck) != fType {
-			slog.With("expected", fType, "got", fpCheck).Error("file type mismatch")
+			util.ImageUploadRejections.WithLabelValues("type_mismatch").Inc()
+			slog.With("expected", fType, "got", fpCheck).ErrorContext(r.Context(), "file type mismatch")
 			httputil.WriteError(w, http.StatusBadRequest, "file type mismatch")
 			return
 		}
 
 		_, err = file.Seek(0, io.SeekStart)
 		if err != nil {
-			slog.With("err", err).Error("couldn't seek file")
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't seek file")
 			httputil.WriteError(w, http.StatusInternalServerError, "couldn't seek file")
 			return
 		}
 
 		uuid, err := uuid.NewV7()
 		if err != nil {
-			slog.With("err", err).Error("couldn't generate uuid")
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't generate uuid")
 			httputil.WriteError(w, http.StatusInternalServerError, "couldn't generate uuid")
 			return
 		}
 		fullPath := filepath.Join(imagesPath, uuid.String())
 
-		destFile, err := os.Create(fullPath)
-		if err != nil {
-			slog.With("err", err).Error("couldn't create file")
-			httputil.WriteError(w, http.StatusInternalServerError, "couldn't create file")
-			return
-		}
-		defer destFile.Close()
-
-		written, err := io.CopyN(destFile, file, MAX_IMAGE_SIZE+1)
+		written, err := saveImageFile(r.Context(), fullPath, file, quotas.maxSize)
 		switch {
 		case err == io.EOF:
 			// File is within size limits - this is good!
-			slog.With("path", fullPath, "size", written).Info("file successfully saved")
+			slog.With("path", fullPath, "size", written).InfoContext(r.Context(), "file successfully saved")
 		case err != nil:
 			// Unexpected error occurred
-			slog.With("err", err).Error("couldn't save file")
-			if cleanupErr := os.Remove(fullPath); cleanupErr != nil {
-				slog.With("err", cleanupErr, "path", fullPath).Error("couldn't remove file after failed save")
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't save file")
+			if cleanupErr := util.RemoveImageFile(r.Context(), imagesPath, uuid.String()); cleanupErr != nil {
+				slog.With("err", cleanupErr, "path", fullPath).ErrorContext(r.Context(), "couldn't remove file after failed save")
 			}
 			httputil.WriteError(w, http.StatusInternalServerError, "couldn't save file")
 			return
-		case written > MAX_IMAGE_SIZE:
+		case written > quotas.maxSize:
 			// File exceeded size limit
-			slog.With("size", written, "max", MAX_IMAGE_SIZE).Error("file too large")
-			if cleanupErr := os.Remove(fullPath); cleanupErr != nil {
-				slog.With("err", cleanupErr, "path", fullPath).Error("couldn't remove file after failed save")
+			util.ImageUploadRejections.WithLabelValues("too_large").Inc()
+			slog.With("size", written, "max", quotas.maxSize).ErrorContext(r.Context(), "file too large")
+			if cleanupErr := util.RemoveImageFile(r.Context(), imagesPath, uuid.String()); cleanupErr != nil {
+				slog.With("err", cleanupErr, "path", fullPath).ErrorContext(r.Context(), "couldn't remove file after failed save")
 			}
 			httputil.WriteError(w, http.StatusBadRequest, "file too large")
 			return
 		}
 
-		_, err = util.CreateImage(db, uuid.String(), user.ID, uint(written))
+		err = db.Transaction(func(tx *gorm.DB) error {
+			image, err := util.CreateImage(tx, uuid.String(), user.ID, uint(written))
+			if err != nil {
+				return err
+			}
+			return RecordAuditEvent(tx, r, models.AuditActionCreated, models.AuditTargetImage, image.ID, nil,
+				map[string]uint{"size": image.Size})
+		})
 		if err != nil {
-			slog.With("err", err).Error("couldn't create image record")
-			if cleanupErr := os.Remove(fullPath); cleanupErr != nil {
-				slog.With("err", cleanupErr, "path", fullPath).Error("couldn't remove file after failed db record creation")
+			slog.With("err", err).ErrorContext(r.Context(), "couldn't create image record")
+			if cleanupErr := util.RemoveImageFile(r.Context(), imagesPath, uuid.String()); cleanupErr != nil {
+				slog.With("err", cleanupErr, "path", fullPath).ErrorContext(r.Context(), "couldn't remove file after failed db record creation")
 			}
 			httputil.WriteError(w, http.StatusInternalServerError, "could not insert the image")
 			return
 		}
 
+		util.ImageUploads.Inc()
+		util.ImageUploadBytes.Add(float64(written))
+
 		httputil.WriteData(w, http.StatusOK, Image{
 			ID:  uuid.String(),
 			URL: fullPath,
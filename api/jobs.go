@@ -0,0 +1,201 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type JobRun struct {
+	ID          uint              `json:"id"`
+	Job         string            `json:"job"`
+	Trigger     models.JobTrigger `json:"trigger"`
+	Host        string            `json:"host"`
+	ScheduledAt *time.Time        `json:"scheduled_at,omitempty"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	// Duration is in milliseconds
+	Duration int64             `json:"duration"`
+	Outcome  models.JobOutcome `json:"outcome"`
+	Error    string            `json:"error,omitempty"`
+	// TriggeredBy is the admin who triggered a manual run
+	TriggeredBy string `json:"triggered_by,omitempty"`
+}
+
+type Job struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Timeout      string     `json:"timeout,omitempty"`
+	RunAtStartup bool       `json:"run_at_startup"`
+	Disabled     bool       `json:"disabled"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastRun      *JobRun    `json:"last_run,omitempty"`
+}
+
+func dbJobRunToJobRun(db *gorm.DB, r *models.JobRun) JobRun {
+	run := JobRun{
+		ID:          r.ID,
+		Job:         r.Job,
+		Trigger:     r.Trigger,
+		Host:        r.Host,
+		ScheduledAt: r.ScheduledAt,
+		StartedAt:   r.StartedAt,
+		FinishedAt:  r.FinishedAt,
+		Duration:    r.Duration.Milliseconds(),
+		Outcome:     r.Outcome,
+		Error:       r.Error,
+	}
+	if r.TriggeredBy != nil {
+		run.TriggeredBy = getUsernameOrSystem(db, *r.TriggeredBy)
+	}
+	return run
+}
+
+// @Summary		Get the background jobs
+// @Description	Get the background jobs with their schedule, next and last run (admin only)
+// @Tags			admin
+// @Produce		json
+// @Success		200	{object}	[]Job
+// @Failure		403	{object}	httputil.ApiError
+// @Router			/jobs [get]
+func GetJobsHandler(scheduler *util.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
+
+		if !middleware.GetAdmin(r) {
+			httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+			return
+		}
+
+		db := util.GetDbContext(r.Context())
+		jobs := make([]Job, 0)
+		for _, job := range scheduler.Jobs() {
+			res := Job{
+				Name:         job.Name,
+				Schedule:     job.Config.Schedule,
+				RunAtStartup: job.Config.RunAtStartup,
+				Disabled:     job.Config.Disabled,
+				NextRun:      job.NextRun(),
+			}
+			if job.Config.Timeout > 0 {
+				res.Timeout = time.Duration(job.Config.Timeout).String()
+			}
+
+			last, err := util.GetLastJobRun(db, job.Name)
+			if err != nil {
+				slog.With("job", job.Name, "err", err).ErrorContext(r.Context(), "could not get the last job run")
+				httputil.WriteError(w, http.StatusInternalServerError, "could not get the jobs")
+				return
+			}
+			if last != nil {
+				lastRun := dbJobRunToJobRun(db, last)
+				res.LastRun = &lastRun
+			}
+			jobs = append(jobs, res)
+		}
+
+		httputil.WriteData(w, http.StatusOK, jobs)
+	}
+}
+
+// @Summary		Get the runs of a job
+// @Description	Get the most recent runs of a background job, newest first (admin only)
+// @Tags			admin
+// @Param			name	path	string	true	"Job name"
+// @Param			limit	query	int		false	"Number of runs, 50 by default and at most 500"
+// @Produce		json
+// @Success		200	{object}	[]JobRun
+// @Failure		403	{object}	httputil.ApiError
+// @Failure		404	{object}	httputil.ApiError
+// @Router			/jobs/{name}/runs [get]
+func GetJobRunsHandler(scheduler *util.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
+
+		if !middleware.GetAdmin(r) {
+			httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+			return
+		}
+
+		name := muxie.GetParam(w, "name")
+		if !scheduler.HasJob(name) {
+			httputil.WriteError(w, http.StatusNotFound, util.ErrJobNotFound.Error())
+			return
+		}
+
+		limit := 50
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit <= 0 || limit > 500 {
+				httputil.WriteError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+		}
+
+		db := util.GetDbContext(r.Context())
+		runs, err := util.GetJobRuns(db, name, limit)
+		if err != nil {
+			slog.With("job", name, "err", err).ErrorContext(r.Context(), "could not get the job runs")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not get the job runs")
+			return
+		}
+
+		res := make([]JobRun, 0, len(runs))
+		for _, run := range runs {
+			res = append(res, dbJobRunToJobRun(db, &run))
+		}
+		httputil.WriteData(w, http.StatusOK, res)
+	}
+}
+
+// @Summary		Trigger a job
+// @Description	Run a background job now, in the background. The run is recorded as skipped if another replica is running it (admin only)
+// @Tags			admin
+// @Param			name	path	string	true	"Job name"
+// @Produce		json
+// @Success		202
+// @Failure		403	{object}	httputil.ApiError
+// @Failure		404	{object}	httputil.ApiError
+// @Router			/jobs/{name}/run [post]
+func TriggerJobHandler(scheduler *util.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
+
+		if !middleware.GetAdmin(r) {
+			httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+			return
+		}
+
+		name := muxie.GetParam(w, "name")
+		err := scheduler.Trigger(name, middleware.MustGetUser(r).ID)
+		if errors.Is(err, util.ErrJobNotFound) {
+			httputil.WriteError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			slog.With("job", name, "err", err).ErrorContext(r.Context(), "could not trigger the job")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not trigger the job")
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
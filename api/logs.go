@@ -1,9 +1,13 @@
 package api
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"slices"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -11,26 +15,164 @@ import (
 	"github.com/cartabinaria/auth/pkg/middleware"
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
+	"gorm.io/gorm"
 )
 
 const SYSTEM_USER_ID = 0
 
 type Log struct {
+	ID        uint      `json:"id"`
 	Timestamp time.Time `json:"timestamp"`
-	Action    string    `json:"action"`    // Created, Updated, Deleted
-	ItemType  string    `json:"item_type"` // Answer, Image, ecc.
+	Action    string    `json:"action"`    // created, updated, deleted, banned, ecc.
+	ItemType  string    `json:"item_type"` // answer, image, ecc.
 	ItemID    string    `json:"item_id"`
 
 	UserID        uint   `json:"-"`
 	Username      string `json:"username"`
 	UserAvatarURL string `json:"user_avatar_url"`
+
+	// Before and After are JSON summaries of the item
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// auditEventsToLogs converts the audit events, resolving the usernames of
+// the actors with a single query
+func auditEventsToLogs(db *gorm.DB, events []models.AuditEvent) ([]Log, error) {
+	actorIDs := make([]uint, 0, len(events))
+	for _, e := range events {
+		actorIDs = append(actorIDs, e.ActorID)
+	}
+
+	var users []models.User
+	if err := db.Unscoped().Where("id IN ?", actorIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	userMap := make(map[uint]string, len(users))
+	for _, u := range users {
+		userMap[u.ID] = u.Username
+	}
+
+	logs := make([]Log, 0, len(events))
+	for _, e := range events {
+		l := Log{
+			ID:        e.ID,
+			Timestamp: e.CreatedAt,
+			Action:    string(e.Action),
+			ItemType:  string(e.TargetType),
+			ItemID:    e.TargetID,
+			UserID:    e.ActorID,
+			Before:    e.Before,
+			After:     e.After,
+			RequestID: e.RequestID,
+		}
+		if e.ActorID == SYSTEM_USER_ID {
+			l.Username = "system"
+		} else if username, ok := userMap[e.ActorID]; ok {
+			l.Username = username
+			l.UserAvatarURL = util.GetPublicAvatarURL(e.ActorID)
+		}
+		logs = append(logs, l)
+	}
+	return logs, nil
+}
+
+const (
+	defaultLogsLimit = 100
+	maxLogsLimit     = 1000
+	logsExportBatch  = 500
+)
+
+// LogsFilter selects the audit events returned by LogsHandler, zero values
+// don't filter
+type LogsFilter struct {
+	ItemType string
+	Action   string
+	ActorID  *uint
+	ItemID   string
+	From     *time.Time
+	To       *time.Time
+}
+
+var errUnknownActor = errors.New("unknown actor")
+
+// parseLogsFilter reads the filters from the query string. The username
+// "system" selects the events performed by the system user.
+func parseLogsFilter(db *gorm.DB, query url.Values) (LogsFilter, error) {
+	filter := LogsFilter{
+		ItemType: query.Get("item_type"),
+		Action:   query.Get("action"),
+		ItemID:   query.Get("item_id"),
+	}
+
+	if username := query.Get("username"); username == "system" {
+		var id uint = SYSTEM_USER_ID
+		filter.ActorID = &id
+	} else if username != "" {
+		user, err := util.GetUserByUsername(db, username)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return filter, errUnknownActor
+		} else if err != nil {
+			return filter, err
+		}
+		filter.ActorID = &user.ID
+	}
+
+	for param, dest := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s, it must be an RFC 3339 timestamp", param)
+		}
+		*dest = &t
+	}
+
+	return filter, nil
+}
+
+func (f LogsFilter) scope(db *gorm.DB) *gorm.DB {
+	if f.ItemType != "" {
+		db = db.Where("target_type = ?", f.ItemType)
+	}
+	if f.Action != "" {
+		db = db.Where("action = ?", f.Action)
+	}
+	if f.ActorID != nil {
+		db = db.Where("actor_id = ?", *f.ActorID)
+	}
+	if f.ItemID != "" {
+		db = db.Where("target_id = ?", f.ItemID)
+	}
+	if f.From != nil {
+		db = db.Where("created_at >= ?", *f.From)
+	}
+	if f.To != nil {
+		db = db.Where("created_at < ?", *f.To)
+	}
+	return db
 }
 
 // @Summary		Get system logs
-// @Description	Get system logs (admin only)
+// @Description	Get the audit log, newest first (admin only). Results are paginated: pass the X-Next-Cursor header of a response as the cursor parameter to get the next page, the header is missing on the last page. With the format parameter, every matching event is exported instead, oldest first.
 // @Tags			admin
+// @Param			item_type	query	string	false	"Item type (answer, image, user...)"
+// @Param			action		query	string	false	"Action (created, deleted, banned...)"
+// @Param			username	query	string	false	"Username of who performed the action, system for the system user"
+// @Param			item_id		query	string	false	"Item ID"
+// @Param			from		query	string	false	"Only events at or after this RFC 3339 timestamp"
+// @Param			to			query	string	false	"Only events before this RFC 3339 timestamp"
+// @Param			limit		query	int		false	"Page size, 100 by default and at most 1000"
+// @Param			cursor		query	string	false	"Cursor of the page, from the X-Next-Cursor header"
+// @Param			format		query	string	false	"Export format, csv or ndjson"
 // @Produce		json
+// @Produce		text/csv
+// @Produce		application/x-ndjson
 // @Success		200	{array}		Log
+// @Header			200	{string}	X-Next-Cursor	"Cursor of the next page"
 // @Failure		400	{object}	httputil.ApiError
 // @Failure		403	{object}	httputil.ApiError
 // @Failure		405	{object}	httputil.ApiError
@@ -46,236 +188,176 @@ func LogsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
-
-	var logs []Log
+	db := util.GetDbContext(r.Context())
+	query := r.URL.Query()
 
-	// Images
-	var images []models.Image
-	if err := db.Find(&images).Error; err != nil {
-		slog.With("err", err).Error("error while getting images from DB")
-		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
+	filter, err := parseLogsFilter(db, query)
+	if errors.Is(err, errUnknownActor) {
+		// nobody can have performed the actions of a missing user
+		httputil.WriteData(w, http.StatusOK, []Log{})
+		return
+	} else if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	logs = append(logs, imagesToLogs(images)...)
 
-	// Answers
-	var answers []models.Answer
-	if err := db.Find(&answers).Error; err != nil {
-		slog.With("err", err).Error("error while getting answers from DB")
-		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
+	switch format := query.Get("format"); format {
+	case "":
+	case "csv", "ndjson":
+		exportLogs(w, db, filter, format)
+		return
+	default:
+		httputil.WriteError(w, http.StatusBadRequest, "invalid format, it must be either csv or ndjson")
 		return
 	}
-	logs = append(logs, answersToLogs(answers)...)
 
-	// Answers versions
-	var answerVersions []models.AnswerVersion
-	if err := db.Find(&answerVersions).Error; err != nil {
-		slog.With("err", err).Error("error while getting answer versions from DB")
-		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
-		return
+	limit := defaultLogsLimit
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		l, err := strconv.Atoi(rawLimit)
+		if err != nil || l <= 0 || l > maxLogsLimit {
+			httputil.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit, it must be between 1 and %d", maxLogsLimit))
+			return
+		}
+		limit = l
 	}
-	logs = append(logs, answersVersionsToLogs(answerVersions, answers)...)
 
-	// Users
-	var users []models.User
-	if err := db.Find(&users).Error; err != nil {
-		slog.With("err", err).Error("error while getting users from DB")
-		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
-		return
+	// IDs grow with time, so they are used as keyset
+	q := db.Scopes(filter.scope)
+	if rawCursor := query.Get("cursor"); rawCursor != "" {
+		cursor, err := strconv.ParseUint(rawCursor, 10, 0)
+		if err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		q = q.Where("id < ?", cursor)
 	}
-	logs = append(logs, usersToLogs(users)...)
 
-	// Proposals
-	var proposals []models.Proposal
-	if err := db.Find(&proposals).Error; err != nil {
-		slog.With("err", err).Error("error while getting proposals from DB")
+	var events []models.AuditEvent
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&events).Error; err != nil {
+		slog.With("err", err).ErrorContext(r.Context(), "error while getting audit events from DB")
 		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
 		return
 	}
-	logs = append(logs, proposalsToLogs(proposals)...)
 
-	// Map user IDs to usernames and avatar URLs
-	userMap := make(map[uint]string, len(users))
-	for _, u := range users {
-		userMap[u.ID] = u.Username
+	if len(events) > limit {
+		events = events[:limit]
+		w.Header().Set("X-Next-Cursor", strconv.FormatUint(uint64(events[limit-1].ID), 10))
 	}
 
-	for i := range logs {
-		if logs[i].UserID == SYSTEM_USER_ID {
-			logs[i].Username = "system"
-			logs[i].UserAvatarURL = ""
-			continue
-		} else if username, ok := userMap[logs[i].UserID]; ok {
-			logs[i].Username = username
-			logs[i].UserAvatarURL = util.GetPublicAvatarURL(logs[i].UserID)
-		}
+	logs, err := auditEventsToLogs(db, events)
+	if err != nil {
+		slog.With("err", err).ErrorContext(r.Context(), "error while getting users from DB")
+		httputil.WriteError(w, http.StatusBadRequest, "could not get logs")
+		return
 	}
 
-	// Sort logs by timestamp descending
-	slices.SortFunc(logs, func(a, b Log) int {
-		return b.Timestamp.Compare(a.Timestamp)
-	})
-
 	httputil.WriteData(w, http.StatusOK, logs)
 }
 
-func imagesToLogs(images []models.Image) []Log {
-	logs := make([]Log, 0, len(images))
-	for _, img := range images {
-		logs = append(logs, Log{
-			Timestamp: img.CreatedAt,
-			Action:    "created",
-			ItemType:  "image",
-			ItemID:    img.ID,
-
-			UserID:        img.UserID,
-			Username:      "",
-			UserAvatarURL: "",
-		})
-
-		if img.DeletedAt.Valid {
-			logs = append(logs, Log{
-				Timestamp: img.DeletedAt.Time,
-				Action:    "deleted",
-				ItemType:  "image",
-				ItemID:    img.ID,
-
-				UserID:        SYSTEM_USER_ID,
-				Username:      "",
-				UserAvatarURL: "",
-			})
-		}
+var logsCSVHeader = []string{"id", "timestamp", "action", "item_type", "item_id", "username", "before", "after", "request_id"}
+
+// exportLogs streams every event matching the filter, loading them in
+// batches. Errors after the first batch can't change the status code anymore,
+// so they truncate the export.
+func exportLogs(w http.ResponseWriter, db *gorm.DB, filter LogsFilter, format string) {
+	filename := "logs-" + time.Now().Format("20060102-150405")
+	var csvWriter *csv.Writer
+	var jsonEncoder *json.Encoder
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		filename += ".csv"
+		csvWriter = csv.NewWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+		jsonEncoder = json.NewEncoder(w)
 	}
-	return logs
-}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
 
-func answersToLogs(answers []models.Answer) []Log {
-	logs := make([]Log, 0, len(answers))
-	for _, ans := range answers {
-		logs = append(logs, Log{
-			Timestamp: ans.CreatedAt,
-			Action:    "created",
-			ItemType:  "answer",
-			ItemID:    strconv.FormatUint(uint64(ans.ID), 10),
-
-			UserID:        ans.UserId,
-			Username:      "",
-			UserAvatarURL: "",
-		})
-
-		if ans.DeletedAt.Valid {
-			l := Log{
-				Timestamp: ans.DeletedAt.Time,
-				Action:    "deleted",
-				ItemType:  "answer",
-				ItemID:    strconv.FormatUint(uint64(ans.ID), 10),
-			}
+	if csvWriter != nil {
+		_ = csvWriter.Write(logsCSVHeader)
+	}
 
-			if ans.State == models.AnswerStateDeletedByAdmin {
-				l.Username = "administrator"
+	flusher, _ := w.(http.Flusher)
+	var batch []models.AuditEvent
+	err := db.Scopes(filter.scope).FindInBatches(&batch, logsExportBatch, func(tx *gorm.DB, _ int) error {
+		logs, err := auditEventsToLogs(db, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range logs {
+			if csvWriter != nil {
+				err = csvWriter.Write([]string{
+					strconv.FormatUint(uint64(l.ID), 10),
+					l.Timestamp.Format(time.RFC3339Nano),
+					l.Action,
+					l.ItemType,
+					l.ItemID,
+					l.Username,
+					l.Before,
+					l.After,
+					l.RequestID,
+				})
 			} else {
-				l.UserID = ans.UserId
+				err = jsonEncoder.Encode(l)
+			}
+			if err != nil {
+				return err
 			}
+		}
 
-			logs = append(logs, l)
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
 		}
+		return nil
+	}).Error
+	if err != nil {
+		slog.With("format", format, "err", err).Error("error while exporting logs")
 	}
-
-	return logs
 }
 
-func answersVersionsToLogs(answersVersions []models.AnswerVersion, answers []models.Answer) []Log {
-	logs := make([]Log, 0, len(answersVersions))
-	answerMap := make(map[uint]uint, len(answers))
-	for _, ans := range answers {
-		answerMap[ans.ID] = ans.UserId
-	}
-
-	for _, av := range answersVersions {
-		logs = append(logs, Log{
-			Timestamp: av.CreatedAt,
-			Action:    "modified",
-			ItemType:  "answer-content",
-			ItemID:    strconv.FormatUint(uint64(av.AnswerID), 10),
-
-			UserID:        answerMap[av.AnswerID],
-			Username:      "",
-			UserAvatarURL: "",
-		})
-	}
-
-	return logs
-}
+// @Summary		Verify the audit hash chain
+// @Description	Walk the hash chain of the moderation and admin events, and the signed checkpoints, reporting the first broken link (admin only)
+// @Tags			admin
+// @Produce		json
+// @Success		200	{object}	util.AuditChainVerification
+// @Failure		403	{object}	httputil.ApiError
+// @Failure		405	{object}	httputil.ApiError
+// @Router			/logs/verify [get]
+func VerifyLogsHandler(auditConfig util.AuditConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httputil.WriteError(w, http.StatusMethodNotAllowed, "invalid method")
+			return
+		}
 
-func usersToLogs(users []models.User) []Log {
-	logs := make([]Log, 0, len(users)*2)
-	for _, u := range users {
-		logs = append(logs, Log{
-			Timestamp: u.CreatedAt,
-			Action:    "created",
-			ItemType:  "user",
-			ItemID:    strconv.FormatUint(uint64(u.ID), 10),
-
-			UserID:        u.ID,
-			Username:      "",
-			UserAvatarURL: "",
-		})
-
-		if u.DeletedAt.Valid {
-			logs = append(logs, Log{
-				Timestamp: u.DeletedAt.Time,
-				Action:    "deleted",
-				ItemType:  "user",
-				ItemID:    strconv.FormatUint(uint64(u.ID), 10),
-
-				UserID:        SYSTEM_USER_ID,
-				Username:      "",
-				UserAvatarURL: "",
-			})
+		if !middleware.GetAdmin(r) {
+			httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+			return
 		}
 
-		if u.Banned {
-			logs = append(logs, Log{
-				Timestamp:     *u.BannedAt,
-				Action:        "banned",
-				ItemType:      "user",
-				ItemID:        strconv.FormatUint(uint64(u.ID), 10),
-				UserID:        SYSTEM_USER_ID,
-				Username:      "",
-				UserAvatarURL: "",
-			})
+		checkpoints, publicKey, err := auditConfig.LoadCheckpoints()
+		if err != nil {
+			slog.With("err", err).ErrorContext(r.Context(), "error while loading the audit checkpoints")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not load the checkpoints")
+			return
 		}
-	}
-	return logs
-}
 
-func proposalsToLogs(proposals []models.Proposal) []Log {
-	logs := make([]Log, 0, len(proposals)*2)
-	for _, p := range proposals {
-		logs = append(logs, Log{
-			Timestamp: p.CreatedAt,
-			Action:    "created",
-			ItemType:  "proposal",
-			ItemID:    strconv.FormatUint(uint64(p.ID), 10),
-
-			UserID:        p.UserID,
-			Username:      "",
-			UserAvatarURL: "",
-		})
-
-		if p.DeletedAt.Valid {
-			logs = append(logs, Log{
-				Timestamp: p.DeletedAt.Time,
-				Action:    "deleted",
-				ItemType:  "proposal",
-				ItemID:    strconv.FormatUint(uint64(p.ID), 10),
-
-				UserID:        SYSTEM_USER_ID,
-				Username:      "",
-				UserAvatarURL: "",
-			})
+		result, err := util.VerifyAuditChain(util.GetDbContext(r.Context()), checkpoints, publicKey)
+		if err != nil {
+			slog.With("err", err).ErrorContext(r.Context(), "error while verifying the audit chain")
+			httputil.WriteError(w, http.StatusInternalServerError, "could not verify the audit chain")
+			return
 		}
+
+		httputil.WriteData(w, http.StatusOK, result)
 	}
-	return logs
 }
@@ -2,8 +2,12 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/cartabinaria/auth/pkg/httputil"
 	"github.com/cartabinaria/auth/pkg/middleware"
@@ -11,27 +15,73 @@ import (
 	"gorm.io/gorm"
 )
 
+// RequestUserMiddleware records the authenticated user, if any, in the request
+// log and span
+func RequestUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, err := middleware.GetUser(r); err == nil {
+			util.SetRequestUser(r.Context(), user.ID, string(user.Role))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func BanMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID := middleware.MustGetUser(r).ID
-		user, err := util.GetUserByID(util.GetDb(), userID)
+		ban, err := util.GetActiveBan(util.GetDbContext(r.Context()), userID)
 		if err != nil {
-			// If the user is not found, we let the request pass,
-			// as it might be a new user
+			// If there is no active ban, we let the request pass. This
+			// also covers new users, who are not in the database yet,
+			// and bans which have expired.
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			slog.With("err", err).Error("Could not get user from database")
+			slog.With("err", err).ErrorContext(r.Context(), "Could not get user bans from database")
 			httputil.WriteError(w, http.StatusInternalServerError, "Could not get user from database")
 			return
 		}
 
-		if user.Banned {
-			httputil.WriteError(w, http.StatusForbidden, "You are banned from using this service")
-			return
+		msg := "You are banned from using this service"
+		if ban.ExpiresAt != nil {
+			msg += fmt.Sprintf(" until %s", ban.ExpiresAt.Format(time.RFC3339))
 		}
-		next.ServeHTTP(w, r)
+		httputil.WriteError(w, http.StatusForbidden, msg+", you can appeal the ban at /moderation/appeals")
 	})
 }
+
+// RateLimitMiddleware limits the requests of a class of routes with the
+// buckets of the authenticated user, or of the client IP for the anonymous
+// requests. It must follow the authentication middleware.
+func RateLimitMiddleware(limiter *util.RateLimiter, class util.RateLimitClass) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "ip:" + util.ClientIP(r)
+			if user, err := middleware.GetUser(r); err == nil {
+				key = fmt.Sprintf("user:%d", user.ID)
+			}
+
+			result := limiter.Take(r.Context(), class, key)
+			if result == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// seconds rounds durations up, so that retrying after them succeeds
+			seconds := func(d time.Duration) string {
+				return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", seconds(result.Reset))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", seconds(result.RetryAfter))
+				httputil.WriteError(w, http.StatusTooManyRequests, "too many requests, retry in "+seconds(result.RetryAfter)+" seconds")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
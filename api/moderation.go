@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -12,11 +13,17 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
+	"gorm.io/gorm"
 )
 
 type ReportRequest struct {
-	Cause  string `json:"cause"`
-	Answer uint   `json:"answer"`
+	Cause      string                  `json:"cause"`
+	TargetType models.ReportTargetType `json:"target_type"`
+	// For users, either the username or the alias
+	TargetID string `json:"target_id"`
+	// Deprecated: kept for clients which can only report answers, use
+	// TargetType and TargetID instead
+	Answer uint `json:"answer"`
 }
 
 type Report struct {
@@ -24,32 +31,70 @@ type Report struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
-	AnswerID      uint   `json:"answer_id"`
-	Cause         string `json:"cause"`
-	Username      string `json:"username"`
-	UserAvatarURL string `json:"user_avatar_url"`
+	TargetType    models.ReportTargetType `json:"target_type"`
+	TargetID      string                  `json:"target_id"`
+	Preview       ReportPreview           `json:"preview"`
+	Cause         string                  `json:"cause"`
+	Username      string                  `json:"username"`
+	UserAvatarURL string                  `json:"user_avatar_url"`
+}
+
+type ReportActionRequest struct {
+	Action ReportAction `json:"action"`
+	// Reason is shown to the author of the removed answer or to the banned
+	// user, the cause of the report is only seen by the moderators
+	Reason string `json:"reason"`
 }
 
 type BannedUser struct {
-	ID            uint      `json:"id"`
-	Username      string    `json:"username"`
-	UserAvatarURL string    `json:"user_avatar_url"`
-	BannedAt      time.Time `json:"banned_at"`
+	ID            uint       `json:"id"`
+	Username      string     `json:"username"`
+	UserAvatarURL string     `json:"user_avatar_url"`
+	BannedAt      time.Time  `json:"banned_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Reason        string     `json:"reason"`
+	BannedBy      string     `json:"banned_by"`
 }
 
 type BanUserRequest struct {
 	Username string `json:"username"`
 	Ban      bool   `json:"ban"`
+	Reason   string `json:"reason"`
+	// ExpiresAt is only used when banning, a nil value means a permanent ban
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ShadowBannedUser struct {
+	ID            uint   `json:"id"`
+	Username      string `json:"username"`
+	UserAvatarURL string `json:"user_avatar_url"`
+}
+
+type ShadowBanRequest struct {
+	Username  string `json:"username"`
+	ShadowBan bool   `json:"shadow_ban"`
+}
+
+type Ban struct {
+	ID         uint       `json:"id"`
+	Reason     string     `json:"reason"`
+	BannedBy   string     `json:"banned_by"`
+	StartsAt   time.Time  `json:"starts_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LiftedAt   *time.Time `json:"lifted_at"`
+	LiftedBy   string     `json:"lifted_by,omitempty"`
+	LiftReason string     `json:"lift_reason,omitempty"`
+	Active     bool       `json:"active"`
 }
 
-// @Summary		Report an answer
-// @Description	Report an answer given its ID
+// @Summary		Report an answer, a question, an image or a user
+// @Description	Report a target given its type and ID
 // @Tags			moderation
-// @Param			id		path	string			true	"Answer id"
-// @Param			report	body	ReportRequest	true	"Report cause"
+// @Param			report	body	ReportRequest	true	"Report target and cause"
 // @Produce		json
 // @Success		200	{object}	string
 // @Failure		400	{object}	httputil.ApiError
+// @Failure		429	{object}	httputil.ApiError
 // @Router			/moderation/report/ [post]
 func PostReportHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -61,7 +106,7 @@ func PostReportHandler(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
-		slog.With("err", err).Error("failed to decode request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
 		return
 	}
 
@@ -70,13 +115,39 @@ func PostReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.TargetType == "" && req.Answer != 0 {
+		req.TargetType = models.ReportTargetAnswer
+		req.TargetID = strconv.FormatUint(uint64(req.Answer), 10)
+	}
+
 	user := middleware.MustGetUser(r)
-	db := util.GetDb()
+	db := util.GetDbContext(r.Context())
 
-	err = util.SaveNewReport(db, req.Answer, req.Cause, user.ID)
+	targetID, err := resolveReportTarget(db, req.TargetType, req.TargetID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidReportTarget):
+			httputil.WriteError(w, http.StatusBadRequest, "invalid report target")
+		case errors.Is(err, errReportTargetNotFound):
+			httputil.WriteError(w, http.StatusNotFound, "report target not found")
+		default:
+			httputil.WriteError(w, http.StatusInternalServerError, "failed to save report")
+			slog.With("err", err).ErrorContext(r.Context(), "failed to resolve report target")
+		}
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		report, err := util.SaveNewReport(tx, req.TargetType, targetID, req.Cause, user.ID)
+		if err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, r, models.AuditActionCreated, models.AuditTargetReport,
+			strconv.FormatUint(uint64(report.ID), 10), nil, reportSummary(report))
+	})
 	if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to save report")
-		slog.With("err", err).Error("failed to save report")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to save report")
 		return
 	}
 
@@ -84,7 +155,7 @@ func PostReportHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary		Get all reports
-// @Description	Get all reports
+// @Description	Get all reports, moderators only get the ones about the documents they moderate
 // @Tags			moderation
 // @Produce		json
 // @Success		200	{object}	[]Report
@@ -96,38 +167,56 @@ func GetReportsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !middleware.GetAdmin(r) {
-		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+	db := util.GetDbContext(r.Context())
+	canModerate, isModerator, err := moderatedPathFilter(db, r)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get moderator scopes")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get moderator scopes")
+		return
+	}
+	if !isModerator {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin or moderator")
 		return
 	}
+	isAdmin := middleware.GetAdmin(r)
 
-	db := util.GetDb()
 	reports, err := util.GetAllReports(db)
 	if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to get reports")
-		slog.With("err", err).Error("failed to get reports")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get reports")
 		return
 	}
 
 	returnResports := make([]Report, 0, len(reports))
 	for _, report := range reports {
+		if !isAdmin {
+			path, err := getReportDocumentPath(db, &report)
+			if err != nil || !canModerate(path) {
+				continue
+			}
+		}
 
-		user, err := util.GetUserByID(db, report.UserID)
-		var username, avatarURL string
-		if err != nil {
-			slog.With("err", err).Error("failed to get user by id")
-			username = "unknown"
-			avatarURL = ""
+		// reports by the system user are created by the content filter
+		username := getUsernameOrSystem(db, report.ReporterID())
+		avatarURL := ""
+		if report.UserID != nil {
+			avatarURL = util.GetPublicAvatarURL(*report.UserID)
 		}
 
-		username = user.Username
-		avatarURL = util.GetPublicAvatarURL(user.ID)
+		preview, err := getReportPreview(db, &report)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			preview.Missing = true
+		} else if err != nil {
+			slog.With("report", report, "err", err).ErrorContext(r.Context(), "failed to get report preview")
+		}
 
 		returnResports = append(returnResports, Report{
 			ID:            report.ID,
 			CreatedAt:     report.CreatedAt,
 			UpdatedAt:     report.UpdatedAt,
-			AnswerID:      report.AnswerID,
+			TargetType:    report.TargetType,
+			TargetID:      report.TargetID,
+			Preview:       preview,
 			Cause:         report.Cause,
 			Username:      username,
 			UserAvatarURL: avatarURL,
@@ -155,20 +244,29 @@ func GetBannedHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
-	bannedUsers, err := util.GetBannedUsers(db)
+	db := util.GetDbContext(r.Context())
+	bans, err := util.GetActiveBans(db)
 	if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to get banned users")
-		slog.With("err", err).Error("failed to get banned users")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get banned users")
 		return
 	}
 
-	returnBannedUsers := make([]BannedUser, 0, len(bannedUsers))
-	for _, user := range bannedUsers {
+	returnBannedUsers := make([]BannedUser, 0, len(bans))
+	for _, ban := range bans {
+		user, err := util.GetUserByID(db, ban.UserID)
+		if err != nil {
+			slog.With("ban", ban, "err", err).ErrorContext(r.Context(), "failed to get banned user by id")
+			continue
+		}
+
 		returnBannedUsers = append(returnBannedUsers, BannedUser{
 			ID:            user.ID,
 			Username:      user.Username,
-			BannedAt:      user.UpdatedAt,
+			BannedAt:      ban.StartsAt,
+			ExpiresAt:     ban.ExpiresAt,
+			Reason:        ban.Reason,
+			BannedBy:      getUsernameOrSystem(db, ban.IssuedBy),
 			UserAvatarURL: util.GetPublicAvatarURL(user.ID),
 		})
 	}
@@ -199,7 +297,7 @@ func BanUserHandler(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
-		slog.With("err", err).Error("failed to decode request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
 		return
 	}
 
@@ -208,11 +306,11 @@ func BanUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(r.Context())
 	user, err := util.GetUserByUsername(db, req.Username)
 	if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to get user by username")
-		slog.With("err", err).Error("failed to get user by username")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get user by username")
 		return
 	}
 	if user == nil {
@@ -220,10 +318,30 @@ func BanUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = util.BanUnbanUser(db, req.Username, req.Ban)
-	if err != nil {
+	if req.Ban && req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		httputil.WriteError(w, http.StatusBadRequest, "the ban expiration must be in the future")
+		return
+	}
+
+	admin := middleware.MustGetUser(r)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := util.BanUnbanUser(tx, req.Username, req.Ban, admin.ID, req.Reason, req.ExpiresAt); err != nil {
+			return err
+		}
+
+		action := models.AuditActionUnbanned
+		if req.Ban {
+			action = models.AuditActionBanned
+		}
+		return RecordAuditEvent(tx, r, action, models.AuditTargetUser, strconv.FormatUint(uint64(user.ID), 10),
+			nil, banSummary(req.Reason, req.ExpiresAt))
+	})
+	if errors.Is(err, util.ErrUserAlreadyBanned) || errors.Is(err, util.ErrUserNotBanned) {
+		httputil.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to ban/unban user")
-		slog.With("err", err).Error("failed to ban/unban user")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to ban/unban user")
 		return
 	}
 
@@ -234,6 +352,179 @@ func BanUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// @Summary		Get all shadow-banned users
+// @Description	Get all shadow-banned users
+// @Tags			moderation
+// @Produce		json
+// @Success		200	{object}	[]ShadowBannedUser
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/shadowban [get]
+func GetShadowBannedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	users, err := util.GetShadowBannedUsers(db)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get shadow-banned users")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get shadow-banned users")
+		return
+	}
+
+	returnUsers := make([]ShadowBannedUser, 0, len(users))
+	for _, user := range users {
+		returnUsers = append(returnUsers, ShadowBannedUser{
+			ID:            user.ID,
+			Username:      user.Username,
+			UserAvatarURL: util.GetPublicAvatarURL(user.ID),
+		})
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnUsers)
+}
+
+// @Summary		Shadow-ban or un-shadow-ban a user
+// @Description	Hide the answers, votes and reports of a user from everyone else, without telling them
+// @Tags			moderation
+// @Param			shadowBan	body	ShadowBanRequest	true	"Shadow-ban or un-shadow-ban a user"
+// @Produce		json
+// @Success		200	{object}	string
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/shadowban [post]
+func ShadowBanUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	var req ShadowBanRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	if req.Username == "" {
+		httputil.WriteError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := util.SetShadowBan(tx, req.Username, req.ShadowBan); err != nil {
+			return err
+		}
+		user, err := util.GetUserByUsername(tx, req.Username)
+		if err != nil {
+			return err
+		}
+
+		action := models.AuditActionShadowUnbanned
+		if req.ShadowBan {
+			action = models.AuditActionShadowBanned
+		}
+		return RecordAuditEvent(tx, r, action, models.AuditTargetUser, strconv.FormatUint(uint64(user.ID), 10), nil, nil)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		httputil.WriteError(w, http.StatusBadRequest, "user not found")
+		return
+	} else if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to shadow-ban user")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to shadow-ban user")
+		return
+	}
+	// the answers and the votes of shadow-banned users are hidden everywhere
+	util.GetResponseCache().InvalidateAll()
+
+	if req.ShadowBan {
+		httputil.WriteData(w, http.StatusOK, "User shadow-banned successfully")
+	} else {
+		httputil.WriteData(w, http.StatusOK, "User un-shadow-banned successfully")
+	}
+}
+
+// @Summary		Get the ban history of a user
+// @Description	Get all bans, active or not, of a user given its username
+// @Tags			moderation
+// @Param			username	path	string	true	"Username"
+// @Produce		json
+// @Success		200	{object}	[]Ban
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/ban/{username}/history [get]
+func GetBanHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	user, err := util.GetUserByUsername(db, muxie.GetParam(w, "username"))
+	if err != nil {
+		httputil.WriteError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	bans, err := util.GetBanHistory(db, user.ID)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get ban history")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get ban history")
+		return
+	}
+
+	now := time.Now()
+	returnBans := make([]Ban, 0, len(bans))
+	for _, ban := range bans {
+		b := Ban{
+			ID:         ban.ID,
+			Reason:     ban.Reason,
+			BannedBy:   getUsernameOrSystem(db, ban.IssuedBy),
+			StartsAt:   ban.StartsAt,
+			ExpiresAt:  ban.ExpiresAt,
+			LiftedAt:   ban.LiftedAt,
+			LiftReason: ban.LiftReason,
+			Active:     ban.IsActive(now),
+		}
+		if ban.LiftedBy != nil {
+			b.LiftedBy = getUsernameOrSystem(db, *ban.LiftedBy)
+		}
+		returnBans = append(returnBans, b)
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnBans)
+}
+
+// getUsernameOrSystem returns the username of the given user, or "system" for
+// actions performed automatically
+func getUsernameOrSystem(db *gorm.DB, userID uint) string {
+	if userID == SYSTEM_USER_ID {
+		return "system"
+	}
+	user, err := util.GetUserByID(db, userID)
+	if err != nil {
+		slog.With("user_id", userID, "err", err).Error("failed to get user by id")
+		return "unknown"
+	}
+	return user.Username
+}
+
 // @Summary		Delete a report
 // @Description	Delete a report given its ID
 // @Tags			moderation
@@ -260,14 +551,171 @@ func DeleteReportByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(r.Context())
+	report, err := util.GetReportByID(db, uint(objID))
+	if err != nil {
+		httputil.WriteError(w, http.StatusNotFound, "report not found")
+		return
+	}
 
-	err = db.Delete(&models.Report{}, objID).Error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(report).Error; err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, r, models.AuditActionDeleted, models.AuditTargetReport, objectID, reportSummary(report), nil)
+	})
 	if err != nil {
 		httputil.WriteError(w, http.StatusInternalServerError, "failed to delete report")
-		slog.With("err", err).Error("failed to delete report")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to delete report")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// @Summary		Act on a report
+// @Description	Dismiss a report, remove the reported content, ban its author or approve an answer held for review
+// @Tags			moderation
+// @Param			id		path	string				true	"Report id"
+// @Param			action	body	ReportActionRequest	true	"Action to take"
+// @Produce		json
+// @Success		204	{object}	nil
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/report/{id}/action [post]
+func ReportActionHandler(imagesPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		reportID, err := strconv.ParseUint(muxie.GetParam(w, "id"), 10, 0)
+		if err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, "invalid report id")
+			return
+		}
+
+		var req ReportActionRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+			slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+			return
+		}
+
+		db := util.GetDbContext(r.Context())
+		report, err := util.GetReportByID(db, uint(reportID))
+		if err != nil {
+			httputil.WriteError(w, http.StatusNotFound, "report not found")
+			return
+		}
+
+		// moderators can act on the reports about the documents they
+		// moderate, but only admins can ban users
+		if !middleware.GetAdmin(r) {
+			path, err := getReportDocumentPath(db, report)
+			if err != nil {
+				httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+				return
+			}
+			canModerate, err := CanModeratePath(db, r, path)
+			if err != nil {
+				httputil.WriteError(w, http.StatusInternalServerError, "failed to get moderator scopes")
+				slog.With("err", err).ErrorContext(r.Context(), "failed to get moderator scopes")
+				return
+			}
+			if !canModerate || req.Action == ReportActionBan {
+				httputil.WriteError(w, http.StatusForbidden, "you are not admin or moderator of this document")
+				return
+			}
+		}
+
+		switch req.Action {
+		case ReportActionDismiss, ReportActionRemove, ReportActionBan, ReportActionApprove:
+		default:
+			httputil.WriteError(w, http.StatusBadRequest, "the action must be either dismiss, remove, ban or approve")
+			return
+		}
+		if req.Action == ReportActionRemove && report.TargetType == models.ReportTargetUser {
+			httputil.WriteError(w, http.StatusBadRequest, "users cannot be removed, ban them instead")
+			return
+		}
+
+		var owner *models.User
+		if req.Action == ReportActionBan {
+			owner, err = getReportTargetOwner(db, report)
+			if err != nil {
+				httputil.WriteError(w, http.StatusInternalServerError, "failed to get the reported user")
+				slog.With("report", report, "err", err).ErrorContext(r.Context(), "failed to get the reported user")
+				return
+			}
+		}
+
+		admin := middleware.MustGetUser(r)
+		targetType := models.AuditTargetType(report.TargetType)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			switch req.Action {
+			case ReportActionDismiss:
+				// only this report is closed, the others about the same
+				// target stay open
+				if err := tx.Delete(report).Error; err != nil {
+					return err
+				}
+				return RecordAuditEvent(tx, r, models.AuditActionDismissed, models.AuditTargetReport,
+					muxie.GetParam(w, "id"), reportSummary(report), nil)
+
+			case ReportActionRemove:
+				if err := removeReportTarget(tx, report, admin.ID, req.Reason); err != nil {
+					return err
+				}
+				event := NewAuditEvent(r, models.AuditActionDeleted, targetType, report.TargetID)
+				event.Chain = true
+				if err := recordAuditEvent(tx, event, nil, reportSummary(report)); err != nil {
+					return err
+				}
+
+			case ReportActionBan:
+				err := util.BanUnbanUser(tx, owner.Username, true, admin.ID, req.Reason, nil)
+				if err == nil {
+					err = RecordAuditEvent(tx, r, models.AuditActionBanned, models.AuditTargetUser,
+						strconv.FormatUint(uint64(owner.ID), 10), nil, banSummary(req.Reason, nil))
+				}
+				if err != nil && !errors.Is(err, util.ErrUserAlreadyBanned) {
+					return err
+				}
+
+			case ReportActionApprove:
+				if err := approveReportTarget(tx, report, admin.ID); err != nil {
+					return err
+				}
+				err := RecordAuditEvent(tx, r, models.AuditActionApproved, targetType, report.TargetID, nil, reportSummary(report))
+				if err != nil {
+					return err
+				}
+			}
+
+			return util.CloseReportsByTarget(tx, report.TargetType, report.TargetID)
+		})
+		if errors.Is(err, errInvalidReportTarget) {
+			httputil.WriteError(w, http.StatusBadRequest, "only answers waiting for review can be approved")
+			return
+		} else if err != nil {
+			httputil.WriteError(w, http.StatusInternalServerError, "failed to act on the report")
+			slog.With("report", report, "action", req.Action, "err", err).ErrorContext(r.Context(), "failed to act on the report")
+			return
+		}
+		if req.Action == ReportActionRemove || req.Action == ReportActionApprove {
+			// approving may auto-approve other answers of the author
+			util.GetResponseCache().InvalidateAll()
+		}
+		// the file of a removed image outlives its record if removing it
+		// fails, fsck reports it as an orphan
+		if req.Action == ReportActionRemove && report.TargetType == models.ReportTargetImage {
+			if err := util.RemoveImageFile(r.Context(), imagesPath, report.TargetID); err != nil {
+				slog.With("image", report.TargetID, "err", err).ErrorContext(r.Context(), "failed to delete image file")
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type ModeratorScope struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Username      string `json:"username"`
+	UserAvatarURL string `json:"user_avatar_url"`
+	PathPrefix    string `json:"path_prefix"`
+	GrantedBy     string `json:"granted_by"`
+}
+
+type ModeratorScopeRequest struct {
+	Username   string `json:"username"`
+	PathPrefix string `json:"path_prefix"`
+}
+
+// CanModeratePath reports whether the requester can moderate the content of
+// the given document path, either by being an admin or by having been
+// granted a moderator scope which covers it
+func CanModeratePath(db *gorm.DB, req *http.Request, documentPath string) (bool, error) {
+	if middleware.GetAdmin(req) {
+		return true, nil
+	}
+
+	user, err := middleware.GetUser(req)
+	if err != nil {
+		return false, nil
+	}
+	return util.IsScopedModerator(db, user.ID, documentPath)
+}
+
+// moderatedPathFilter returns a function reporting whether the requester can
+// moderate a document path, loading the scopes only once. The second return
+// value is false if the requester is neither an admin nor a moderator.
+func moderatedPathFilter(db *gorm.DB, req *http.Request) (func(string) bool, bool, error) {
+	if middleware.GetAdmin(req) {
+		return func(string) bool { return true }, true, nil
+	}
+
+	user, err := middleware.GetUser(req)
+	if err != nil {
+		return nil, false, nil
+	}
+	scopes, err := util.GetModeratorScopesByUser(db, user.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(scopes) == 0 {
+		return nil, false, nil
+	}
+
+	return func(path string) bool {
+		for _, scope := range scopes {
+			if util.ScopeContainsPath(scope.PathPrefix, path) {
+				return true
+			}
+		}
+		return false
+	}, true, nil
+}
+
+// @Summary		Get all moderator scopes
+// @Description	Get all the document paths users have been granted moderator rights on
+// @Tags			moderation
+// @Produce		json
+// @Success		200	{object}	[]ModeratorScope
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/moderators [get]
+func GetModeratorScopesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	scopes, err := util.GetModeratorScopes(db)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get moderators")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get moderators")
+		return
+	}
+
+	returnScopes := make([]ModeratorScope, 0, len(scopes))
+	for _, scope := range scopes {
+		returnScopes = append(returnScopes, ModeratorScope{
+			ID:            scope.ID,
+			CreatedAt:     scope.CreatedAt,
+			Username:      getUsernameOrSystem(db, scope.UserID),
+			UserAvatarURL: util.GetPublicAvatarURL(scope.UserID),
+			PathPrefix:    scope.PathPrefix,
+			GrantedBy:     getUsernameOrSystem(db, scope.GrantedBy),
+		})
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnScopes)
+}
+
+// @Summary		Grant moderator rights
+// @Description	Grant a user moderator rights on the documents whose path starts with the given prefix
+// @Tags			moderation
+// @Param			scope	body	ModeratorScopeRequest	true	"User and path prefix"
+// @Produce		json
+// @Success		200	{object}	ModeratorScope
+// @Failure		400	{object}	httputil.ApiError
+// @Failure		409	{object}	httputil.ApiError
+// @Router			/moderation/moderators [post]
+func PostModeratorScopeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	var req ModeratorScopeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	if req.Username == "" || req.PathPrefix == "" {
+		httputil.WriteError(w, http.StatusBadRequest, "username and path_prefix are required")
+		return
+	}
+	pathPrefix := util.NormalizePathPrefix(req.PathPrefix)
+	if pathPrefix == "" {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid path_prefix")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	user, err := util.GetUserByUsername(db, req.Username)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "user not found")
+		return
+	}
+
+	admin := middleware.MustGetUser(r)
+	scope := models.ModeratorScope{
+		UserID:     user.ID,
+		PathPrefix: pathPrefix,
+		GrantedBy:  admin.ID,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&scope).Error; err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, r, models.AuditActionGranted, models.AuditTargetModeratorScope,
+			strconv.FormatUint(uint64(scope.ID), 10), nil, moderatorScopeSummary(&scope))
+	})
+	if util.IsUniqueViolation(err) {
+		httputil.WriteError(w, http.StatusConflict, "the user is already a moderator of this path prefix")
+		return
+	} else if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to grant moderator rights")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to grant moderator rights")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, ModeratorScope{
+		ID:            scope.ID,
+		CreatedAt:     scope.CreatedAt,
+		Username:      user.Username,
+		UserAvatarURL: util.GetPublicAvatarURL(user.ID),
+		PathPrefix:    scope.PathPrefix,
+		GrantedBy:     admin.Username,
+	})
+}
+
+// @Summary		Revoke moderator rights
+// @Description	Revoke a moderator scope given its ID
+// @Tags			moderation
+// @Param			id	path	string	true	"Moderator scope id"
+// @Produce		json
+// @Success		204	{object}	nil
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/moderators/{id} [delete]
+func DeleteModeratorScopeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	scopeID, err := strconv.ParseUint(muxie.GetParam(w, "id"), 10, 0)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid moderator scope id")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	var scope models.ModeratorScope
+	if err := db.First(&scope, scopeID).Error; err != nil {
+		httputil.WriteError(w, http.StatusNotFound, "moderator scope not found")
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&scope).Error; err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, r, models.AuditActionRevoked, models.AuditTargetModeratorScope,
+			muxie.GetParam(w, "id"), moderatorScopeSummary(&scope), nil)
+	})
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to revoke moderator rights")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to revoke moderator rights")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,18 +1,24 @@
 package proposal
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
 
 	"github.com/cartabinaria/auth/pkg/httputil"
 	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/api"
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// errNotModerator rolls back the approval of proposals the moderator can't
+// moderate
+var errNotModerator = errors.New("not a moderator of the proposal")
+
 // @Summary		Get proposals by document id
 // @Description	Get all proposals for a document, given its ID
 // @Tags			proposal
@@ -27,12 +33,12 @@ func GetProposalByDocumentHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	docID := muxie.GetParam(res, "id")
 
 	var questions []models.Proposal
 	if err := db.Where("document = ?", docID).Find(&questions).Error; err != nil {
-		slog.Error("db query failed", "err", err)
+		slog.ErrorContext(req.Context(), "db query failed", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "db query failed")
 		return
 	}
@@ -58,11 +64,24 @@ func DeleteProposalByDocumentHandler(res http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	docID := muxie.GetParam(res, "id")
 
-	if err := db.Where("document = ?", docID).Delete(&models.Proposal{}).Error; err != nil {
-		slog.With("err", err).Error("db query failed")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var proposals []models.Proposal
+		if err := tx.Clauses(clause.Returning{}).Where("document = ?", docID).Delete(&proposals).Error; err != nil {
+			return err
+		}
+		for _, p := range proposals {
+			err := api.RecordAuditEvent(tx, req, models.AuditActionDeleted, models.AuditTargetProposal, proposalID(&p), proposalSummary(&p), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.With("err", err).ErrorContext(req.Context(), "db query failed")
 		httputil.WriteError(res, http.StatusInternalServerError, "db query failed")
 		return
 	}
@@ -84,42 +103,71 @@ func ApproveProposalByDocumentHandler(res http.ResponseWriter, req *http.Request
 		return
 	}
 
-	if !middleware.GetMember(req) && !middleware.GetAdmin(req) {
-		httputil.WriteError(res, http.StatusForbidden, "you are not a member or admin")
-		return
-	}
-
 	docID := muxie.GetParam(res, "id")
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 
 	var proposals []models.Proposal
 	var questions []models.Question
+	isMemberOrAdmin := middleware.GetMember(req) || middleware.GetAdmin(req)
 
 	err := db.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Clauses(clause.Returning{}).Where("document_id = ?", docID).Delete(&proposals).Error; err != nil {
-			slog.Error("error while deleting proposals", "proposals", proposals, "err", err)
+			slog.ErrorContext(req.Context(), "error while deleting proposals", "proposals", proposals, "err", err)
 			return err
 		}
+		if len(proposals) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// the paths are sent by the proposers, so the moderators must
+		// moderate every one of them
+		if !isMemberOrAdmin {
+			for _, proposal := range proposals {
+				canModerate, err := api.CanModeratePath(tx, req, proposal.DocumentPath)
+				if err != nil {
+					return err
+				}
+				if !canModerate {
+					return errNotModerator
+				}
+			}
+		}
 
 		for _, proposal := range proposals {
 			questions = append(questions, models.Question{
-				Document: proposal.DocumentID,
-				Start:    proposal.Start,
-				End:      proposal.End,
-				UserID:   proposal.UserID,
+				Document:     proposal.DocumentID,
+				DocumentPath: proposal.DocumentPath,
+				Start:        proposal.Start,
+				End:          proposal.End,
+				UserID:       proposal.UserID,
 			})
 		}
 
 		if err := tx.Create(&questions).Error; err != nil {
-			slog.Error("error while creating the questions", "questions", questions, "err", err)
+			slog.ErrorContext(req.Context(), "error while creating the questions", "questions", questions, "err", err)
 			return err
 		}
 
+		for i, proposal := range proposals {
+			err := api.RecordAuditEvent(tx, req, models.AuditActionApproved, models.AuditTargetProposal, proposalID(&proposal),
+				proposalSummary(&proposal), map[string]uint{"question_id": questions[i].ID})
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	if err != nil {
-		slog.With("err", err).Error("transaction failed")
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		httputil.WriteError(res, http.StatusNotFound, "proposal not found")
+		return
+	case errors.Is(err, errNotModerator):
+		httputil.WriteError(res, http.StatusForbidden, "you are not a member, admin or moderator of every proposal")
+		return
+	case err != nil:
+		slog.With("err", err).ErrorContext(req.Context(), "transaction failed")
 		httputil.WriteError(res, http.StatusInternalServerError, "transaction failed")
 		return
 	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(docID), util.DocumentListTag)
 }
@@ -2,6 +2,7 @@ package proposal
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -11,7 +12,7 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
+	"gorm.io/gorm"
 )
 
 type UpdateProposalRequest struct {
@@ -32,7 +33,7 @@ func GetProposalByIdHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	proposalID := muxie.GetParam(res, "id")
 	propID, err := strconv.ParseUint(proposalID, 10, 0)
 	if err != nil {
@@ -63,7 +64,7 @@ func DeleteProposalByIdHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	proposalID := muxie.GetParam(res, "id")
 	propID, err := strconv.ParseUint(proposalID, 10, 0)
 	if err != nil {
@@ -71,7 +72,19 @@ func DeleteProposalByIdHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := db.Delete(&models.Proposal{}, propID).Error; err != nil {
+	var proposal models.Proposal
+	if err := db.First(&proposal, propID).Error; err != nil {
+		httputil.WriteError(res, http.StatusNotFound, "proposal not found")
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&proposal).Error; err != nil {
+			return err
+		}
+		return api.RecordAuditEvent(tx, req, models.AuditActionDeleted, models.AuditTargetProposal, proposalID, proposalSummary(&proposal), nil)
+	})
+	if err != nil {
 		httputil.WriteError(res, http.StatusInternalServerError, "db query failed")
 		return
 	}
@@ -99,7 +112,7 @@ func UpdateProposalByIdHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	proposalID := muxie.GetParam(res, "id")
 	propID, err := strconv.ParseUint(proposalID, 10, 0)
 	if err != nil {
@@ -113,11 +126,18 @@ func UpdateProposalByIdHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before := proposalSummary(&proposal)
 	proposal.Start = data.Coords.Start
 	proposal.Start = data.Coords.End
 
-	if err := db.Save(&proposal).Error; err != nil {
-		slog.Error("error while updating proposal", "proposal", proposal, "err", err)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&proposal).Error; err != nil {
+			return err
+		}
+		return api.RecordAuditEvent(tx, req, models.AuditActionUpdated, models.AuditTargetProposal, proposalID, before, proposalSummary(&proposal))
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "error while updating proposal", "proposal", proposal, "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "error while updating answer")
 		return
 	}
@@ -2,6 +2,7 @@ package proposal
 
 import (
 	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/cartabinaria/polleg/models"
@@ -54,3 +55,17 @@ func dbProposalsToProposals(db *gorm.DB, p []models.Proposal) []Proposal {
 	}
 	return res
 }
+
+func proposalSummary(p *models.Proposal) map[string]any {
+	return map[string]any{
+		"document":      p.DocumentID,
+		"document_path": p.DocumentPath,
+		"start":         p.Start,
+		"end":           p.End,
+		"user_id":       p.UserID,
+	}
+}
+
+func proposalID(p *models.Proposal) string {
+	return strconv.FormatUint(p.ID, 10)
+}
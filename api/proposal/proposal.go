@@ -2,7 +2,9 @@ package proposal
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 
 	"github.com/cartabinaria/auth/pkg/httputil"
@@ -11,7 +13,6 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -52,11 +53,11 @@ func PostProposalHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 	_, err := util.GetOrCreateUserByID(db, user.ID, user.Username)
 	if err != nil {
-		slog.With("user", user, "err", err).Error("error while getting or creating the user-alias association")
+		slog.With("user", user, "err", err).ErrorContext(req.Context(), "error while getting or creating the user-alias association")
 		httputil.WriteError(res, http.StatusBadRequest, "could not insert the answer")
 		return
 	}
@@ -74,7 +75,19 @@ func PostProposalHandler(res http.ResponseWriter, req *http.Request) {
 		questions = append(questions, q)
 	}
 
-	if err := db.Save(questions).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(questions).Error; err != nil {
+			return err
+		}
+		for _, q := range questions {
+			err := api.RecordAuditEvent(tx, req, models.AuditActionCreated, models.AuditTargetProposal, proposalID(&q), nil, proposalSummary(&q))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		httputil.WriteError(res, http.StatusInternalServerError, "couldn't create questions")
 		return
 	}
@@ -104,18 +117,37 @@ func GetAllProposalsHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	db := util.GetDbContext(req.Context())
+	user := middleware.MustGetUser(req)
+	var scopes []models.ModeratorScope
 	if !middleware.GetMember(req) && !middleware.GetAdmin(req) {
-		httputil.WriteError(res, http.StatusForbidden, "you are not a member or admin")
-		return
+		var err error
+		scopes, err = util.GetModeratorScopesByUser(db, user.ID)
+		if err != nil {
+			httputil.WriteError(res, http.StatusInternalServerError, "db query failed")
+			return
+		}
+		if len(scopes) == 0 {
+			httputil.WriteError(res, http.StatusForbidden, "you are not a member, admin or moderator")
+			return
+		}
 	}
 
-	db := util.GetDb()
 	var dbProposals []models.Proposal
 	if err := db.Find(&dbProposals).Error; err != nil {
 		httputil.WriteError(res, http.StatusInternalServerError, "db query failed")
 		return
 	}
 
+	// moderators only see the proposals of the documents they moderate
+	if len(scopes) > 0 {
+		dbProposals = slices.DeleteFunc(dbProposals, func(p models.Proposal) bool {
+			return !slices.ContainsFunc(scopes, func(s models.ModeratorScope) bool {
+				return util.ScopeContainsPath(s.PathPrefix, p.DocumentPath)
+			})
+		})
+	}
+
 	proposals := dbProposalsToProposals(db, dbProposals)
 
 	// group proposal by the document
@@ -149,11 +181,6 @@ func ApproveProposalHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !middleware.GetMember(req) && !middleware.GetAdmin(req) {
-		httputil.WriteError(res, http.StatusForbidden, "you are not a member or admin")
-		return
-	}
-
 	rawID := muxie.GetParam(res, "id")
 	proposalID, err := strconv.Atoi(rawID)
 	if err != nil {
@@ -161,39 +188,60 @@ func ApproveProposalHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 	_, err = util.GetOrCreateUserByID(db, user.ID, user.Username)
 
 	var proposal models.Proposal
 	var question models.Question
 
+	if err := db.First(&proposal, proposalID).Error; err != nil {
+		httputil.WriteError(res, http.StatusNotFound, "proposal not found")
+		return
+	}
+
+	if !middleware.GetMember(req) {
+		canModerate, err := api.CanModeratePath(db, req, proposal.DocumentPath)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "error while getting moderator scopes", "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "could not approve proposal")
+			return
+		}
+		if !canModerate {
+			httputil.WriteError(res, http.StatusForbidden, "you are not a member, admin or moderator")
+			return
+		}
+	}
+
 	err = db.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Clauses(clause.Returning{}).Delete(&proposal, proposalID).Error; err != nil {
-			slog.Error("error while deleting proposal", "proposal", proposal, "err", err)
+			slog.ErrorContext(req.Context(), "error while deleting proposal", "proposal", proposal, "err", err)
 			return err
 		}
 
 		// Create question
 		question = models.Question{
-			Document: proposal.DocumentID,
-			Start:    proposal.Start,
-			End:      proposal.End,
-			UserID:   uint(user.ID),
+			Document:     proposal.DocumentID,
+			DocumentPath: proposal.DocumentPath,
+			Start:        proposal.Start,
+			End:          proposal.End,
+			UserID:       uint(user.ID),
 		}
 
 		if err := tx.Create(&question).Error; err != nil {
-			slog.Error("error while creating the question", "question", question, "err", err)
+			slog.ErrorContext(req.Context(), "error while creating the question", "question", question, "err", err)
 			return err
 		}
 
-		return nil
+		return api.RecordAuditEvent(tx, req, models.AuditActionApproved, models.AuditTargetProposal, rawID,
+			proposalSummary(&proposal), map[string]uint{"question_id": question.ID})
 	})
 
 	if err != nil {
 		httputil.WriteError(res, http.StatusBadRequest, "could not approve proposal")
 		return
 	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(question.Document), util.DocumentListTag)
 
 	httputil.WriteData(res, http.StatusOK, api.Question{
 		ID:        question.ID,
@@ -1,9 +1,9 @@
 package api
 
 import (
+	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/cartabinaria/auth"
@@ -12,7 +12,7 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
+	"gorm.io/gorm"
 )
 
 type Question struct {
@@ -30,8 +30,10 @@ type Question struct {
 // @Description	Given a question ID, return the question and all its answers
 // @Tags			question
 // @Param			id	path	string	true	"Answer id"
+// @Param			If-None-Match	header	string	false	"ETag of a previous response"
 // @Produce		json
 // @Success		200	{array}		Question
+// @Success		304	"not modified"
 // @Failure		400	{object}	httputil.ApiError
 // @Router			/questions/{id} [get]
 func GetQuestionHandler(res http.ResponseWriter, req *http.Request) {
@@ -40,7 +42,7 @@ func GetQuestionHandler(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	rawQID := muxie.GetParam(res, "id")
 
 	user, err := middleware.GetUser(req)
@@ -58,26 +60,31 @@ func GetQuestionHandler(res http.ResponseWriter, req *http.Request) {
 
 	var question models.Question
 	if err := db.First(&question, uint(qID)).Error; err != nil {
-		slog.Error("question not found", "err", err)
+		slog.ErrorContext(req.Context(), "question not found", "err", err)
 		httputil.WriteError(res, http.StatusNotFound, "question not found")
 		return
 	}
 
-	var answers []models.Answer
+	depth, err := util.GetSetting(db, util.SettingRepliesDepth, "", 0)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "could not get the replies depth", "err", err)
+		httputil.WriteError(res, http.StatusInternalServerError, "could not fetch answers")
+		return
+	}
 
-	preloadingString := strings.Repeat("Replies.", RepliesDepth)
+	var answers []models.Answer
 
-	votesSubquery := createVotesSubquery(db)
-	err = applyVoteJoins(
+	votesSubquery := createVotesSubquery(db, requesterID)
+	query := applyVoteJoins(
 		db.Table("answers").
 			Where("answers.deleted_at IS NULL AND answers.parent IS NULL AND answers.question = ?", question.ID),
 		votesSubquery,
-	).
-		Preload(preloadingString[:len(preloadingString)-1], createPreloadFunction(votesSubquery)).
+	).Scopes(visibleAnswersScope(requesterID))
+	err = preloadReplies(query, int(depth), createPreloadFunction(votesSubquery, requesterID)).
 		Find(&answers).Error
 
 	if err != nil {
-		slog.Error("could not fetch answers", "err", err)
+		slog.ErrorContext(req.Context(), "could not fetch answers", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "could not fetch answers")
 		return
 	}
@@ -87,13 +94,14 @@ func GetQuestionHandler(res http.ResponseWriter, req *http.Request) {
 	// recursively convert answers
 	var responseAnswers []Answer
 	for _, ans := range question.Answers {
-		ans, err := ConvertAnswerToAPI(ans, isMemberOrAdmin, requesterID)
+		ans, err := ConvertAnswerToAPI(db, ans, isMemberOrAdmin, requesterID)
 		if err != nil {
 			return
 		}
 		responseAnswers = append(responseAnswers, *ans)
 	}
 
+	tagCachedResponse(req, util.DocumentTag(question.Document))
 	httputil.WriteData(res, http.StatusOK, Question{
 		ID:        question.ID,
 		CreatedAt: question.CreatedAt,
@@ -120,12 +128,7 @@ func DelQuestionHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	user := middleware.MustGetUser(req)
-	if user.Role == auth.RoleUser {
-		httputil.WriteError(res, http.StatusForbidden, "only members and admins can delete questions")
-		return
-	}
-
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	rawAnsID := muxie.GetParam(res, "id")
 
 	qID, err := strconv.ParseUint(rawAnsID, 10, 0)
@@ -134,11 +137,40 @@ func DelQuestionHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := db.Delete(&models.Question{}, uint(qID)).Error; err != nil {
-		slog.Error("something went wrong", "err", err)
+	var question models.Question
+	if err := db.First(&question, uint(qID)).Error; err != nil {
+		httputil.WriteError(res, http.StatusNotFound, "question not found")
+		return
+	}
+
+	if user.Role == auth.RoleUser {
+		canModerate, err := CanModeratePath(db, req, question.DocumentPath)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "couldn't get moderator scopes", "err", err)
+			httputil.WriteError(res, http.StatusInternalServerError, "something went wrong")
+			return
+		}
+		if !canModerate {
+			httputil.WriteError(res, http.StatusForbidden, "only members, admins and moderators can delete questions")
+			return
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&question).Error; err != nil {
+			return err
+		}
+		// only members, admins and moderators can delete questions
+		event := NewAuditEvent(req, models.AuditActionDeleted, models.AuditTargetQuestion, rawAnsID)
+		event.Chain = true
+		return recordAuditEvent(tx, event, questionSummary(&question), nil)
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "something went wrong", "err", err)
 		httputil.WriteError(res, http.StatusInternalServerError, "something went wrong")
 		return
 	}
+	util.GetResponseCache().Invalidate(util.DocumentTag(question.Document), util.DocumentListTag)
 
 	res.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type QueuedAnswer struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Question     uint   `json:"question"`
+	Parent       *uint  `json:"parent"`
+	DocumentPath string `json:"document_path"`
+	// Username is the real author, even for anonymous answers
+	Username   string `json:"username"`
+	Anonymous  bool   `json:"anonymous"`
+	Content    string `json:"content"`
+	HoldReason string `json:"hold_reason"`
+}
+
+type QueueReviewRequest struct {
+	Approve bool `json:"approve"`
+	// Reason is shown to the author when the answer is rejected
+	Reason string `json:"reason"`
+}
+
+type QueueReviewResponse struct {
+	// AutoApproved lists the answers approved because their author reached
+	// the trust threshold
+	AutoApproved []uint `json:"auto_approved"`
+}
+
+// getAnswerDocumentPath returns the document path of the question the answer
+// belongs to
+func getAnswerDocumentPath(db *gorm.DB, answer *models.Answer) (string, error) {
+	var question models.Question
+	if err := db.First(&question, answer.Question).Error; err != nil {
+		return "", err
+	}
+	return question.DocumentPath, nil
+}
+
+// @Summary		Get the pre-moderation queue
+// @Description	Get the answers waiting for approval, oldest first. Moderators only see the ones about the documents they moderate.
+// @Tags			moderation
+// @Produce		json
+// @Success		200	{object}	[]QueuedAnswer
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/queue [get]
+func GetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	canModerate, isModerator, err := moderatedPathFilter(db, r)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get moderator scopes")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get moderator scopes")
+		return
+	}
+	if !isModerator {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin or moderator")
+		return
+	}
+
+	answers, err := util.GetPendingAnswers(db)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get the queue")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get the queue")
+		return
+	}
+
+	queue := make([]QueuedAnswer, 0, len(answers))
+	for _, answer := range answers {
+		path, err := getAnswerDocumentPath(db, &answer)
+		if err != nil {
+			slog.With("answer_id", answer.ID, "err", err).ErrorContext(r.Context(), "failed to get the question of a queued answer")
+			continue
+		}
+		if !canModerate(path) {
+			continue
+		}
+
+		var version models.AnswerVersion
+		if err := db.Where("answer_id = ?", answer.ID).Last(&version).Error; err != nil {
+			slog.With("answer_id", answer.ID, "err", err).ErrorContext(r.Context(), "failed to get the content of a queued answer")
+			continue
+		}
+
+		queue = append(queue, QueuedAnswer{
+			ID:           answer.ID,
+			CreatedAt:    answer.CreatedAt,
+			Question:     answer.Question,
+			Parent:       answer.Parent,
+			DocumentPath: path,
+			Username:     getUsernameOrSystem(db, answer.UserId),
+			Anonymous:    answer.Anonymous,
+			Content:      version.Content,
+			HoldReason:   answer.HoldReason,
+		})
+	}
+
+	httputil.WriteData(w, http.StatusOK, queue)
+}
+
+// @Summary		Review a queued answer
+// @Description	Approve or reject an answer waiting for approval. Approving it may make its author trusted, which approves their other answers held by the trust policy.
+// @Tags			moderation
+// @Param			id		path	string				true	"Answer id"
+// @Param			review	body	QueueReviewRequest	true	"Review outcome"
+// @Produce		json
+// @Success		200	{object}	QueueReviewResponse
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/queue/{id} [post]
+func ReviewQueuedAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	answerID, err := strconv.ParseUint(muxie.GetParam(w, "id"), 10, 0)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid answer id")
+		return
+	}
+
+	var req QueueReviewRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	var answer models.Answer
+	if err := db.First(&answer, answerID).Error; err != nil {
+		httputil.WriteError(w, http.StatusNotFound, "answer not found")
+		return
+	}
+	if answer.State != models.AnswerStatePending {
+		httputil.WriteError(w, http.StatusBadRequest, "the answer is not waiting for approval")
+		return
+	}
+
+	path, err := getAnswerDocumentPath(db, &answer)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get the question")
+		slog.With("answer_id", answer.ID, "err", err).ErrorContext(r.Context(), "failed to get the question")
+		return
+	}
+	canModerate, err := CanModeratePath(db, r, path)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get moderator scopes")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get moderator scopes")
+		return
+	}
+	if !canModerate {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin or moderator of this document")
+		return
+	}
+
+	moderator := middleware.MustGetUser(r)
+	res := QueueReviewResponse{AutoApproved: []uint{}}
+	targetID := strconv.FormatUint(answerID, 10)
+	before := answerSummary(&answer)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		action := models.AuditActionRejected
+		if req.Approve {
+			action = models.AuditActionApproved
+			approved, err := util.ApproveAnswer(tx, &answer, moderator.ID)
+			if err != nil {
+				return err
+			}
+			for _, id := range approved {
+				event := NewAuditEvent(r, models.AuditActionApproved, models.AuditTargetAnswer, strconv.FormatUint(uint64(id), 10))
+				event.ActorID = SYSTEM_USER_ID
+				if err := util.RecordAuditEvent(tx, event); err != nil {
+					return err
+				}
+				res.AutoApproved = append(res.AutoApproved, id)
+			}
+		} else {
+			err := util.ChangeAnswerState(tx, &answer, models.AnswerStateDeletedByAdmin, moderator.ID, req.Reason)
+			if err != nil {
+				return err
+			}
+		}
+		if err := RecordAuditEvent(tx, r, action, models.AuditTargetAnswer, targetID, before, answerSummary(&answer)); err != nil {
+			return err
+		}
+
+		// the answer has been reviewed, the reports of the content filter
+		// about it are not needed anymore
+		return util.CloseReportsByTarget(tx, models.ReportTargetAnswer, targetID)
+	})
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to review the answer")
+		slog.With("answer_id", answer.ID, "err", err).ErrorContext(r.Context(), "failed to review the answer")
+		return
+	}
+	if len(res.AutoApproved) > 0 {
+		// the auto-approved answers may belong to any document
+		util.GetResponseCache().InvalidateAll()
+	} else {
+		invalidateQuestionResponses(db, answer.Question)
+	}
+
+	httputil.WriteData(w, http.StatusOK, res)
+}
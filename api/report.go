@@ -0,0 +1,299 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ReportAction string
+
+const (
+	// ReportActionDismiss closes the report without touching its target
+	ReportActionDismiss ReportAction = "dismiss"
+	// ReportActionRemove deletes the reported answer, question or image
+	ReportActionRemove ReportAction = "remove"
+	// ReportActionBan bans the author of the reported content, or the
+	// reported user itself
+	ReportActionBan ReportAction = "ban"
+	// ReportActionApprove publishes an answer held for review
+	ReportActionApprove ReportAction = "approve"
+)
+
+var (
+	errInvalidReportTarget  = errors.New("invalid report target")
+	errReportTargetNotFound = errors.New("report target not found")
+)
+
+// ReportPreview contains a short, target specific, summary of the reported
+// content, so that admins don't have to fetch it by themselves
+type ReportPreview struct {
+	Content      string `json:"content,omitempty"`
+	QuestionID   uint   `json:"question_id,omitempty"`
+	DocumentID   string `json:"document_id,omitempty"`
+	DocumentPath string `json:"document_path,omitempty"`
+	ImageURL     string `json:"image_url,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Alias        string `json:"alias,omitempty"`
+	// Missing is true when the target doesn't exist anymore
+	Missing bool `json:"missing"`
+}
+
+// resolveReportTarget validates the target sent by the client, checks that it
+// exists and returns the ID to be stored in the report. Users can be
+// reported either by username or by alias, but are always stored by ID.
+func resolveReportTarget(db *gorm.DB, targetType models.ReportTargetType, rawID string) (string, error) {
+	switch targetType {
+	case models.ReportTargetAnswer, models.ReportTargetQuestion:
+		id, err := strconv.ParseUint(rawID, 10, 0)
+		if err != nil {
+			return "", errInvalidReportTarget
+		}
+
+		var model any = &models.Answer{}
+		if targetType == models.ReportTargetQuestion {
+			model = &models.Question{}
+		}
+		if err := db.First(model, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", errReportTargetNotFound
+			}
+			return "", err
+		}
+		return strconv.FormatUint(id, 10), nil
+
+	case models.ReportTargetImage:
+		if _, err := uuid.Parse(rawID); err != nil {
+			return "", errInvalidReportTarget
+		}
+		if _, err := util.GetImageByID(db, rawID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", errReportTargetNotFound
+			}
+			return "", err
+		}
+		return rawID, nil
+
+	case models.ReportTargetUser:
+		if rawID == "" {
+			return "", errInvalidReportTarget
+		}
+		var user models.User
+		if err := db.Where("alias = ? OR username = ?", rawID, rawID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", errReportTargetNotFound
+			}
+			return "", err
+		}
+		return strconv.FormatUint(uint64(user.ID), 10), nil
+	}
+
+	return "", errInvalidReportTarget
+}
+
+// numericTargetID parses the ID of targets identified by an integer
+func numericTargetID(report *models.Report) (uint, error) {
+	id, err := strconv.ParseUint(report.TargetID, 10, 0)
+	if err != nil {
+		return 0, errInvalidReportTarget
+	}
+	return uint(id), nil
+}
+
+// getReportTargetOwner returns the user responsible for the reported target
+func getReportTargetOwner(db *gorm.DB, report *models.Report) (*models.User, error) {
+	var userID uint
+
+	switch report.TargetType {
+	case models.ReportTargetAnswer:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return nil, err
+		}
+		var answer models.Answer
+		if err := db.First(&answer, id).Error; err != nil {
+			return nil, err
+		}
+		userID = answer.UserId
+	case models.ReportTargetQuestion:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return nil, err
+		}
+		var question models.Question
+		if err := db.First(&question, id).Error; err != nil {
+			return nil, err
+		}
+		userID = question.UserID
+	case models.ReportTargetImage:
+		image, err := util.GetImageByID(db, report.TargetID)
+		if err != nil {
+			return nil, err
+		}
+		userID = image.UserID
+	case models.ReportTargetUser:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return nil, err
+		}
+		userID = id
+	default:
+		return nil, errInvalidReportTarget
+	}
+
+	return util.GetUserByID(db, userID)
+}
+
+func getReportPreview(db *gorm.DB, report *models.Report) (ReportPreview, error) {
+	var preview ReportPreview
+
+	switch report.TargetType {
+	case models.ReportTargetAnswer:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return preview, err
+		}
+		var answer models.Answer
+		if err := db.First(&answer, id).Error; err != nil {
+			return preview, err
+		}
+		var latestVersion models.AnswerVersion
+		if err := db.Where("answer_id = ?", answer.ID).Last(&latestVersion).Error; err != nil {
+			return preview, err
+		}
+		preview.Content = latestVersion.Content
+		preview.QuestionID = answer.Question
+
+	case models.ReportTargetQuestion:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return preview, err
+		}
+		var question models.Question
+		if err := db.First(&question, id).Error; err != nil {
+			return preview, err
+		}
+		preview.QuestionID = question.ID
+		preview.DocumentID = question.Document
+		preview.DocumentPath = question.DocumentPath
+
+	case models.ReportTargetImage:
+		image, err := util.GetImageByID(db, report.TargetID)
+		if err != nil {
+			return preview, err
+		}
+		preview.ImageURL = fmt.Sprintf("/images/%s", image.ID)
+
+	case models.ReportTargetUser:
+		// handled below, as the owner is the user itself
+
+	default:
+		return preview, errInvalidReportTarget
+	}
+
+	owner, err := getReportTargetOwner(db, report)
+	if err != nil {
+		return preview, err
+	}
+	preview.Username = owner.Username
+	preview.Alias = owner.Alias
+
+	return preview, nil
+}
+
+// removeReportTarget deletes the reported content, as an admin would do
+// through the target-specific endpoints. The file of an image is left to be
+// removed once the transaction has committed, so that a rollback doesn't keep
+// a record without its file.
+func removeReportTarget(db *gorm.DB, report *models.Report, adminID uint, reason string) error {
+	switch report.TargetType {
+	case models.ReportTargetAnswer:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return err
+		}
+		var answer models.Answer
+		if err := db.First(&answer, id).Error; err != nil {
+			return err
+		}
+		return util.ChangeAnswerState(db, &answer, models.AnswerStateDeletedByAdmin, adminID, reason)
+	case models.ReportTargetQuestion:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return err
+		}
+		var question models.Question
+		if err := db.First(&question, id).Error; err != nil {
+			return err
+		}
+		return db.Delete(&question).Error
+	case models.ReportTargetImage:
+		image, err := util.GetImageByID(db, report.TargetID)
+		if err != nil {
+			return err
+		}
+		return db.Delete(image).Error
+	}
+
+	return errInvalidReportTarget
+}
+
+// approveReportTarget makes visible an answer held for review
+func approveReportTarget(db *gorm.DB, report *models.Report, adminID uint) error {
+	if report.TargetType != models.ReportTargetAnswer {
+		return errInvalidReportTarget
+	}
+
+	id, err := numericTargetID(report)
+	if err != nil {
+		return err
+	}
+	var answer models.Answer
+	if err := db.First(&answer, id).Error; err != nil {
+		return err
+	}
+	if answer.State != models.AnswerStatePending {
+		return errInvalidReportTarget
+	}
+	_, err = util.ApproveAnswer(db, &answer, adminID)
+	return err
+}
+
+// getReportDocumentPath returns the document path of the reported content, to
+// check moderator scopes against. Images and users don't belong to any
+// document, so they can only be moderated by admins.
+func getReportDocumentPath(db *gorm.DB, report *models.Report) (string, error) {
+	var questionID uint
+
+	switch report.TargetType {
+	case models.ReportTargetAnswer:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return "", err
+		}
+		var answer models.Answer
+		if err := db.First(&answer, id).Error; err != nil {
+			return "", err
+		}
+		questionID = answer.Question
+	case models.ReportTargetQuestion:
+		id, err := numericTargetID(report)
+		if err != nil {
+			return "", err
+		}
+		questionID = id
+	default:
+		return "", nil
+	}
+
+	var question models.Question
+	if err := db.Unscoped().First(&question, questionID).Error; err != nil {
+		return "", err
+	}
+	return question.DocumentPath, nil
+}
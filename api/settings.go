@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cartabinaria/auth"
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"gorm.io/gorm"
+)
+
+// Setting is a runtime setting with its global value and its overrides
+type Setting struct {
+	util.SettingDefinition
+	Value     int64             `json:"value"`
+	Overrides []SettingOverride `json:"overrides"`
+}
+
+// SettingOverride is the value of a quota for a role or for a user
+type SettingOverride struct {
+	Role      string    `json:"role,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Value     int64     `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// SettingRequest changes the global value of a setting, or its override for
+// a role or a user if one of them is given. A null value restores the default
+// or removes the override.
+type SettingRequest struct {
+	Key      util.SettingKey `json:"key"`
+	Role     string          `json:"role"`
+	Username string          `json:"username"`
+	Value    *int64          `json:"value"`
+}
+
+// settingAudit is the summary of a setting stored in the audit events
+type settingAudit struct {
+	Role     string `json:"role,omitempty"`
+	Username string `json:"username,omitempty"`
+	Value    int64  `json:"value"`
+}
+
+func getSettings(db *gorm.DB) ([]Setting, error) {
+	rows, err := util.GetSettings(db)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Setting, 0, len(util.SettingDefinitions))
+	for _, def := range util.SettingDefinitions {
+		setting := Setting{SettingDefinition: def, Value: def.Default, Overrides: []SettingOverride{}}
+		for _, row := range rows {
+			if row.Key != string(def.Key) {
+				continue
+			}
+			if row.Role == "" && row.UserID == 0 {
+				setting.Value = row.Value
+				continue
+			}
+			override := SettingOverride{
+				Role:      row.Role,
+				Value:     row.Value,
+				UpdatedAt: row.UpdatedAt,
+				UpdatedBy: getUsernameOrSystem(db, row.UpdatedBy),
+			}
+			if row.UserID != 0 {
+				override.Username = getUsernameOrSystem(db, row.UserID)
+			}
+			setting.Overrides = append(setting.Overrides, override)
+		}
+		result = append(result, setting)
+	}
+	return result, nil
+}
+
+// @Summary		Get the runtime settings
+// @Description	Get the limits and quotas with their global values and their overrides per role and per user
+// @Tags			admin
+// @Produce		json
+// @Success		200	{object}	[]Setting
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/admin/settings [get]
+func GetSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	settings, err := getSettings(util.GetDbContext(r.Context()))
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get settings")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get settings")
+		return
+	}
+
+	httputil.WriteData(w, http.StatusOK, settings)
+}
+
+// @Summary		Change a runtime setting
+// @Description	Change the global value of a setting, or override a quota for a role or a user. A null value restores the default or removes the override.
+// @Tags			admin
+// @Param			setting	body	SettingRequest	true	"Setting and its new value"
+// @Produce		json
+// @Success		200	{object}	[]Setting
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/admin/settings [put]
+func PutSettingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	var req SettingRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	switch auth.Role(req.Role) {
+	case "", auth.RoleAdmin, auth.RoleMember, auth.RoleUser:
+	default:
+		httputil.WriteError(w, http.StatusBadRequest, "invalid role")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	var userID uint
+	if req.Username != "" {
+		user, err := util.GetUserByUsername(db, req.Username)
+		if err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, "user not found")
+			return
+		}
+		userID = user.ID
+	}
+
+	targetID := string(req.Key)
+	if req.Role != "" {
+		targetID += "@role:" + req.Role
+	} else if userID != 0 {
+		targetID += fmt.Sprintf("@user:%d", userID)
+	}
+
+	admin := middleware.MustGetUser(r)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		previous, err := util.SetSetting(tx, req.Key, req.Role, userID, req.Value, admin.ID)
+		if err != nil || (previous == nil && req.Value == nil) {
+			return err
+		}
+
+		action := models.AuditActionUpdated
+		var before, after any
+		if previous != nil {
+			before = settingAudit{req.Role, req.Username, *previous}
+		}
+		if req.Value != nil {
+			after = settingAudit{req.Role, req.Username, *req.Value}
+		} else {
+			action = models.AuditActionDeleted
+		}
+		return RecordAuditEvent(tx, r, action, models.AuditTargetSetting, targetID, before, after)
+	})
+	var rangeErr *util.SettingRangeError
+	switch {
+	case errors.Is(err, util.ErrUnknownSetting), errors.Is(err, util.ErrSettingNotOverridable),
+		errors.Is(err, util.ErrSettingScope), errors.As(err, &rangeErr):
+		httputil.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to change setting")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to change setting")
+		return
+	}
+	util.InvalidateSettingsCache()
+	if req.Key == util.SettingRepliesDepth {
+		util.GetResponseCache().InvalidateAll()
+	}
+
+	settings, err := getSettings(db)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get settings")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get settings")
+		return
+	}
+	httputil.WriteData(w, http.StatusOK, settings)
+}
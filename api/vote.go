@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 	"github.com/kataras/muxie"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
@@ -36,6 +38,8 @@ const (
 	VoteDown VoteValue = -1
 )
 
+var errNoVote = errors.New("no vote found to delete")
+
 // get given vote to an answer
 func GetUserVote(res http.ResponseWriter, req *http.Request) {
 	// Check method GET is used
@@ -43,7 +47,7 @@ func GetUserVote(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 
 	rawAnsID := muxie.GetParam(res, "id")
@@ -75,6 +79,7 @@ func GetUserVote(res http.ResponseWriter, req *http.Request) {
 // @Param			id	path		string	true	"code query parameter"
 // @Success		200	{object}	Vote
 // @Failure		400	{object}	httputil.ApiError
+// @Failure		429	{object}	httputil.ApiError
 // @Router			/answer/{id}/vote [post]
 func PostVote(res http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodGet {
@@ -86,7 +91,7 @@ func PostVote(res http.ResponseWriter, req *http.Request) {
 		httputil.WriteError(res, http.StatusMethodNotAllowed, "invalid method")
 		return
 	}
-	db := util.GetDb()
+	db := util.GetDbContext(req.Context())
 	user := middleware.MustGetUser(req)
 
 	rawAnsID := muxie.GetParam(res, "id")
@@ -114,33 +119,42 @@ func PostVote(res http.ResponseWriter, req *http.Request) {
 		UserId:   user.ID,
 		Vote:     int8(p.Vote),
 	}
-	switch p.Vote {
-	case VoteUp, VoteDown:
-		// If a vote already exists, and
-		err := db.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "answer_id"}, {Name: "user_id"}},
-			DoUpdates: clause.AssignmentColumns([]string{"vote"}),
-		}).Create(&vote).Error
-		if err != nil {
-			httputil.WriteError(res, http.StatusInternalServerError, "could not update your vote")
-			return
-		}
+	if p.Vote != VoteUp && p.Vote != VoteDown && p.Vote != VoteNone {
+		httputil.WriteError(res, http.StatusBadRequest, "the vote value must be either 1, -1 or 0")
+		return
+	}
 
-	case VoteNone:
-		result := db.Where("answer_id = ? AND user_id = ?", ans.ID, user.ID).Delete(&models.Vote{})
-		if result.Error != nil {
-			httputil.WriteError(res, http.StatusInternalServerError, "could not delete the previous vote")
-			return
+	event := NewAuditEvent(req, models.AuditActionVoted, models.AuditTargetAnswer, rawAnsID)
+	event.After = util.AuditSummary(map[string]VoteValue{"vote": p.Vote})
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if p.Vote == VoteNone {
+			result := tx.Where("answer_id = ? AND user_id = ?", ans.ID, user.ID).Delete(&models.Vote{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errNoVote
+			}
+		} else {
+			// If a vote already exists, and
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "answer_id"}, {Name: "user_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"vote"}),
+			}).Create(&vote).Error
+			if err != nil {
+				return err
+			}
 		}
-		if result.RowsAffected == 0 {
-			httputil.WriteError(res, http.StatusNotFound, "no vote found to delete")
-			return
-		}
-
-	default:
-		httputil.WriteError(res, http.StatusBadRequest, "the vote value must be either 1, -1 or 0")
+		return util.RecordAuditEvent(tx, event)
+	})
+	if errors.Is(err, errNoVote) {
+		httputil.WriteError(res, http.StatusNotFound, "no vote found to delete")
+		return
+	} else if err != nil {
+		httputil.WriteError(res, http.StatusInternalServerError, "could not update your vote")
 		return
 	}
+	invalidateQuestionResponses(db, ans.Question)
 
 	httputil.WriteData(res, http.StatusOK, Vote{
 		Answer:    vote.AnswerID,
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+)
+
+type WarningRequest struct {
+	Reason string `json:"reason"`
+	// Exactly one between AnswerID and ReportID must be set, the warned user
+	// is the author of the answer or of the reported content
+	AnswerID *uint `json:"answer_id"`
+	ReportID *uint `json:"report_id"`
+}
+
+type Warning struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	Reason   string `json:"reason"`
+	AnswerID *uint  `json:"answer_id"`
+	ReportID *uint  `json:"report_id"`
+	// IssuedBy is only shown to admins
+	IssuedBy string `json:"issued_by,omitempty"`
+	Active   bool   `json:"active"`
+}
+
+type WarningResponse struct {
+	Warning Warning `json:"warning"`
+	// Ban is set when the warning triggered the escalation policy
+	Ban *Ban `json:"ban,omitempty"`
+}
+
+func dbWarningToWarning(w *models.Warning, now time.Time) Warning {
+	return Warning{
+		ID:        w.ID,
+		CreatedAt: w.CreatedAt,
+		ExpiresAt: w.ExpiresAt,
+		Reason:    w.Reason,
+		AnswerID:  w.AnswerID,
+		ReportID:  w.ReportID,
+		Active:    w.ExpiresAt.After(now),
+	}
+}
+
+// @Summary		Warn a user
+// @Description	Issue a warning to the author of an answer or of a reported content, banning them if the escalation policy says so
+// @Tags			moderation
+// @Param			warning	body	WarningRequest	true	"Warning data"
+// @Produce		json
+// @Success		200	{object}	WarningResponse
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/warnings [post]
+func PostWarningHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	var req WarningRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httputil.WriteError(w, http.StatusBadRequest, "invalid request body")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to decode request body")
+		return
+	}
+
+	if req.Reason == "" {
+		httputil.WriteError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+	if (req.AnswerID == nil) == (req.ReportID == nil) {
+		httputil.WriteError(w, http.StatusBadRequest, "exactly one of answer_id and report_id is required")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	admin := middleware.MustGetUser(r)
+	warning := models.Warning{
+		IssuedBy: admin.ID,
+		Reason:   req.Reason,
+		AnswerID: req.AnswerID,
+		ReportID: req.ReportID,
+	}
+
+	if req.AnswerID != nil {
+		var answer models.Answer
+		if err := db.First(&answer, *req.AnswerID).Error; err != nil {
+			httputil.WriteError(w, http.StatusNotFound, "answer not found")
+			return
+		}
+		warning.UserID = answer.UserId
+	} else {
+		report, err := util.GetReportByID(db, *req.ReportID)
+		if err != nil {
+			httputil.WriteError(w, http.StatusNotFound, "report not found")
+			return
+		}
+		owner, err := getReportTargetOwner(db, report)
+		if err != nil {
+			httputil.WriteError(w, http.StatusInternalServerError, "failed to get the reported user")
+			slog.With("report", report, "err", err).ErrorContext(r.Context(), "failed to get the reported user")
+			return
+		}
+		warning.UserID = owner.ID
+	}
+
+	var ban *models.Ban
+	err = db.Transaction(func(tx *gorm.DB) error {
+		ban, err = util.IssueWarning(tx, &warning)
+		if err != nil {
+			return err
+		}
+
+		userID := strconv.FormatUint(uint64(warning.UserID), 10)
+		err := RecordAuditEvent(tx, r, models.AuditActionWarned, models.AuditTargetUser, userID, nil, map[string]any{
+			"warning_id": warning.ID,
+			"reason":     warning.Reason,
+			"answer_id":  warning.AnswerID,
+			"report_id":  warning.ReportID,
+		})
+		if err != nil || ban == nil {
+			return err
+		}
+
+		// the ban is issued by the escalation policy, not by the admin
+		event := NewAuditEvent(r, models.AuditActionBanned, models.AuditTargetUser, userID)
+		event.ActorID = ban.IssuedBy
+		event.After = util.AuditSummary(banSummary(ban.Reason, ban.ExpiresAt))
+		return util.RecordAuditEvent(tx, event)
+	})
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to issue warning")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to issue warning")
+		return
+	}
+
+	now := time.Now()
+	res := WarningResponse{
+		Warning: dbWarningToWarning(&warning, now),
+	}
+	res.Warning.IssuedBy = admin.Username
+	if ban != nil {
+		res.Ban = &Ban{
+			ID:        ban.ID,
+			Reason:    ban.Reason,
+			BannedBy:  getUsernameOrSystem(db, ban.IssuedBy),
+			StartsAt:  ban.StartsAt,
+			ExpiresAt: ban.ExpiresAt,
+			Active:    ban.IsActive(now),
+		}
+	}
+
+	httputil.WriteData(w, http.StatusOK, res)
+}
+
+// @Summary		Get the warnings of a user
+// @Description	Get all warnings, active or expired, of a user given its username
+// @Tags			moderation
+// @Param			username	path	string	true	"Username"
+// @Produce		json
+// @Success		200	{object}	[]Warning
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/moderation/warnings/{username} [get]
+func GetUserWarningsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.GetAdmin(r) {
+		httputil.WriteError(w, http.StatusForbidden, "you are not admin")
+		return
+	}
+
+	db := util.GetDbContext(r.Context())
+	user, err := util.GetUserByUsername(db, muxie.GetParam(w, "username"))
+	if err != nil {
+		httputil.WriteError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	warnings, err := util.GetWarnings(db, user.ID)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get warnings")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get warnings")
+		return
+	}
+
+	now := time.Now()
+	returnWarnings := make([]Warning, 0, len(warnings))
+	for _, warning := range warnings {
+		wr := dbWarningToWarning(&warning, now)
+		wr.IssuedBy = getUsernameOrSystem(db, warning.IssuedBy)
+		returnWarnings = append(returnWarnings, wr)
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnWarnings)
+}
+
+// @Summary		Get my warnings
+// @Description	Get the active warnings of the logged user
+// @Tags			moderation
+// @Produce		json
+// @Success		200	{object}	[]Warning
+// @Failure		400	{object}	httputil.ApiError
+// @Router			/warnings [get]
+func GetMyWarningsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := middleware.MustGetUser(r)
+	db := util.GetDbContext(r.Context())
+
+	warnings, err := util.GetActiveWarnings(db, user.ID)
+	if err != nil {
+		httputil.WriteError(w, http.StatusInternalServerError, "failed to get warnings")
+		slog.With("err", err).ErrorContext(r.Context(), "failed to get warnings")
+		return
+	}
+
+	now := time.Now()
+	returnWarnings := make([]Warning, 0, len(warnings))
+	for _, warning := range warnings {
+		returnWarnings = append(returnWarnings, dbWarningToWarning(&warning, now))
+	}
+
+	httputil.WriteData(w, http.StatusOK, returnWarnings)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/cartabinaria/polleg/api"
+	"github.com/cartabinaria/polleg/models"
+	"github.com/cartabinaria/polleg/util"
+)
+
+// cliRequestID is the request ID of the audit events recorded by the commands
+const cliRequestID = "cli"
+
+// runJob runs a background job through the scheduler, so that it doesn't
+// overlap with the runs of the servers and it is recorded with them. The
+// report of the run is decoded into report.
+func runJob(name string, jobConfig util.JobConfig, job util.JobFunc, report any) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	scheduler := util.NewScheduler(ctx, openDb())
+	if err := scheduler.Register(name, jobConfig, job); err != nil {
+		return err
+	}
+	run, err := scheduler.RunJob(name)
+	if err != nil {
+		return err
+	}
+	if run.Report != "" {
+		if err := json.Unmarshal([]byte(run.Report), report); err != nil {
+			return err
+		}
+	}
+	if run.Outcome != models.JobOutcomeSuccess {
+		return fmt.Errorf("the job run ended with outcome %s: %s", run.Outcome, run.Error)
+	}
+	return nil
+}
+
+func gcCommand(flags *flag.FlagSet, args []string) int {
+	dryRun := flags.Bool("dry-run", config.GarbageCollector.DryRun, "only report what would be done")
+	if !parseArgs(flags, args, 0) {
+		return 2
+	}
+	gcConfig := config.GarbageCollector
+	gcConfig.DryRun = *dryRun
+
+	var report util.GCReport
+	err := runJob(util.GarbageCollectorJobName, config.Jobs.GarbageCollector,
+		util.GarbageCollectorJob(config.ImagesPath, gcConfig), &report)
+
+	printImages := func(action string, images []util.GCImage) {
+		for _, img := range images {
+			fmt.Printf("%s %s: %s\n", action, img.ID, img.Reason)
+		}
+	}
+	printImages("quarantine", report.Quarantined)
+	printImages("restore", report.Restored)
+	printImages("purge", report.Purged)
+	for _, e := range report.Errors {
+		fmt.Printf("error: %s\n", e)
+	}
+	if err != nil {
+		slog.Error("failed to collect the unused images", "err", err)
+		return 1
+	}
+
+	fmt.Printf("%d images checked: %d quarantined, %d restored, %d purged", report.Scanned,
+		len(report.Quarantined), len(report.Restored), len(report.Purged))
+	if report.DryRun {
+		fmt.Print(" (dry run)")
+	}
+	fmt.Println()
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func fsckCommand(flags *flag.FlagSet, args []string) int {
+	repair := flags.Bool("repair", config.Fsck.Repair, "remove the orphan files and delete the records of the missing files")
+	if !parseArgs(flags, args, 0) {
+		return 2
+	}
+	fsckConfig := config.Fsck
+	fsckConfig.Repair = *repair
+
+	var report util.FsckReport
+	err := runJob(util.FsckJobName, config.Jobs.Fsck, util.FsckJob(config.ImagesPath, fsckConfig), &report)
+
+	printIssues := func(kind string, issues []util.FsckIssue) {
+		for _, issue := range issues {
+			status := ""
+			if issue.Repaired {
+				status = " (repaired)"
+			}
+			fmt.Printf("%s %s: %s%s\n", kind, issue.ID, issue.Reason, status)
+		}
+	}
+	printIssues("orphan file", report.OrphanFiles)
+	printIssues("dangling record", report.DanglingRecords)
+	printIssues("size mismatch", report.SizeMismatches)
+	for _, e := range report.Errors {
+		fmt.Printf("error: %s\n", e)
+	}
+	if err != nil {
+		slog.Error("failed to check the images", "err", err)
+		return 1
+	}
+
+	fmt.Printf("%d files and %d records checked: %d orphan files, %d dangling records, %d size mismatches\n",
+		report.Files, report.Records, len(report.OrphanFiles), len(report.DanglingRecords), len(report.SizeMismatches))
+	if report.Unrepaired() > 0 || len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// auditCommand walks the audit hash chain and prints the result
+func auditCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+	if flags.Arg(0) != "verify" {
+		flags.Usage()
+		return 2
+	}
+
+	checkpoints, publicKey, err := config.Audit.LoadCheckpoints()
+	if err != nil {
+		slog.Error("failed to load the audit checkpoints", "err", err)
+		return 1
+	}
+
+	result, err := util.VerifyAuditChain(openDb(), checkpoints, publicKey)
+	if err != nil {
+		slog.Error("failed to verify the audit chain", "err", err)
+		return 1
+	}
+
+	if result.FirstBroken != nil {
+		fmt.Printf("audit chain broken at event %d: %s\n", result.FirstBroken.EventID, result.FirstBroken.Reason)
+		fmt.Printf("%d events and %d checkpoints verified before the break\n", result.Events-1, result.Checkpoints)
+		return 1
+	}
+	fmt.Printf("audit chain ok: %d events and %d checkpoints verified\n", result.Events, result.Checkpoints)
+	return 0
+}
+
+func banCommand(flags *flag.FlagSet, args []string) int {
+	reason := flags.String("reason", "", "reason of the ban, shown to the user")
+	duration := flags.Duration("duration", 0, "how long the ban lasts, such as 168h, forever if zero")
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+
+	var expiresAt *time.Time
+	if *duration > 0 {
+		t := time.Now().Add(*duration)
+		expiresAt = &t
+	}
+	return setBan(flags.Arg(0), true, *reason, expiresAt)
+}
+
+func unbanCommand(flags *flag.FlagSet, args []string) int {
+	reason := flags.String("reason", "", "reason for lifting the ban")
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+	return setBan(flags.Arg(0), false, *reason, nil)
+}
+
+// setBan bans or unbans a user on behalf of the system user, recording it in
+// the audit log like the moderation endpoints do
+func setBan(username string, ban bool, reason string, expiresAt *time.Time) int {
+	err := openDb().Transaction(func(tx *gorm.DB) error {
+		user, err := util.GetUserByUsername(tx, username)
+		if err != nil {
+			return err
+		}
+		if err := util.BanUnbanUser(tx, username, ban, api.SYSTEM_USER_ID, reason, expiresAt); err != nil {
+			return err
+		}
+
+		action := models.AuditActionUnbanned
+		if ban {
+			action = models.AuditActionBanned
+		}
+		return util.RecordAuditEvent(tx, &models.AuditEvent{
+			ActorID:    api.SYSTEM_USER_ID,
+			Action:     action,
+			TargetType: models.AuditTargetUser,
+			TargetID:   strconv.FormatUint(uint64(user.ID), 10),
+			After:      util.AuditSummary(map[string]any{"reason": reason, "expires_at": expiresAt}),
+			RequestID:  cliRequestID,
+			Chain:      true,
+		})
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		fmt.Fprintf(os.Stderr, "user %s not found\n", username)
+		return 1
+	case errors.Is(err, util.ErrUserAlreadyBanned), errors.Is(err, util.ErrUserNotBanned):
+		fmt.Fprintf(os.Stderr, "%s: %v\n", username, err)
+		return 1
+	case err != nil:
+		slog.Error("failed to ban/unban user", "username", username, "err", err)
+		return 1
+	}
+
+	if ban {
+		fmt.Printf("user %s banned\n", username)
+	} else {
+		fmt.Printf("user %s unbanned\n", username)
+	}
+	return 0
+}
+
+func reportsCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+	if flags.Arg(0) != "list" {
+		flags.Usage()
+		return 2
+	}
+
+	db := openDb()
+	reports, err := util.GetAllReports(db)
+	if err != nil {
+		slog.Error("failed to get the reports", "err", err)
+		return 1
+	}
+
+	usernames := make(map[uint]string)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tTARGET\tREPORTER\tCAUSE")
+	for _, report := range reports {
+		username, ok := usernames[report.ReporterID()]
+		if !ok {
+			username = "system"
+			if report.UserID != nil {
+				username = ""
+				if user, err := util.GetUserByID(db, *report.UserID); err == nil {
+					username = user.Username
+				}
+			}
+			usernames[report.ReporterID()] = username
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s %s\t%s\t%s\n", report.ID, report.CreatedAt.Format(time.RFC3339),
+			report.TargetType, report.TargetID, username, report.Cause)
+	}
+	tw.Flush()
+	fmt.Printf("%d open reports\n", len(reports))
+	return 0
+}
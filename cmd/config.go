@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/cartabinaria/polleg/util"
+)
+
+// envPrefix is the prefix of the environment variables overriding the config
+// keys, see util.ApplyEnv
+const envPrefix = "POLLEG"
+
+type Config struct {
+	Listen     string   `toml:"listen"`
+	ClientURLs []string `toml:"client_urls"`
+
+	DbURI   string `toml:"db_uri" required:"true" secret:"dsn"`
+	AuthURI string `toml:"auth_uri" required:"true"`
+
+	ImagesPath string `toml:"images_path"`
+	// ContentFilterPath is the path of the content filter rules, which are
+	// reloaded whenever the file changes. Leave empty to disable the filter.
+	ContentFilterPath string `toml:"content_filter_path"`
+
+	Moderation util.ModerationConfig `toml:"moderation"`
+	Trust      util.TrustConfig      `toml:"trust"`
+	Audit      util.AuditConfig      `toml:"audit"`
+	Log        util.LogConfig        `toml:"log"`
+	Metrics    util.MetricsConfig    `toml:"metrics"`
+	Tracing    util.TracingConfig    `toml:"tracing"`
+	Jobs       JobsConfig            `toml:"jobs"`
+	RateLimit  util.RateLimitConfig  `toml:"rate_limit"`
+
+	ResponseCache util.ResponseCacheConfig `toml:"response_cache"`
+
+	GarbageCollector util.GarbageCollectorConfig `toml:"garbage_collector"`
+	Fsck             util.FsckConfig             `toml:"fsck"`
+
+	// AutoMigrate applies the pending migrations when the server starts,
+	// otherwise they are applied with the migrate up command
+	AutoMigrate bool `toml:"auto_migrate"`
+
+	// ShutdownDelay is how long the readiness probe fails before the
+	// connections are drained, so that the load balancers stop routing
+	// requests to the replica first
+	ShutdownDelay util.Duration `toml:"shutdown_delay"`
+	// ShutdownTimeout is how long the requests in flight are waited for
+	// when shutting down
+	ShutdownTimeout util.Duration `toml:"shutdown_timeout"`
+}
+
+type JobsConfig struct {
+	GarbageCollector util.JobConfig `toml:"garbage_collector"`
+	Fsck             util.JobConfig `toml:"fsck"`
+}
+
+var (
+	// Default config values
+	config = Config{
+		Listen:          "0.0.0.0:3001",
+		AuthURI:         "http://localhost:3000",
+		ImagesPath:      "./images",
+		Moderation:      util.GetModerationConfig(),
+		AutoMigrate:     true,
+		ShutdownDelay:   util.Duration(5 * time.Second),
+		ShutdownTimeout: util.Duration(30 * time.Second),
+		Jobs: JobsConfig{
+			GarbageCollector: util.JobConfig{
+				Schedule:     "@daily",
+				Timeout:      util.Duration(time.Hour),
+				RunAtStartup: true,
+			},
+			Fsck: util.JobConfig{
+				Schedule: "@weekly",
+				Timeout:  util.Duration(time.Hour),
+			},
+		},
+		GarbageCollector: util.GarbageCollectorConfig{
+			GracePeriod:      util.Duration(24 * time.Hour),
+			QuarantinePeriod: util.Duration(7 * 24 * time.Hour),
+			BatchSize:        100,
+		},
+		Fsck: util.FsckConfig{
+			MinFileAge: util.Duration(time.Hour),
+		},
+		Tracing: util.TracingConfig{
+			SampleRatio: 1,
+		},
+		Log: util.LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Audit: util.AuditConfig{
+			CheckpointKeyPath:  "./audit-checkpoint.key",
+			CheckpointInterval: util.Duration(time.Hour),
+		},
+		RateLimit: util.RateLimitConfig{
+			Store:   util.RateLimitStoreMemory,
+			Answers: util.RateLimit{Requests: 10, Period: util.Duration(time.Minute), Burst: 10},
+			Images:  util.RateLimit{Requests: 30, Period: util.Duration(time.Hour), Burst: 10},
+			Votes:   util.RateLimit{Requests: 60, Period: util.Duration(time.Minute), Burst: 30},
+			Reports: util.RateLimit{Requests: 10, Period: util.Duration(time.Hour), Burst: 5},
+			Reads:   util.RateLimit{Requests: 300, Period: util.Duration(time.Minute), Burst: 100},
+		},
+		ResponseCache: util.ResponseCacheConfig{
+			MaxSize: 32 * 1024 * 1024,
+			MaxAge:  util.Duration(time.Minute),
+		},
+	}
+)
+
+// configErrors are the problems found loading and validating the config, they
+// are printed by the config command instead of stopping it
+var configErrors error
+
+// loadConfig decodes the config file and applies the environment variables
+// overriding it. The unknown keys and the invalid variables are added to
+// configErrors, so that they are reported together with the invalid values.
+func loadConfig(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+
+	var errs []error
+	decoder := toml.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	var strictErr *toml.StrictMissingError
+	if errors.As(err, &strictErr) {
+		for _, e := range strictErr.Errors {
+			errs = append(errs, fmt.Errorf("unknown key %s", strings.Join(e.Key(), ".")))
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close config file: %w", err)
+	}
+
+	errs = append(errs, util.ApplyEnv(envPrefix, &config, os.Environ()))
+	configErrors = errors.Join(errs...)
+	return nil
+}
+
+// Validate checks the whole config, returning all the errors found. The images
+// directory is checked separately, only for the commands which use it.
+func (c *Config) Validate() error {
+	errs := []error{util.CheckRequired(c)}
+
+	if err := util.CheckListenAddress(c.Listen); err != nil {
+		errs = append(errs, &util.ConfigError{Key: "listen", Err: err})
+	}
+	for _, clientURL := range c.ClientURLs {
+		if err := util.CheckHTTPURL(clientURL); err != nil {
+			errs = append(errs, &util.ConfigError{Key: "client_urls", Err: err})
+		}
+	}
+	if c.DbURI != "" {
+		// the error would include the password
+		if _, err := pgconn.ParseConfig(c.DbURI); err != nil {
+			errs = append(errs, &util.ConfigError{Key: "db_uri", Err: errors.New("invalid connection string")})
+		}
+	}
+	if c.AuthURI != "" {
+		if err := util.CheckHTTPURL(c.AuthURI); err != nil {
+			errs = append(errs, &util.ConfigError{Key: "auth_uri", Err: err})
+		}
+	}
+	if c.ContentFilterPath != "" {
+		if _, err := os.Stat(c.ContentFilterPath); err != nil {
+			errs = append(errs, &util.ConfigError{Key: "content_filter_path", Err: err})
+		}
+	}
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, &util.ConfigError{Key: "shutdown_delay", Err: errors.New("must not be negative")})
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, &util.ConfigError{Key: "shutdown_timeout", Err: errors.New("must be positive")})
+	}
+
+	errs = append(errs,
+		util.InSection("moderation", c.Moderation.Validate()),
+		util.InSection("trust", c.Trust.Validate()),
+		util.InSection("audit", c.Audit.Validate()),
+		util.InSection("log", c.Log.Validate()),
+		util.InSection("metrics", c.Metrics.Validate()),
+		util.InSection("tracing", c.Tracing.Validate()),
+		util.InSection("jobs.garbage_collector", c.Jobs.GarbageCollector.Validate()),
+		util.InSection("jobs.fsck", c.Jobs.Fsck.Validate()),
+		util.InSection("rate_limit", c.RateLimit.Validate()),
+		util.InSection("response_cache", c.ResponseCache.Validate()),
+		util.InSection("garbage_collector", c.GarbageCollector.Validate()),
+		util.InSection("fsck", c.Fsck.Validate()),
+	)
+	return errors.Join(errs...)
+}
+
+// printConfigErrors prints the errors joined in err one per line
+func printConfigErrors(err error) {
+	fmt.Fprintln(os.Stderr, "invalid config:")
+	for line := range strings.SplitSeq(err.Error(), "\n") {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+}
+
+// configCommand prints the effective config, with the secrets redacted, and
+// the validation errors if any
+func configCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+	if flags.Arg(0) != "print" {
+		flags.Usage()
+		return 2
+	}
+
+	redacted := config
+	util.RedactSecrets(&redacted)
+	data, err := toml.Marshal(redacted)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode the config: %v\n", err)
+		return 1
+	}
+	fmt.Print(string(data))
+
+	if configErrors != nil {
+		printConfigErrors(configErrors)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/cartabinaria/polleg/util"
+)
+
+func printExportSummary(verb string, summary util.ExportSummary) {
+	tables := make([]string, 0, len(summary))
+	for table := range summary {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+	for _, table := range tables {
+		fmt.Printf("%s %d rows of %s\n", verb, summary[table], table)
+	}
+}
+
+func exportCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+
+	file, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		slog.Error("failed to create the export file", "err", err)
+		return 1
+	}
+	summary, err := util.Export(context.Background(), openDb(), file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Error("failed to export the database", "err", err)
+		os.Remove(flags.Arg(0))
+		return 1
+	}
+
+	printExportSummary("exported", summary)
+	return 0
+}
+
+func importCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 1) {
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		slog.Error("failed to open the export file", "err", err)
+		return 1
+	}
+	defer file.Close()
+
+	summary, err := util.Import(context.Background(), openDb(), file)
+	if errors.Is(err, util.ErrDatabaseNotEmpty) {
+		fmt.Fprintf(os.Stderr, "%v, an export can only be imported into an empty database\n", err)
+		return 1
+	} else if err != nil {
+		slog.Error("failed to import the export", "err", err)
+		return 1
+	}
+
+	printExportSummary("imported", summary)
+	return 0
+}
+
+func seedCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 0) {
+		return 2
+	}
+
+	err := util.Seed(context.Background(), openDb())
+	if errors.Is(err, util.ErrDatabaseNotEmpty) {
+		fmt.Fprintf(os.Stderr, "%v, only an empty database can be seeded\n", err)
+		return 1
+	} else if err != nil {
+		slog.Error("failed to seed the database", "err", err)
+		return 1
+	}
+
+	fmt.Printf("database seeded, see the questions of document %s\n", util.SeedDocumentID)
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	migrationsfs "github.com/cartabinaria/polleg/migrations"
+	"github.com/cartabinaria/polleg/util"
+)
+
+// loadMigrations returns the migrations embedded in the binary, the commands
+// exit if they are invalid
+func loadMigrations() []util.Migration {
+	migrations, err := util.LoadMigrations(migrationsfs.FS)
+	if err != nil {
+		slog.Error("failed to load the migrations", "err", err)
+		os.Exit(1)
+	}
+	return migrations
+}
+
+func migrateCommand(flags *flag.FlagSet, args []string) int {
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		flags.Usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := util.MigrateUp(context.Background(), openDb(), loadMigrations())
+		for _, m := range done {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			slog.Error("failed to migrate the database", "err", err)
+			return 1
+		}
+		fmt.Printf("%d migrations applied\n", len(done))
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				flags.Usage()
+				return 2
+			}
+		}
+		done, err := util.MigrateDown(context.Background(), openDb(), loadMigrations(), steps)
+		for _, m := range done {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			slog.Error("failed to revert the migrations", "err", err)
+			return 1
+		}
+		fmt.Printf("%d migrations reverted\n", len(done))
+	case "status":
+		status, err := util.GetMigrationStatus(openDb(), loadMigrations())
+		if err != nil {
+			slog.Error("failed to get the migrations status", "err", err)
+			return 1
+		}
+		for _, m := range status.Migrations {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied at " + m.AppliedAt.Format(time.RFC3339)
+			}
+			if m.Unknown {
+				state += ", unknown to this release"
+			}
+			fmt.Printf("%d_%s: %s\n", m.Version, m.Name, state)
+		}
+		if status.Legacy {
+			fmt.Println("the schema was created by AutoMigrate, migrate up upgrades it to the initial migration without running it")
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
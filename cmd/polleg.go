@@ -1,40 +1,62 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
 
-	"github.com/kataras/muxie"
-	"github.com/pelletier/go-toml/v2"
-	"golang.org/x/exp/slog"
+	"gorm.io/gorm"
 
-	"github.com/cartabinaria/auth/pkg/httputil"
-	"github.com/cartabinaria/auth/pkg/middleware"
-	"github.com/cartabinaria/polleg/api"
-	"github.com/cartabinaria/polleg/api/proposal"
-	"github.com/cartabinaria/polleg/models"
 	"github.com/cartabinaria/polleg/util"
 )
 
-type Config struct {
-	Listen     string   `toml:"listen"`
-	ClientURLs []string `toml:"client_urls"`
+// command is a subcommand of polleg, run returns the exit code
+type command struct {
+	name string
+	// args is the synopsis of the arguments of the command
+	args string
+	help string
+	run  func(flags *flag.FlagSet, args []string) int
+}
+
+var commands = []command{
+	{"serve", "", "start the server, the default command", serveCommand},
+	{"migrate", "up | down [steps] | status", "apply, revert or list the database migrations", migrateCommand},
+	{"gc", "[-dry-run]", "run the images garbage collector", gcCommand},
+	{"fsck", "[-repair]", "check the consistency of the images storage with the database", fsckCommand},
+	{"audit", "verify", "verify the hash chain of the audit log against the signed checkpoints", auditCommand},
+	{"ban", "[-reason text] [-duration d] <username>", "ban a user, forever unless a duration is given", banCommand},
+	{"unban", "[-reason text] <username>", "lift the ban of a user", unbanCommand},
+	{"reports", "list", "list the open reports", reportsCommand},
+	{"export", "<file>", "export the database, not the images files, as JSON lines", exportCommand},
+	{"import", "<file>", "import an export into an empty database", importCommand},
+	{"seed", "", "fill an empty database with sample data for development", seedCommand},
+	{"config", "print", "print the effective config, secrets redacted, and validate it", configCommand},
+}
 
-	DbURI   string `toml:"db_uri" required:"true"`
-	AuthURI string `toml:"auth_uri" required:"true"`
+// imagesCommands are the commands which use the images directory, it is
+// checked only for them, so that the others run on hosts without it
+var imagesCommands = []string{"serve", "gc", "fsck"}
 
-	ImagesPath string `toml:"images_path"`
+func (c command) synopsis() string {
+	return strings.TrimSpace(c.name + " " + c.args)
 }
 
-var (
-	// Default config values
-	config = Config{
-		Listen:     "0.0.0.0:3001",
-		AuthURI:    "http://localhost:3000",
-		ImagesPath: "./images",
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: polleg <config-file> [command] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.synopsis(), c.help)
 	}
-)
+	tw.Flush()
+}
 
 // @title			Polleg API
 // @version		1.0
@@ -46,121 +68,78 @@ var (
 // @BasePath		/
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: polleg <config-file>")
-		os.Exit(1)
+		printUsage(os.Stderr)
+		os.Exit(2)
 	}
-	err := loadConfig(os.Args[1])
-	if err != nil {
-		slog.Error("failed to load config", "err", err)
-		os.Exit(1)
+	if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		printUsage(os.Stdout)
+		return
 	}
 
-	err = util.ConnectDb(config.DbURI)
-	if err != nil {
-		slog.Error("failed to connect to db", "err", err)
-		os.Exit(1)
+	args := os.Args[2:]
+	if len(args) == 0 {
+		args = []string{"serve"}
 	}
-	db := util.GetDb()
-	err = db.AutoMigrate(&models.User{}, &models.Proposal{}, &models.Question{}, &models.Answer{}, &models.Vote{}, &models.Image{}, &models.AnswerVersion{}, &models.Report{})
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == args[0] })
+	if i < 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	cmd := commands[i]
+
+	err := loadConfig(os.Args[1])
 	if err != nil {
-		slog.Error("AutoMigrate failed", "err", err)
+		slog.Error("failed to load config", "err", err)
 		os.Exit(1)
 	}
-
-	err = os.Mkdir(config.ImagesPath, 0755)
-	if err != nil && !os.IsExist(err) {
-		slog.Error("failed to create images directory", "err", err)
+	configErrors = errors.Join(configErrors, config.Validate())
+	if slices.Contains(imagesCommands, cmd.name) {
+		if err := util.CheckWritableDir(config.ImagesPath); err != nil {
+			configErrors = errors.Join(configErrors, &util.ConfigError{Key: "images_path", Err: err})
+		}
+	}
+	if configErrors != nil && cmd.name != "config" {
+		printConfigErrors(configErrors)
 		os.Exit(1)
 	}
-
-	mux := muxie.NewMux()
-	authMiddleware, err := middleware.NewAuthMiddleware(config.AuthURI)
+	err = util.SetupLogger(config.Log)
 	if err != nil {
-		slog.Error("failed to create authentication middleware", "err", err)
+		slog.Error("failed to set up the logger", "err", err)
 		os.Exit(1)
 	}
 
-	mux.Use(util.NewLoggerMiddleware, httputil.NewCorsMiddleware(config.ClientURLs, true, mux))
-
-	authChain := muxie.Pre(authMiddleware.Handler, api.BanMiddleware)
-	authOptionalChain := muxie.Pre(authMiddleware.NonBlockingHandler)
-
-	// authentication-less read-only queries
-	mux.Handle("/documents/:id", authOptionalChain.ForFunc(api.GetDocumentHandler))
-	mux.Handle("/questions/:id", muxie.Methods().
-		Handle("GET", authOptionalChain.ForFunc(api.GetQuestionHandler)).
-		Handle("DELETE", authChain.ForFunc(api.DelQuestionHandler)))
-
-	mux.Handle("/images/:id", authOptionalChain.ForFunc(api.GetImageHandler(config.ImagesPath)))
-
-	// authenticated queries
-	// insert new answer
-	mux.Handle("/answers", authChain.ForFunc(api.PostAnswerHandler))
-	// put up/down votes to an answer
-	mux.Handle("/answers/:id/vote", authChain.ForFunc(api.PostVote))
-	mux.Handle("/answers/:id/replies", authOptionalChain.ForFunc(api.GetRepliesHandler))
-	// insert new doc and quesions
-	mux.Handle("/documents", muxie.Methods().
-		Handle("POST", authChain.ForFunc(api.PostDocumentHandler)).
-		Handle("GET", authOptionalChain.ForFunc(api.GetDocumentsWithQuestionsHandler)))
-	mux.Handle("/answers/:id", authChain.ForFunc(api.DelAnswerHandler))
-	mux.Handle("/answers/:id", muxie.Methods().
-		Handle("DELETE", authChain.ForFunc(api.DelAnswerHandler)).
-		Handle("PATCH", authChain.ForFunc(api.UpdateAnswerHandler)))
-
-	// Images
-	mux.Handle("/images", authChain.ForFunc(api.PostImageHandler(config.ImagesPath)))
-
-	// proposal managers
-	mux.Handle("/proposals", muxie.Methods().
-		Handle("POST", authChain.ForFunc(proposal.PostProposalHandler)).
-		Handle("GET", authChain.ForFunc(proposal.GetAllProposalsHandler)))
-	mux.Handle("/proposals/:id/approve", authChain.ForFunc(proposal.ApproveProposalHandler))
-	mux.Handle("/proposals/:id", muxie.Methods().
-		Handle("DELETE", authChain.ForFunc(proposal.DeleteProposalByIdHandler)).
-		Handle("GET", authChain.ForFunc(proposal.GetProposalByIdHandler)).
-		Handle("PATCH", authChain.ForFunc(proposal.UpdateProposalByIdHandler)))
-	mux.Handle("/proposals/document/:id", muxie.Methods().
-		Handle("GET", authChain.ForFunc(proposal.GetProposalByDocumentHandler)).
-		Handle("DELETE", authChain.ForFunc(proposal.DeleteProposalByDocumentHandler)))
-	mux.Handle("/proposals/document/:id/approve", authChain.ForFunc(proposal.ApproveProposalByDocumentHandler))
-
-	// Logs
-	mux.Handle("/logs", authChain.ForFunc(api.LogsHandler))
-
-	// Moderation
-	mux.Handle("/moderation/report", authChain.ForFunc(api.PostReportHandler))
-	mux.Handle("/moderation/report/:id", authChain.ForFunc(api.DeleteReportByIdHandler))
-	mux.Handle("/moderation/reports", authChain.ForFunc(api.GetReportsHandler))
-	mux.Handle("/moderation/ban", muxie.Methods().
-		Handle("GET", authChain.ForFunc(api.GetBannedHandler)).
-		Handle("POST", authChain.ForFunc(api.BanUserHandler)))
+	util.SetModerationConfig(config.Moderation)
+	util.SetTrustConfig(config.Trust)
 
-	// start garbage collector
-	go util.GarbageCollector(config.ImagesPath)
-
-	slog.Info("listening at", "address", config.Listen)
-	err = http.ListenAndServe(config.Listen, mux)
-	if err != nil {
-		slog.Error("failed to serve", "err", err)
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: polleg <config-file> %s\n", cmd.synopsis())
+		flags.PrintDefaults()
 	}
+	os.Exit(cmd.run(flags, args[1:]))
 }
 
-func loadConfig(path string) (err error) {
-	file, err := os.Open(path)
+// openDb connects to the database, the commands exit if it fails
+func openDb() *gorm.DB {
+	err := util.ConnectDb(config.DbURI)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %w", err)
+		slog.Error("failed to connect to db", "err", err)
+		os.Exit(1)
 	}
+	return util.GetDb()
+}
 
-	err = toml.NewDecoder(file).Decode(&config)
-	if err != nil {
-		return fmt.Errorf("failed to decode config file: %w", err)
+// parseArgs parses the flags of a command, which must be followed by n
+// positional arguments. It returns false, after printing the usage, if they
+// are invalid.
+func parseArgs(flags *flag.FlagSet, args []string, n int) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
 	}
-
-	err = file.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close config file: %w", err)
+	if flags.NArg() != n {
+		flags.Usage()
+		return false
 	}
-
-	return nil
+	return true
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kataras/muxie"
+	"gorm.io/gorm"
+
+	"github.com/cartabinaria/auth/pkg/httputil"
+	"github.com/cartabinaria/auth/pkg/middleware"
+	"github.com/cartabinaria/polleg/api"
+	"github.com/cartabinaria/polleg/api/proposal"
+	"github.com/cartabinaria/polleg/util"
+)
+
+func serveCommand(flags *flag.FlagSet, args []string) int {
+	if !parseArgs(flags, args, 0) {
+		return 2
+	}
+
+	db := openDb()
+	if config.AutoMigrate {
+		if _, err := util.MigrateUp(context.Background(), db, loadMigrations()); err != nil {
+			slog.Error("failed to migrate the database", "err", err)
+			return 1
+		}
+	}
+	if err := serve(db); err != nil {
+		slog.Error("failed to serve", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// serve runs the server until SIGINT or SIGTERM, it returns the errors
+// instead of exiting so that the deferred cleanups run
+func serve(db *gorm.DB) error {
+	// background jobs are stopped, and the connections drained, on SIGINT
+	// or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var jobs sync.WaitGroup
+	runJob := func(job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			job()
+		}()
+	}
+
+	shutdownTracing, err := util.SetupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush the traces", "err", err)
+		}
+	}()
+
+	if config.ContentFilterPath != "" {
+		filter, err := util.LoadContentFilter(config.ContentFilterPath)
+		if err != nil {
+			return fmt.Errorf("failed to load content filter: %w", err)
+		}
+		runJob(func() { filter.Watch(ctx, 10*time.Second) })
+	}
+
+	if config.Audit.CheckpointPath != "" {
+		key, err := util.LoadOrCreateCheckpointKey(config.Audit.CheckpointKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load the audit checkpoint key: %w", err)
+		}
+		checkpointer, err := util.NewAuditCheckpointer(config.Audit.CheckpointPath, key)
+		if err != nil {
+			return fmt.Errorf("failed to load the audit checkpoints: %w", err)
+		}
+		runJob(func() { checkpointer.Run(ctx, time.Duration(config.Audit.CheckpointInterval)) })
+	}
+
+	scheduler := util.NewScheduler(ctx, db)
+	err = scheduler.Register(util.GarbageCollectorJobName, config.Jobs.GarbageCollector,
+		util.GarbageCollectorJob(config.ImagesPath, config.GarbageCollector))
+	if err == nil {
+		err = scheduler.Register(util.FsckJobName, config.Jobs.Fsck, util.FsckJob(config.ImagesPath, config.Fsck))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register the jobs: %w", err)
+	}
+
+	err = os.Mkdir(config.ImagesPath, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create images directory: %w", err)
+	}
+
+	mux := muxie.NewMux()
+	authMiddleware, err := middleware.NewAuthMiddleware(config.AuthURI)
+	if err != nil {
+		return fmt.Errorf("failed to create authentication middleware: %w", err)
+	}
+
+	mux.Use(util.NewMetricsMiddleware(mux), util.NewLoggerMiddleware, util.NewTracingMiddleware(mux),
+		httputil.NewCorsMiddleware(config.ClientURLs, true, mux))
+
+	rateLimiter := util.NewRateLimiter(config.RateLimit, db)
+	runJob(func() { rateLimiter.Run(ctx, time.Minute) })
+	util.SetupResponseCache(config.ResponseCache)
+
+	authChain := muxie.Pre(authMiddleware.Handler, api.RequestUserMiddleware, api.BanMiddleware)
+	authOptionalChain := muxie.Pre(authMiddleware.NonBlockingHandler, api.RequestUserMiddleware,
+		api.RateLimitMiddleware(rateLimiter, util.RateLimitReads))
+	// authenticated and limited by the given class, the requests over the
+	// limit don't reach the database
+	rateLimitedChain := func(class util.RateLimitClass) muxie.Wrappers {
+		return muxie.Pre(authMiddleware.Handler, api.RequestUserMiddleware,
+			api.RateLimitMiddleware(rateLimiter, class), api.BanMiddleware)
+	}
+	// the documents and the questions are served with validators, and cached
+	// for the anonymous users
+	cachedChain := muxie.Pre(authMiddleware.NonBlockingHandler, api.RequestUserMiddleware,
+		api.RateLimitMiddleware(rateLimiter, util.RateLimitReads), api.ResponseCacheMiddleware)
+	// authenticated, but reachable by banned users too
+	banExemptChain := muxie.Pre(authMiddleware.Handler, api.RequestUserMiddleware)
+
+	// authentication-less read-only queries
+	mux.Handle("/documents/:id", cachedChain.ForFunc(api.GetDocumentHandler))
+	mux.Handle("/questions/:id", muxie.Methods().
+		Handle("GET", cachedChain.ForFunc(api.GetQuestionHandler)).
+		Handle("DELETE", authChain.ForFunc(api.DelQuestionHandler)))
+
+	mux.Handle("/images/:id", authOptionalChain.ForFunc(api.GetImageHandler(config.ImagesPath)))
+
+	// authenticated queries
+	// insert new answer
+	mux.Handle("/answers", rateLimitedChain(util.RateLimitAnswers).ForFunc(api.PostAnswerHandler))
+	// put up/down votes to an answer
+	mux.Handle("/answers/:id/vote", rateLimitedChain(util.RateLimitVotes).ForFunc(api.PostVote))
+	mux.Handle("/answers/:id/replies", authOptionalChain.ForFunc(api.GetRepliesHandler))
+	// insert new doc and quesions
+	mux.Handle("/documents", muxie.Methods().
+		Handle("POST", authChain.ForFunc(api.PostDocumentHandler)).
+		Handle("GET", cachedChain.ForFunc(api.GetDocumentsWithQuestionsHandler)))
+	mux.Handle("/answers/:id", authChain.ForFunc(api.DelAnswerHandler))
+	mux.Handle("/answers/:id", muxie.Methods().
+		Handle("DELETE", authChain.ForFunc(api.DelAnswerHandler)).
+		Handle("PATCH", authChain.ForFunc(api.UpdateAnswerHandler)))
+	mux.Handle("/answers/:id/restore", authChain.ForFunc(api.RestoreAnswerHandler))
+
+	// Images
+	mux.Handle("/images", rateLimitedChain(util.RateLimitImages).ForFunc(api.PostImageHandler(config.ImagesPath)))
+	mux.Handle("/images/gc/report", authChain.ForFunc(api.GetGCReportHandler))
+	mux.Handle("/images/gc/dry-run", authChain.ForFunc(api.GCDryRunHandler(config.ImagesPath, config.GarbageCollector)))
+
+	// proposal managers
+	mux.Handle("/proposals", muxie.Methods().
+		Handle("POST", authChain.ForFunc(proposal.PostProposalHandler)).
+		Handle("GET", authChain.ForFunc(proposal.GetAllProposalsHandler)))
+	mux.Handle("/proposals/:id/approve", authChain.ForFunc(proposal.ApproveProposalHandler))
+	mux.Handle("/proposals/:id", muxie.Methods().
+		Handle("DELETE", authChain.ForFunc(proposal.DeleteProposalByIdHandler)).
+		Handle("GET", authChain.ForFunc(proposal.GetProposalByIdHandler)).
+		Handle("PATCH", authChain.ForFunc(proposal.UpdateProposalByIdHandler)))
+	mux.Handle("/proposals/document/:id", muxie.Methods().
+		Handle("GET", authChain.ForFunc(proposal.GetProposalByDocumentHandler)).
+		Handle("DELETE", authChain.ForFunc(proposal.DeleteProposalByDocumentHandler)))
+	mux.Handle("/proposals/document/:id/approve", authChain.ForFunc(proposal.ApproveProposalByDocumentHandler))
+
+	// Logs
+	mux.Handle("/logs", authChain.ForFunc(api.LogsHandler))
+	mux.Handle("/logs/verify", authChain.ForFunc(api.VerifyLogsHandler(config.Audit)))
+
+	// Moderation
+	mux.Handle("/moderation/report", rateLimitedChain(util.RateLimitReports).ForFunc(api.PostReportHandler))
+	mux.Handle("/moderation/report/:id", authChain.ForFunc(api.DeleteReportByIdHandler))
+	mux.Handle("/moderation/report/:id/action", authChain.ForFunc(api.ReportActionHandler(config.ImagesPath)))
+	mux.Handle("/moderation/reports", authChain.ForFunc(api.GetReportsHandler))
+	mux.Handle("/moderation/ban", muxie.Methods().
+		Handle("GET", authChain.ForFunc(api.GetBannedHandler)).
+		Handle("POST", authChain.ForFunc(api.BanUserHandler)))
+	mux.Handle("/moderation/shadowban", muxie.Methods().
+		Handle("GET", authChain.ForFunc(api.GetShadowBannedHandler)).
+		Handle("POST", authChain.ForFunc(api.ShadowBanUserHandler)))
+	mux.Handle("/moderation/ban/:username/history", authChain.ForFunc(api.GetBanHistoryHandler))
+	mux.Handle("/moderation/appeals", muxie.Methods().
+		Handle("GET", banExemptChain.ForFunc(api.GetAppealsHandler)).
+		Handle("POST", banExemptChain.ForFunc(api.PostAppealHandler)))
+	mux.Handle("/moderation/appeals/:id", authChain.ForFunc(api.ReviewAppealHandler))
+	mux.Handle("/moderation/warnings", authChain.ForFunc(api.PostWarningHandler))
+	mux.Handle("/moderation/warnings/:username", authChain.ForFunc(api.GetUserWarningsHandler))
+	mux.Handle("/warnings", banExemptChain.ForFunc(api.GetMyWarningsHandler))
+	mux.Handle("/moderation/moderators", muxie.Methods().
+		Handle("GET", authChain.ForFunc(api.GetModeratorScopesHandler)).
+		Handle("POST", authChain.ForFunc(api.PostModeratorScopeHandler)))
+	mux.Handle("/moderation/moderators/:id", authChain.ForFunc(api.DeleteModeratorScopeHandler))
+	mux.Handle("/moderation/filter/hits", authChain.ForFunc(api.GetFilterHitsHandler))
+	mux.Handle("/moderation/queue", authChain.ForFunc(api.GetQueueHandler))
+	mux.Handle("/moderation/queue/:id", authChain.ForFunc(api.ReviewQueuedAnswerHandler))
+
+	mux.Handle("/admin/settings", muxie.Methods().
+		Handle("GET", authChain.ForFunc(api.GetSettingsHandler)).
+		Handle("PUT", authChain.ForFunc(api.PutSettingHandler)))
+
+	mux.Handle("/jobs", authChain.ForFunc(api.GetJobsHandler(scheduler)))
+	mux.Handle("/jobs/:name/runs", authChain.ForFunc(api.GetJobRunsHandler(scheduler)))
+	mux.Handle("/jobs/:name/run", authChain.ForFunc(api.TriggerJobHandler(scheduler)))
+
+	// probes
+	mux.HandleFunc("/healthz", api.HealthHandler)
+	mux.Handle("/readyz", api.ReadyHandler(config.ImagesPath, config.AuthURI))
+
+	servers := []*http.Server{{Addr: config.Listen, Handler: mux}}
+
+	// the metrics are either served on their own address, which is not
+	// exposed publicly, or by the API behind a token
+	switch {
+	case config.Metrics.Listen != "":
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", util.MetricsHandler(config.Metrics.Token))
+		servers = append(servers, &http.Server{Addr: config.Metrics.Listen, Handler: metricsMux})
+	case config.Metrics.Token != "":
+		mux.Handle("/metrics", util.MetricsHandler(config.Metrics.Token))
+	}
+
+	runJob(scheduler.Run)
+
+	// the error of a server stops the others, it is returned once they have
+	// been shut down
+	serveErrs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			slog.Info("listening at", "address", server.Addr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErrs <- fmt.Errorf("failed to serve at %s: %w", server.Addr, err)
+				stop()
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+	api.SetShuttingDown()
+	// the readiness probe fails for a while first, unless a server has
+	// already failed
+	var serveErr error
+	select {
+	case serveErr = <-serveErrs:
+	default:
+		time.Sleep(time.Duration(config.ShutdownDelay))
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to drain the connections", "address", server.Addr, "err", err)
+		}
+	}
+	jobs.Wait()
+
+	if err := util.CloseDb(); err != nil {
+		slog.Error("failed to close the db", "err", err)
+	}
+	return serveErr
+}
@@ -22,6 +22,73 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/settings": {
+            "get": {
+                "description": "Get the limits and quotas with their global values and their overrides per role and per user",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Get the runtime settings",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Setting"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Change the global value of a setting, or override a quota for a role or a user. A null value restores the default or removes the override.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Change a runtime setting",
+                "parameters": [
+                    {
+                        "description": "Setting and its new value",
+                        "name": "setting",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.SettingRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Setting"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
         "/answer/{id}/vote": {
             "post": {
                 "description": "Insert a new vote on a answer",
@@ -53,6 +120,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
                     }
                 }
             }
@@ -90,13 +163,19 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
                     }
                 }
             }
         },
         "/answers/{id}": {
             "delete": {
-                "description": "Given an andwer ID, delete the answer",
+                "description": "Given an andwer ID, delete the answer. Admins can specify the reason of the removal, which is shown to the author.",
                 "produces": [
                     "application/json"
                 ],
@@ -111,6 +190,14 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "description": "Removal reason",
+                        "name": "body",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.DeleteAnswerRequest"
+                        }
                     }
                 ],
                 "responses": {
@@ -188,6 +275,41 @@ const docTemplate = `{
                 }
             }
         },
+        "/answers/{id}/restore": {
+            "post": {
+                "description": "Given an answer ID, make a deleted answer visible again. Admins, members and the moderators of the document can restore any answer, users only the ones they deleted themselves.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "answer"
+                ],
+                "summary": "Restore an answer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Answer id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.Answer"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
         "/documents": {
             "get": {
                 "description": "Given a path prefix, return all the documents that have questions in that path",
@@ -205,6 +327,12 @@ const docTemplate = `{
                         "name": "path",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a previous response",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -217,6 +345,9 @@ const docTemplate = `{
                             }
                         }
                     },
+                    "304": {
+                        "description": "not modified"
+                    },
                     "400": {
                         "description": "Bad Request",
                         "schema": {
@@ -278,6 +409,12 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a previous response",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -287,6 +424,9 @@ const docTemplate = `{
                             "$ref": "#/definitions/api.Document"
                         }
                     },
+                    "304": {
+                        "description": "not modified"
+                    },
                     "400": {
                         "description": "Bad Request",
                         "schema": {
@@ -296,6 +436,26 @@ const docTemplate = `{
                 }
             }
         },
+        "/healthz": {
+            "get": {
+                "description": "Always succeeds while the process is able to serve requests",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Liveness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.HealthResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/images": {
             "post": {
                 "description": "Insert a new image",
@@ -330,38 +490,35 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
                     }
                 }
             }
         },
-        "/images/{id}": {
-            "get": {
-                "description": "Given an image ID, return the image",
+        "/images/gc/dry-run": {
+            "post": {
+                "description": "Report which images the garbage collector would quarantine, restore and purge now, and why, without changing anything (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "image"
-                ],
-                "summary": "Get an image",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Image id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
+                    "admin"
                 ],
+                "summary": "Dry-run the garbage collector",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "file"
+                            "$ref": "#/definitions/util.GCReport"
                         }
                     },
-                    "400": {
-                        "description": "Bad Request",
+                    "403": {
+                        "description": "Forbidden",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -369,30 +526,21 @@ const docTemplate = `{
                 }
             }
         },
-        "/logs": {
+        "/images/gc/report": {
             "get": {
-                "description": "Get system logs (admin only)",
+                "description": "Get the report of the last run of the images garbage collector: the images it quarantined, restored and purged, and why (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "admin"
                 ],
-                "summary": "Get system logs",
+                "summary": "Get the last garbage collector report",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/api.Log"
-                            }
-                        }
-                    },
-                    "400": {
-                        "description": "Bad Request",
-                        "schema": {
-                            "$ref": "#/definitions/httputil.ApiError"
+                            "$ref": "#/definitions/api.GCReportResponse"
                         }
                     },
                     "403": {
@@ -401,8 +549,8 @@ const docTemplate = `{
                             "$ref": "#/definitions/httputil.ApiError"
                         }
                     },
-                    "405": {
-                        "description": "Method Not Allowed",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -410,24 +558,30 @@ const docTemplate = `{
                 }
             }
         },
-        "/moderation/ban": {
+        "/images/{id}": {
             "get": {
-                "description": "Get all banned users",
+                "description": "Given an image ID, return the image",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "moderation"
+                    "image"
+                ],
+                "summary": "Get an image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Image id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Get all banned users",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/api.BannedUser"
-                            }
+                            "type": "file"
                         }
                     },
                     "400": {
@@ -437,36 +591,30 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
-            "post": {
-                "description": "Ban or unban a user given its username",
+            }
+        },
+        "/jobs": {
+            "get": {
+                "description": "Get the background jobs with their schedule, next and last run (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "moderation"
-                ],
-                "summary": "Ban or unban a user",
-                "parameters": [
-                    {
-                        "description": "Ban or unban a user",
-                        "name": "banUser",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/api.BanUserRequest"
-                        }
-                    }
+                    "admin"
                 ],
+                "summary": "Get the background jobs",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Job"
+                            }
                         }
                     },
-                    "400": {
-                        "description": "Bad Request",
+                    "403": {
+                        "description": "Forbidden",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -474,43 +622,37 @@ const docTemplate = `{
                 }
             }
         },
-        "/moderation/report/": {
+        "/jobs/{name}/run": {
             "post": {
-                "description": "Report an answer given its ID",
+                "description": "Run a background job now, in the background. The run is recorded as skipped if another replica is running it (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "moderation"
+                    "admin"
                 ],
-                "summary": "Report an answer",
+                "summary": "Trigger a job",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Answer id",
-                        "name": "id",
+                        "description": "Job name",
+                        "name": "name",
                         "in": "path",
                         "required": true
-                    },
-                    {
-                        "description": "Report cause",
-                        "name": "report",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/api.ReportRequest"
-                        }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "202": {
+                        "description": "Accepted"
+                    },
+                    "403": {
+                        "description": "Forbidden",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/httputil.ApiError"
                         }
                     },
-                    "400": {
-                        "description": "Bad Request",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -518,60 +660,49 @@ const docTemplate = `{
                 }
             }
         },
-        "/moderation/report/{id}": {
-            "delete": {
-                "description": "Delete a report given its ID",
+        "/jobs/{name}/runs": {
+            "get": {
+                "description": "Get the most recent runs of a background job, newest first (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "moderation"
+                    "admin"
                 ],
-                "summary": "Delete a report",
+                "summary": "Get the runs of a job",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Answer id",
-                        "name": "id",
+                        "description": "Job name",
+                        "name": "name",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of runs, 50 by default and at most 500",
+                        "name": "limit",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "No Content"
-                    },
-                    "400": {
-                        "description": "Bad Request",
-                        "schema": {
-                            "$ref": "#/definitions/httputil.ApiError"
-                        }
-                    }
-                }
-            }
-        },
-        "/moderation/reports": {
-            "get": {
-                "description": "Get all reports",
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "moderation"
-                ],
-                "summary": "Get all reports",
-                "responses": {
-                    "200": {
-                        "description": "OK",
+                    "200": {
+                        "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/api.Report"
+                                "$ref": "#/definitions/api.JobRun"
                             }
                         }
                     },
-                    "400": {
-                        "description": "Bad Request",
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -579,23 +710,87 @@ const docTemplate = `{
                 }
             }
         },
-        "/proposals": {
+        "/logs": {
             "get": {
-                "description": "Get all proposals",
+                "description": "Get the audit log, newest first (admin only). Results are paginated: pass the X-Next-Cursor header of a response as the cursor parameter to get the next page, the header is missing on the last page. With the format parameter, every matching event is exported instead, oldest first.",
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "text/csv",
+                    "application/x-ndjson"
                 ],
                 "tags": [
-                    "proposal"
+                    "admin"
+                ],
+                "summary": "Get system logs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Item type (answer, image, user...)",
+                        "name": "item_type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Action (created, deleted, banned...)",
+                        "name": "action",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Username of who performed the action, system for the system user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Item ID",
+                        "name": "item_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only events at or after this RFC 3339 timestamp",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only events before this RFC 3339 timestamp",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size, 100 by default and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the page, from the X-Next-Cursor header",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Export format, csv or ndjson",
+                        "name": "format",
+                        "in": "query"
+                    }
                 ],
-                "summary": "Get all proposals",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/api_proposal.DocumentProposal"
+                                "$ref": "#/definitions/api.Log"
+                            }
+                        },
+                        "headers": {
+                            "X-Next-Cursor": {
+                                "type": "string",
+                                "description": "Cursor of the next page"
                             }
                         }
                     },
@@ -604,38 +799,47 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
                     }
                 }
-            },
-            "post": {
-                "description": "Insert a new proposal for a document",
+            }
+        },
+        "/logs/verify": {
+            "get": {
+                "description": "Walk the hash chain of the moderation and admin events, and the signed checkpoints, reporting the first broken link (admin only)",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
-                ],
-                "summary": "Insert a new proposal",
-                "parameters": [
-                    {
-                        "description": "Proposal data to insert",
-                        "name": "proposalReq",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/api_proposal.DocumentProposal"
-                        }
-                    }
+                    "admin"
                 ],
+                "summary": "Verify the audit hash chain",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/api_proposal.DocumentProposal"
+                            "$ref": "#/definitions/util.AuditChainVerification"
                         }
                     },
-                    "400": {
-                        "description": "Bad Request",
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
                         "schema": {
                             "$ref": "#/definitions/httputil.ApiError"
                         }
@@ -643,30 +847,32 @@ const docTemplate = `{
                 }
             }
         },
-        "/proposals/document/{id}": {
+        "/moderation/appeals": {
             "get": {
-                "description": "Get all proposals for a document, given its ID",
+                "description": "Admins get the appeals queue, optionally filtered by status, other users get their own appeals",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
+                    "moderation"
                 ],
-                "summary": "Get proposals by document id",
+                "summary": "Get appeals",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Document id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Appeal status (pending, accepted or rejected)",
+                        "name": "status",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/api_proposal.Proposal"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Appeal"
+                            }
                         }
                     },
                     "400": {
@@ -677,27 +883,32 @@ const docTemplate = `{
                     }
                 }
             },
-            "delete": {
-                "description": "Given a document ID, delete all its proposals",
+            "post": {
+                "description": "Submit an appeal against the ban currently in effect for the logged user, only one appeal per ban is allowed",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
+                    "moderation"
                 ],
-                "summary": "Delete all proposals for a document",
+                "summary": "Appeal a ban",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Document id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Appeal message",
+                        "name": "appeal",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.AppealRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "OK"
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.Appeal"
+                        }
                     },
                     "400": {
                         "description": "Bad Request",
@@ -708,28 +919,40 @@ const docTemplate = `{
                 }
             }
         },
-        "/proposals/document/{id}/approve": {
-            "delete": {
-                "description": "Given a document ID, approve all its proposals",
+        "/moderation/appeals/{id}": {
+            "post": {
+                "description": "Accept or reject an appeal with a reply message, accepting it lifts the ban",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
+                    "moderation"
                 ],
-                "summary": "Approve all proposals for a document",
+                "summary": "Review an appeal",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Document id",
+                        "description": "Appeal id",
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "description": "Review outcome",
+                        "name": "review",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.AppealReviewRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "OK"
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.Appeal"
+                        }
                     },
                     "400": {
                         "description": "Bad Request",
@@ -740,30 +963,24 @@ const docTemplate = `{
                 }
             }
         },
-        "/proposals/{id}": {
+        "/moderation/ban": {
             "get": {
-                "description": "Get a proposal given its ID",
+                "description": "Get all banned users",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
-                ],
-                "summary": "Get proposal by id",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Proposal id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
+                    "moderation"
                 ],
+                "summary": "Get all banned users",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/api_proposal.Proposal"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.BannedUser"
+                            }
                         }
                     },
                     "400": {
@@ -774,27 +991,32 @@ const docTemplate = `{
                     }
                 }
             },
-            "delete": {
-                "description": "Given a proposal ID, delete the proposal",
+            "post": {
+                "description": "Ban or unban a user given its username",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
+                    "moderation"
                 ],
-                "summary": "Delete a proposal",
+                "summary": "Ban or unban a user",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Proposal id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Ban or unban a user",
+                        "name": "banUser",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.BanUserRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "OK"
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
                     },
                     "400": {
                         "description": "Bad Request",
@@ -803,21 +1025,23 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
-            "patch": {
-                "description": "Given a proposal ID, update the proposal",
+            }
+        },
+        "/moderation/ban/{username}/history": {
+            "get": {
+                "description": "Get all bans, active or not, of a user given its username",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "proposal"
+                    "moderation"
                 ],
-                "summary": "Update a proposal",
+                "summary": "Get the ban history of a user",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Proposal id",
-                        "name": "id",
+                        "description": "Username",
+                        "name": "username",
                         "in": "path",
                         "required": true
                     }
@@ -826,7 +1050,10 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/api_proposal.Proposal"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Ban"
+                            }
                         }
                     },
                     "400": {
@@ -838,21 +1065,32 @@ const docTemplate = `{
                 }
             }
         },
-        "/proposals/{id}/approve": {
-            "post": {
-                "description": "Approve a proposal given its id",
+        "/moderation/filter/hits": {
+            "get": {
+                "description": "Get the latest answers which matched the content filter",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "answer"
+                    "moderation"
+                ],
+                "summary": "Get content filter hits",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of hits, 100 by default",
+                        "name": "limit",
+                        "in": "query"
+                    }
                 ],
-                "summary": "Approve a proposal",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Question"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.FilterHit"
+                            }
                         }
                     },
                     "400": {
@@ -864,32 +1102,23 @@ const docTemplate = `{
                 }
             }
         },
-        "/questions/{id}": {
+        "/moderation/moderators": {
             "get": {
-                "description": "Given a question ID, return the question and all its answers",
+                "description": "Get all the document paths users have been granted moderator rights on",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "question"
-                ],
-                "summary": "Get all answers given a question",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Answer id",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
+                    "moderation"
                 ],
+                "summary": "Get all moderator scopes",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/api.Question"
+                                "$ref": "#/definitions/api.ModeratorScope"
                             }
                         }
                     },
@@ -901,18 +1130,780 @@ const docTemplate = `{
                     }
                 }
             },
-            "delete": {
-                "description": "Given a question ID, delete the question",
+            "post": {
+                "description": "Grant a user moderator rights on the documents whose path starts with the given prefix",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "question"
+                    "moderation"
                 ],
-                "summary": "Delete a question",
+                "summary": "Grant moderator rights",
                 "parameters": [
                     {
-                        "type": "string",
+                        "description": "User and path prefix",
+                        "name": "scope",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.ModeratorScopeRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.ModeratorScope"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/moderators/{id}": {
+            "delete": {
+                "description": "Revoke a moderator scope given its ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Revoke moderator rights",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Moderator scope id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/queue": {
+            "get": {
+                "description": "Get the answers waiting for approval, oldest first. Moderators only see the ones about the documents they moderate.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Get the pre-moderation queue",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.QueuedAnswer"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/queue/{id}": {
+            "post": {
+                "description": "Approve or reject an answer waiting for approval. Approving it may make its author trusted, which approves their other answers held by the trust policy.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Review a queued answer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Answer id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Review outcome",
+                        "name": "review",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.QueueReviewRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.QueueReviewResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/report/": {
+            "post": {
+                "description": "Report a target given its type and ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Report an answer, a question, an image or a user",
+                "parameters": [
+                    {
+                        "description": "Report target and cause",
+                        "name": "report",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.ReportRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/report/{id}": {
+            "delete": {
+                "description": "Delete a report given its ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Delete a report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Answer id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/report/{id}/action": {
+            "post": {
+                "description": "Dismiss a report, remove the reported content, ban its author or approve an answer held for review",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Act on a report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Report id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Action to take",
+                        "name": "action",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.ReportActionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/reports": {
+            "get": {
+                "description": "Get all reports, moderators only get the ones about the documents they moderate",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Get all reports",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Report"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/shadowban": {
+            "get": {
+                "description": "Get all shadow-banned users",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Get all shadow-banned users",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.ShadowBannedUser"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Hide the answers, votes and reports of a user from everyone else, without telling them",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Shadow-ban or un-shadow-ban a user",
+                "parameters": [
+                    {
+                        "description": "Shadow-ban or un-shadow-ban a user",
+                        "name": "shadowBan",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.ShadowBanRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/warnings": {
+            "post": {
+                "description": "Issue a warning to the author of an answer or of a reported content, banning them if the escalation policy says so",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Warn a user",
+                "parameters": [
+                    {
+                        "description": "Warning data",
+                        "name": "warning",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.WarningRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.WarningResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/moderation/warnings/{username}": {
+            "get": {
+                "description": "Get all warnings, active or expired, of a user given its username",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Get the warnings of a user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Username",
+                        "name": "username",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Warning"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/proposals": {
+            "get": {
+                "description": "Get all proposals",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Get all proposals",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api_proposal.DocumentProposal"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Insert a new proposal for a document",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Insert a new proposal",
+                "parameters": [
+                    {
+                        "description": "Proposal data to insert",
+                        "name": "proposalReq",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api_proposal.DocumentProposal"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api_proposal.DocumentProposal"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/proposals/document/{id}": {
+            "get": {
+                "description": "Get all proposals for a document, given its ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Get proposals by document id",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Document id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api_proposal.Proposal"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Given a document ID, delete all its proposals",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Delete all proposals for a document",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Document id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/proposals/document/{id}/approve": {
+            "delete": {
+                "description": "Given a document ID, approve all its proposals",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Approve all proposals for a document",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Document id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/proposals/{id}": {
+            "get": {
+                "description": "Get a proposal given its ID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Get proposal by id",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Proposal id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api_proposal.Proposal"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Given a proposal ID, delete the proposal",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Delete a proposal",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Proposal id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Given a proposal ID, update the proposal",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "proposal"
+                ],
+                "summary": "Update a proposal",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Proposal id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api_proposal.Proposal"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/proposals/{id}/approve": {
+            "post": {
+                "description": "Approve a proposal given its id",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "answer"
+                ],
+                "summary": "Approve a proposal",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Question"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/questions/{id}": {
+            "get": {
+                "description": "Given a question ID, return the question and all its answers",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "question"
+                ],
+                "summary": "Get all answers given a question",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Answer id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a previous response",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Question"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "not modified"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Given a question ID, delete the question",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "question"
+                ],
+                "summary": "Delete a question",
+                "parameters": [
+                    {
+                        "type": "string",
                         "description": "Question id",
                         "name": "id",
                         "in": "path",
@@ -931,76 +1922,466 @@ const docTemplate = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "api.Answer": {
+        },
+        "/readyz": {
+            "get": {
+                "description": "Check that the database answers, the images storage is writable and the auth server is reachable. Fails while the server is shutting down.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Readiness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.HealthResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/api.HealthResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/warnings": {
+            "get": {
+                "description": "Get the active warnings of the logged user",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "moderation"
+                ],
+                "summary": "Get my warnings",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.Warning"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/httputil.ApiError"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "api.Answer": {
+            "type": "object",
+            "properties": {
+                "can_i_delete": {
+                    "type": "boolean"
+                },
+                "content": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "downvotes": {
+                    "type": "integer"
+                },
+                "hold_reason": {
+                    "type": "string"
+                },
+                "i_voted": {
+                    "$ref": "#/definitions/api.VoteValue"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "parent": {
+                    "type": "integer"
+                },
+                "question": {
+                    "type": "integer"
+                },
+                "removal_reason": {
+                    "description": "RemovalReason and HoldReason are only shown to the author of the answer",
+                    "type": "string"
+                },
+                "replies": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.Answer"
+                    }
+                },
+                "state": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "upvotes": {
+                    "type": "integer"
+                },
+                "user": {
+                    "type": "string"
+                },
+                "user_avatar_url": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Appeal": {
+            "type": "object",
+            "properties": {
+                "ban_id": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "reply": {
+                    "type": "string"
+                },
+                "reviewed_at": {
+                    "type": "string"
+                },
+                "reviewed_by": {
+                    "type": "string"
+                },
+                "status": {
+                    "$ref": "#/definitions/models.AppealStatus"
+                },
+                "user_avatar_url": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.AppealRequest": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.AppealReviewRequest": {
+            "type": "object",
+            "properties": {
+                "accept": {
+                    "type": "boolean"
+                },
+                "reply": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Ban": {
+            "type": "object",
+            "properties": {
+                "active": {
+                    "type": "boolean"
+                },
+                "banned_by": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "lift_reason": {
+                    "type": "string"
+                },
+                "lifted_at": {
+                    "type": "string"
+                },
+                "lifted_by": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.BanUserRequest": {
+            "type": "object",
+            "properties": {
+                "ban": {
+                    "type": "boolean"
+                },
+                "expires_at": {
+                    "description": "ExpiresAt is only used when banning, a nil value means a permanent ban",
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.BannedUser": {
             "type": "object",
             "properties": {
-                "can_i_delete": {
-                    "type": "boolean"
+                "banned_at": {
+                    "type": "string"
                 },
-                "content": {
+                "banned_by": {
                     "type": "string"
                 },
-                "created_at": {
+                "expires_at": {
                     "type": "string"
                 },
-                "downvotes": {
+                "id": {
                     "type": "integer"
                 },
-                "i_voted": {
-                    "$ref": "#/definitions/api.VoteValue"
+                "reason": {
+                    "type": "string"
                 },
-                "id": {
-                    "type": "integer"
+                "user_avatar_url": {
+                    "type": "string"
                 },
-                "parent": {
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Coord": {
+            "type": "object",
+            "properties": {
+                "end": {
                     "type": "integer"
                 },
-                "question": {
+                "start": {
                     "type": "integer"
+                }
+            }
+        },
+        "api.DeleteAnswerRequest": {
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Document": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
                 },
-                "replies": {
+                "questions": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/api.Answer"
+                        "$ref": "#/definitions/api.Question"
                     }
+                }
+            }
+        },
+        "api.FilterHit": {
+            "type": "object",
+            "properties": {
+                "answer_id": {
+                    "type": "integer"
                 },
-                "updated_at": {
+                "created_at": {
                     "type": "string"
                 },
-                "upvotes": {
+                "details": {
+                    "type": "string"
+                },
+                "id": {
                     "type": "integer"
                 },
-                "user": {
+                "rules": {
                     "type": "string"
                 },
-                "user_avatar_url": {
+                "username": {
+                    "type": "string"
+                },
+                "verdict": {
                     "type": "string"
                 }
             }
         },
-        "api.BanUserRequest": {
+        "api.GCReportResponse": {
             "type": "object",
             "properties": {
-                "ban": {
+                "report": {
+                    "$ref": "#/definitions/util.GCReport"
+                },
+                "run": {
+                    "$ref": "#/definitions/api.JobRun"
+                }
+            }
+        },
+        "api.HealthResponse": {
+            "type": "object",
+            "properties": {
+                "checks": {
+                    "description": "Checks maps each dependency to \"ok\" or to the reason it is unavailable",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Image": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Job": {
+            "type": "object",
+            "properties": {
+                "disabled": {
                     "type": "boolean"
                 },
+                "last_run": {
+                    "$ref": "#/definitions/api.JobRun"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "next_run": {
+                    "type": "string"
+                },
+                "run_at_startup": {
+                    "type": "boolean"
+                },
+                "schedule": {
+                    "type": "string"
+                },
+                "timeout": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.JobRun": {
+            "type": "object",
+            "properties": {
+                "duration": {
+                    "description": "Duration is in milliseconds",
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "finished_at": {
+                    "type": "string"
+                },
+                "host": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "job": {
+                    "type": "string"
+                },
+                "outcome": {
+                    "$ref": "#/definitions/models.JobOutcome"
+                },
+                "scheduled_at": {
+                    "type": "string"
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "trigger": {
+                    "$ref": "#/definitions/models.JobTrigger"
+                },
+                "triggered_by": {
+                    "description": "TriggeredBy is the admin who triggered a manual run",
+                    "type": "string"
+                }
+            }
+        },
+        "api.Log": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "description": "created, updated, deleted, banned, ecc.",
+                    "type": "string"
+                },
+                "after": {
+                    "type": "string"
+                },
+                "before": {
+                    "description": "Before and After are JSON summaries of the item",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "item_id": {
+                    "type": "string"
+                },
+                "item_type": {
+                    "description": "answer, image, ecc.",
+                    "type": "string"
+                },
+                "request_id": {
+                    "type": "string"
+                },
+                "timestamp": {
+                    "type": "string"
+                },
+                "user_avatar_url": {
+                    "type": "string"
+                },
                 "username": {
                     "type": "string"
                 }
             }
         },
-        "api.BannedUser": {
+        "api.ModeratorScope": {
             "type": "object",
             "properties": {
-                "banned_at": {
+                "created_at": {
+                    "type": "string"
+                },
+                "granted_by": {
                     "type": "string"
                 },
                 "id": {
                     "type": "integer"
                 },
+                "path_prefix": {
+                    "type": "string"
+                },
                 "user_avatar_url": {
                     "type": "string"
                 },
@@ -1009,146 +2390,322 @@ const docTemplate = `{
                 }
             }
         },
-        "api.Coord": {
+        "api.ModeratorScopeRequest": {
+            "type": "object",
+            "properties": {
+                "path_prefix": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.PostDocumentRequest": {
+            "type": "object",
+            "properties": {
+                "coords": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.Coord"
+                    }
+                },
+                "document_path": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.Question": {
             "type": "object",
             "properties": {
+                "answers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.Answer"
+                    }
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "document": {
+                    "type": "string"
+                },
                 "end": {
                     "type": "integer"
                 },
-                "start": {
+                "id": {
+                    "type": "integer"
+                },
+                "start": {
+                    "type": "integer"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "api.QueueReviewRequest": {
+            "type": "object",
+            "properties": {
+                "approve": {
+                    "type": "boolean"
+                },
+                "reason": {
+                    "description": "Reason is shown to the author when the answer is rejected",
+                    "type": "string"
+                }
+            }
+        },
+        "api.QueueReviewResponse": {
+            "type": "object",
+            "properties": {
+                "auto_approved": {
+                    "description": "AutoApproved lists the answers approved because their author reached\nthe trust threshold",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "api.QueuedAnswer": {
+            "type": "object",
+            "properties": {
+                "anonymous": {
+                    "type": "boolean"
+                },
+                "content": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "document_path": {
+                    "type": "string"
+                },
+                "hold_reason": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "parent": {
+                    "type": "integer"
+                },
+                "question": {
                     "type": "integer"
+                },
+                "username": {
+                    "description": "Username is the real author, even for anonymous answers",
+                    "type": "string"
                 }
             }
         },
-        "api.Document": {
+        "api.Report": {
             "type": "object",
             "properties": {
+                "cause": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
                 "id": {
+                    "type": "integer"
+                },
+                "preview": {
+                    "$ref": "#/definitions/api.ReportPreview"
+                },
+                "target_id": {
                     "type": "string"
                 },
-                "questions": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/api.Question"
-                    }
+                "target_type": {
+                    "$ref": "#/definitions/models.ReportTargetType"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "user_avatar_url": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
                 }
             }
         },
-        "api.Image": {
+        "api.ReportAction": {
+            "type": "string",
+            "enum": [
+                "dismiss",
+                "remove",
+                "ban",
+                "approve"
+            ],
+            "x-enum-varnames": [
+                "ReportActionDismiss",
+                "ReportActionRemove",
+                "ReportActionBan",
+                "ReportActionApprove"
+            ]
+        },
+        "api.ReportActionRequest": {
             "type": "object",
             "properties": {
-                "id": {
-                    "type": "string"
+                "action": {
+                    "$ref": "#/definitions/api.ReportAction"
                 },
-                "url": {
+                "reason": {
+                    "description": "Reason is shown to the author of the removed answer or to the banned\nuser, the cause of the report is only seen by the moderators",
                     "type": "string"
                 }
             }
         },
-        "api.Log": {
+        "api.ReportPreview": {
             "type": "object",
             "properties": {
-                "action": {
-                    "description": "Created, Updated, Deleted",
+                "alias": {
                     "type": "string"
                 },
-                "item_id": {
+                "content": {
                     "type": "string"
                 },
-                "item_type": {
-                    "description": "Answer, Image, ecc.",
+                "document_id": {
                     "type": "string"
                 },
-                "timestamp": {
+                "document_path": {
                     "type": "string"
                 },
-                "user_avatar_url": {
+                "image_url": {
                     "type": "string"
                 },
+                "missing": {
+                    "description": "Missing is true when the target doesn't exist anymore",
+                    "type": "boolean"
+                },
+                "question_id": {
+                    "type": "integer"
+                },
                 "username": {
                     "type": "string"
                 }
             }
         },
-        "api.PostDocumentRequest": {
+        "api.ReportRequest": {
             "type": "object",
             "properties": {
-                "coords": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/api.Coord"
-                    }
+                "answer": {
+                    "description": "Deprecated: kept for clients which can only report answers, use\nTargetType and TargetID instead",
+                    "type": "integer"
                 },
-                "document_path": {
+                "cause": {
                     "type": "string"
                 },
-                "id": {
+                "target_id": {
+                    "description": "For users, either the username or the alias",
                     "type": "string"
+                },
+                "target_type": {
+                    "$ref": "#/definitions/models.ReportTargetType"
                 }
             }
         },
-        "api.Question": {
+        "api.Setting": {
             "type": "object",
             "properties": {
-                "answers": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/api.Answer"
-                    }
+                "default": {
+                    "type": "integer"
                 },
-                "created_at": {
+                "description": {
                     "type": "string"
                 },
-                "document": {
-                    "type": "string"
+                "key": {
+                    "$ref": "#/definitions/util.SettingKey"
                 },
-                "end": {
+                "max": {
                     "type": "integer"
                 },
-                "id": {
+                "min": {
                     "type": "integer"
                 },
-                "start": {
-                    "type": "integer"
+                "overrides": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.SettingOverride"
+                    }
                 },
-                "updated_at": {
+                "quota": {
+                    "description": "Quota settings can be overridden per role and per user",
+                    "type": "boolean"
+                },
+                "unit": {
                     "type": "string"
+                },
+                "value": {
+                    "type": "integer"
                 }
             }
         },
-        "api.Report": {
+        "api.SettingOverride": {
             "type": "object",
             "properties": {
-                "answer_id": {
-                    "type": "integer"
+                "role": {
+                    "type": "string"
                 },
-                "cause": {
+                "updated_at": {
                     "type": "string"
                 },
-                "created_at": {
+                "updated_by": {
                     "type": "string"
                 },
-                "id": {
+                "username": {
+                    "type": "string"
+                },
+                "value": {
                     "type": "integer"
+                }
+            }
+        },
+        "api.SettingRequest": {
+            "type": "object",
+            "properties": {
+                "key": {
+                    "$ref": "#/definitions/util.SettingKey"
                 },
-                "updated_at": {
+                "role": {
                     "type": "string"
                 },
-                "user_avatar_url": {
+                "username": {
                     "type": "string"
                 },
+                "value": {
+                    "type": "integer"
+                }
+            }
+        },
+        "api.ShadowBanRequest": {
+            "type": "object",
+            "properties": {
+                "shadow_ban": {
+                    "type": "boolean"
+                },
                 "username": {
                     "type": "string"
                 }
             }
         },
-        "api.ReportRequest": {
+        "api.ShadowBannedUser": {
             "type": "object",
             "properties": {
-                "answer": {
+                "id": {
                     "type": "integer"
                 },
-                "cause": {
+                "user_avatar_url": {
+                    "type": "string"
+                },
+                "username": {
                     "type": "string"
                 }
             }
@@ -1187,6 +2744,67 @@ const docTemplate = `{
                 "VoteDown"
             ]
         },
+        "api.Warning": {
+            "type": "object",
+            "properties": {
+                "active": {
+                    "type": "boolean"
+                },
+                "answer_id": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "issued_by": {
+                    "description": "IssuedBy is only shown to admins",
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "report_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "api.WarningRequest": {
+            "type": "object",
+            "properties": {
+                "answer_id": {
+                    "description": "Exactly one between AnswerID and ReportID must be set, the warned user\nis the author of the answer or of the reported content",
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "report_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "api.WarningResponse": {
+            "type": "object",
+            "properties": {
+                "ban": {
+                    "description": "Ban is set when the warning triggered the escalation policy",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/api.Ban"
+                        }
+                    ]
+                },
+                "warning": {
+                    "$ref": "#/definitions/api.Warning"
+                }
+            }
+        },
         "api_proposal.DocumentProposal": {
             "type": "object",
             "properties": {
@@ -1271,6 +2889,10 @@ const docTemplate = `{
                 "downvotes": {
                     "type": "integer"
                 },
+                "holdReason": {
+                    "description": "HoldReason tells why a pending answer is waiting for approval",
+                    "type": "string"
+                },
                 "id": {
                     "description": "taken from from gorm.Model, so we can json strigify properly",
                     "type": "integer"
@@ -1281,6 +2903,10 @@ const docTemplate = `{
                 "question": {
                     "type": "integer"
                 },
+                "removalReason": {
+                    "description": "RemovalReason is set by admins when deleting an answer, and is shown\nto its author",
+                    "type": "string"
+                },
                 "replies": {
                     "type": "array",
                     "items": {
@@ -1313,12 +2939,59 @@ const docTemplate = `{
             "enum": [
                 0,
                 1,
-                2
+                2,
+                3
             ],
             "x-enum-varnames": [
                 "AnswerStateVisible",
                 "AnswerStateDeletedByUser",
-                "AnswerStateDeletedByAdmin"
+                "AnswerStateDeletedByAdmin",
+                "AnswerStatePending"
+            ]
+        },
+        "models.AppealStatus": {
+            "type": "string",
+            "enum": [
+                "pending",
+                "accepted",
+                "rejected"
+            ],
+            "x-enum-varnames": [
+                "AppealStatusPending",
+                "AppealStatusAccepted",
+                "AppealStatusRejected"
+            ]
+        },
+        "models.JobOutcome": {
+            "type": "string",
+            "enum": [
+                "running",
+                "success",
+                "failed",
+                "timeout",
+                "cancelled",
+                "skipped"
+            ],
+            "x-enum-varnames": [
+                "JobOutcomeRunning",
+                "JobOutcomeSuccess",
+                "JobOutcomeFailed",
+                "JobOutcomeTimeout",
+                "JobOutcomeCancelled",
+                "JobOutcomeSkipped"
+            ]
+        },
+        "models.JobTrigger": {
+            "type": "string",
+            "enum": [
+                "schedule",
+                "startup",
+                "manual"
+            ],
+            "x-enum-varnames": [
+                "JobTriggerSchedule",
+                "JobTriggerStartup",
+                "JobTriggerManual"
             ]
         },
         "models.PostAnswerRequest": {
@@ -1379,6 +3052,21 @@ const docTemplate = `{
                 }
             }
         },
+        "models.ReportTargetType": {
+            "type": "string",
+            "enum": [
+                "answer",
+                "question",
+                "image",
+                "user"
+            ],
+            "x-enum-varnames": [
+                "ReportTargetAnswer",
+                "ReportTargetQuestion",
+                "ReportTargetImage",
+                "ReportTargetUser"
+            ]
+        },
         "models.Vote": {
             "type": "object",
             "properties": {
@@ -1400,6 +3088,108 @@ const docTemplate = `{
                     "format": "int32"
                 }
             }
+        },
+        "util.AuditChainBreak": {
+            "type": "object",
+            "properties": {
+                "event_id": {
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "util.AuditChainVerification": {
+            "type": "object",
+            "properties": {
+                "checkpoints": {
+                    "type": "integer"
+                },
+                "events": {
+                    "type": "integer"
+                },
+                "first_broken": {
+                    "$ref": "#/definitions/util.AuditChainBreak"
+                }
+            }
+        },
+        "util.GCImage": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "util.GCReport": {
+            "type": "object",
+            "properties": {
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "grace_period": {
+                    "type": "string"
+                },
+                "purged": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/util.GCImage"
+                    }
+                },
+                "quarantine_period": {
+                    "type": "string"
+                },
+                "quarantined": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/util.GCImage"
+                    }
+                },
+                "restored": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/util.GCImage"
+                    }
+                },
+                "scanned": {
+                    "description": "Scanned is the number of images past the grace period",
+                    "type": "integer"
+                }
+            }
+        },
+        "util.SettingKey": {
+            "type": "string",
+            "enum": [
+                "images.max_size",
+                "images.max_total_size",
+                "images.max_number",
+                "answers.replies_depth"
+            ],
+            "x-enum-varnames": [
+                "SettingMaxImageSize",
+                "SettingMaxImagesSize",
+                "SettingMaxImages",
+                "SettingRepliesDepth"
+            ]
         }
     }
 }`
@@ -0,0 +1,16 @@
+DROP TABLE "job_runs";
+DROP TABLE "audit_events";
+DROP TABLE "appeals";
+DROP TABLE "moderator_scopes";
+DROP TABLE "filter_hits";
+DROP TABLE "answer_state_changes";
+DROP TABLE "warnings";
+DROP TABLE "bans";
+DROP TABLE "reports";
+DROP TABLE "answer_versions";
+DROP TABLE "images";
+DROP TABLE "votes";
+DROP TABLE "answers";
+DROP TABLE "questions";
+DROP TABLE "proposals";
+DROP TABLE "users";
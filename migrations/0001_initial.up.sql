@@ -0,0 +1,243 @@
+-- The schema as created by AutoMigrate before the versioned migrations. The
+-- databases created by AutoMigrate are upgraded to it with AutoMigrate once,
+-- and marked as migrated to this version without running it.
+
+CREATE TABLE "users" (
+    "id" bigserial,
+    "username" text,
+    "alias" text,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "shadow_banned" boolean DEFAULT false,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE "proposals" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "document_id" text,
+    "document_path" text,
+    "start" bigint,
+    "end" bigint,
+    "user_id" bigint NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_proposals" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX "idx_proposals_user_id" ON "proposals" ("user_id");
+CREATE INDEX "idx_proposals_deleted_at" ON "proposals" ("deleted_at");
+
+CREATE TABLE "questions" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "document" text,
+    "document_path" text,
+    "start" bigint,
+    "end" bigint,
+    "user_id" bigint NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_questions" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX "idx_questions_user_id" ON "questions" ("user_id");
+CREATE INDEX "idx_questions_deleted_at" ON "questions" ("deleted_at");
+
+CREATE TABLE "answers" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "question" bigint,
+    "parent" bigint,
+    "user_id" bigint,
+    "upvotes" bigint,
+    "downvotes" bigint,
+    "anonymous" boolean,
+    "state" smallint,
+    "removal_reason" text,
+    "hold_reason" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_answers_replies" FOREIGN KEY ("parent") REFERENCES "answers"("id"),
+    CONSTRAINT "fk_questions_answers" FOREIGN KEY ("question") REFERENCES "questions"("id")
+);
+CREATE INDEX "idx_answers_deleted_at" ON "answers" ("deleted_at");
+
+CREATE TABLE "votes" (
+    "answer_id" bigint,
+    "user_id" bigint,
+    "vote" smallint,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("answer_id","user_id"),
+    CONSTRAINT "fk_answers_votes" FOREIGN KEY ("answer_id") REFERENCES "answers"("id")
+);
+
+CREATE TABLE "images" (
+    "id" text,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "size" bigint NOT NULL,
+    "quarantined_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_images_quarantined_at" ON "images" ("quarantined_at");
+CREATE INDEX "idx_images_user_id" ON "images" ("user_id");
+
+CREATE TABLE "answer_versions" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "answer_id" bigint NOT NULL,
+    "content" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_answer_versions_answer_id" ON "answer_versions" ("answer_id");
+
+CREATE TABLE "reports" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "target_type" text NOT NULL,
+    "target_id" text NOT NULL,
+    "cause" text,
+    "user_id" bigint NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_reports" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX "idx_reports_user_id" ON "reports" ("user_id");
+CREATE INDEX "idx_report_target" ON "reports" ("target_type","target_id");
+CREATE INDEX "idx_reports_deleted_at" ON "reports" ("deleted_at");
+
+CREATE TABLE "bans" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "issued_by" bigint NOT NULL,
+    "reason" text,
+    "starts_at" timestamptz NOT NULL,
+    "expires_at" timestamptz,
+    "lifted_at" timestamptz,
+    "lifted_by" bigint,
+    "lift_reason" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_bans" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX "idx_bans_user_id" ON "bans" ("user_id");
+
+CREATE TABLE "warnings" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "issued_by" bigint NOT NULL,
+    "reason" text,
+    "answer_id" bigint,
+    "report_id" bigint,
+    "expires_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_warnings" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX "idx_warnings_expires_at" ON "warnings" ("expires_at");
+CREATE INDEX "idx_warnings_user_id" ON "warnings" ("user_id");
+CREATE INDEX "idx_warnings_deleted_at" ON "warnings" ("deleted_at");
+
+CREATE TABLE "answer_state_changes" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "answer_id" bigint NOT NULL,
+    "user_id" bigint NOT NULL,
+    "from_state" smallint,
+    "to_state" smallint,
+    "reason" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_answer_state_changes_answer_id" ON "answer_state_changes" ("answer_id");
+
+CREATE TABLE "filter_hits" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "answer_id" bigint,
+    "verdict" text,
+    "rules" text,
+    "details" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_filter_hits_user_id" ON "filter_hits" ("user_id");
+
+CREATE TABLE "moderator_scopes" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "path_prefix" text NOT NULL,
+    "granted_by" bigint NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_moderator_scopes_user_id" ON "moderator_scopes" ("user_id");
+CREATE INDEX "idx_moderator_scopes_deleted_at" ON "moderator_scopes" ("deleted_at");
+
+CREATE TABLE "appeals" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "ban_id" bigint NOT NULL,
+    "user_id" bigint NOT NULL,
+    "message" text,
+    "status" text NOT NULL DEFAULT 'pending',
+    "reply" text,
+    "reviewed_by" bigint,
+    "reviewed_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_appeals_status" ON "appeals" ("status");
+CREATE INDEX "idx_appeals_user_id" ON "appeals" ("user_id");
+CREATE UNIQUE INDEX "idx_appeals_ban_id" ON "appeals" ("ban_id");
+
+CREATE TABLE "audit_events" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "actor_id" bigint NOT NULL,
+    "action" text NOT NULL,
+    "target_type" text NOT NULL,
+    "target_id" text NOT NULL,
+    "before" text,
+    "after" text,
+    "request_id" text,
+    "prev_hash" text,
+    "hash" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_audit_events_hash" ON "audit_events" ("hash");
+CREATE INDEX "idx_audit_events_request_id" ON "audit_events" ("request_id");
+CREATE INDEX "idx_audit_events_target" ON "audit_events" ("target_type","target_id");
+CREATE INDEX "idx_audit_events_action" ON "audit_events" ("action");
+CREATE INDEX "idx_audit_events_actor_id" ON "audit_events" ("actor_id");
+CREATE INDEX "idx_audit_events_created_at" ON "audit_events" ("created_at");
+
+CREATE TABLE "job_runs" (
+    "id" bigserial,
+    "started_at" timestamptz,
+    "job" text NOT NULL,
+    "trigger" text NOT NULL,
+    "triggered_by" bigint,
+    "host" text,
+    "finished_at" timestamptz,
+    "duration" bigint,
+    "outcome" text NOT NULL,
+    "error" text,
+    "report" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_job_runs_outcome" ON "job_runs" ("outcome");
+CREATE INDEX "idx_job_runs_job" ON "job_runs" ("job");
+CREATE INDEX "idx_job_runs_started_at" ON "job_runs" ("started_at");
@@ -0,0 +1,9 @@
+CREATE TABLE "settings" (
+    "key" text,
+    "role" text,
+    "user_id" bigint,
+    "value" bigint NOT NULL,
+    "updated_at" timestamptz,
+    "updated_by" bigint NOT NULL,
+    PRIMARY KEY ("key", "role", "user_id")
+);
@@ -0,0 +1,10 @@
+-- the buckets are refilled within minutes, so they don't need to survive a
+-- crash of the database
+CREATE UNLOGGED TABLE "rate_limit_buckets" (
+    "key" text,
+    "tokens" double precision NOT NULL,
+    "allowed" boolean NOT NULL,
+    "updated_at" timestamptz NOT NULL,
+    PRIMARY KEY ("key")
+);
+CREATE INDEX "idx_rate_limit_buckets_updated_at" ON "rate_limit_buckets" ("updated_at");
@@ -0,0 +1,3 @@
+-- the reports of the system can't be kept without a reporter
+DELETE FROM "reports" WHERE "user_id" IS NULL;
+ALTER TABLE "reports" ALTER COLUMN "user_id" SET NOT NULL;
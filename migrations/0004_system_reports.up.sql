@@ -0,0 +1,3 @@
+-- the reports of the content filter are made by the system, which is not a
+-- user, so they have no reporter
+ALTER TABLE "reports" ALTER COLUMN "user_id" DROP NOT NULL;
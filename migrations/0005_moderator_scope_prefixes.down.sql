@@ -0,0 +1,2 @@
+-- the prefixes without the trailing slash are valid for the older releases too
+SELECT 1;
@@ -0,0 +1,4 @@
+-- the scopes cover whole path segments, so the prefixes are stored without
+-- the trailing slash
+UPDATE "moderator_scopes" SET "path_prefix" = rtrim("path_prefix", '/')
+WHERE "path_prefix" LIKE '%/' AND rtrim("path_prefix", '/') <> '';
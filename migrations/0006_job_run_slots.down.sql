@@ -0,0 +1,2 @@
+DROP INDEX "idx_job_runs_slot";
+ALTER TABLE "job_runs" DROP COLUMN "scheduled_at";
@@ -0,0 +1,4 @@
+-- the scheduled runs record the slot they were scheduled at, so that each
+-- slot is run by a single replica
+ALTER TABLE "job_runs" ADD COLUMN "scheduled_at" timestamptz;
+CREATE UNIQUE INDEX "idx_job_runs_slot" ON "job_runs" ("job","scheduled_at");
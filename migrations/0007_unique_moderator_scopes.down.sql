@@ -0,0 +1 @@
+DROP INDEX "idx_moderator_scopes_user_path";
@@ -0,0 +1,7 @@
+-- a user is granted each path prefix once, so that revoking the grant takes
+-- effect. The duplicates granted before are revoked, keeping the oldest grant.
+UPDATE "moderator_scopes" SET "deleted_at" = NOW()
+WHERE "deleted_at" IS NULL AND "id" NOT IN (
+    SELECT MIN("id") FROM "moderator_scopes" WHERE "deleted_at" IS NULL GROUP BY "user_id", "path_prefix"
+);
+CREATE UNIQUE INDEX "idx_moderator_scopes_user_path" ON "moderator_scopes" ("user_id","path_prefix") WHERE "deleted_at" IS NULL;
@@ -0,0 +1,9 @@
+// Package migrations embeds the versioned SQL migrations of the database.
+// Each version has a <version>_<name>.up.sql file applying it and a
+// <version>_<name>.down.sql file reverting it, run in a single transaction.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
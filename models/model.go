@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
@@ -23,6 +24,12 @@ type Answer struct {
 	Votes     []Vote   `gorm:"foreignKey:AnswerID;references:ID"`
 	Anonymous bool
 	State     AnswerState
+
+	// RemovalReason is set by admins when deleting an answer, and is shown
+	// to its author
+	RemovalReason string
+	// HoldReason tells why a pending answer is waiting for approval
+	HoldReason string
 }
 
 type AnswerVersion struct {
@@ -39,8 +46,37 @@ const (
 	AnswerStateVisible AnswerState = iota
 	AnswerStateDeletedByUser
 	AnswerStateDeletedByAdmin
+	// AnswerStatePending answers are only visible to their author until an
+	// admin reviews them
+	AnswerStatePending
 )
 
+func (s AnswerState) String() string {
+	switch s {
+	case AnswerStateVisible:
+		return "visible"
+	case AnswerStateDeletedByUser:
+		return "deleted_by_user"
+	case AnswerStateDeletedByAdmin:
+		return "deleted_by_admin"
+	case AnswerStatePending:
+		return "pending"
+	}
+	return "unknown"
+}
+
+// AnswerStateChange records who changed the state of an answer and why
+type AnswerStateChange struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	AnswerID  uint `gorm:"index; not null;"`
+	UserID    uint `gorm:"not null;"`
+	FromState AnswerState
+	ToState   AnswerState
+	Reason    string
+}
+
 type Question struct {
 	// taken from from gorm.Model, so we can json strigify properly
 	ID        uint `gorm:"primarykey"`
@@ -81,12 +117,41 @@ type User struct {
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 
-	Banned   bool `gorm:"default:false"`
-	BannedAt *time.Time
+	// ShadowBanned users can keep using the service, but their answers,
+	// votes and reports are visible only to themselves
+	ShadowBanned bool `gorm:"default:false"`
 
 	Questions []Question `gorm:"foreignKey:UserID;references:ID"`
 	Proposals []Proposal `gorm:"foreignKey:UserID;references:ID"`
 	Reports   []Report   `gorm:"foreignKey:UserID;references:ID"`
+	Bans      []Ban      `gorm:"foreignKey:UserID;references:ID"`
+	Warnings  []Warning  `gorm:"foreignKey:UserID;references:ID"`
+}
+
+type Ban struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID   uint `gorm:"index; not null;"`
+	IssuedBy uint `gorm:"not null;"`
+	Reason   string
+	StartsAt time.Time `gorm:"not null;"`
+	// ExpiresAt is nil for permanent bans
+	ExpiresAt *time.Time
+
+	// Lifted* fields are set when the ban is revoked before its expiration
+	LiftedAt   *time.Time
+	LiftedBy   *uint
+	LiftReason string
+}
+
+// IsActive reports whether the ban is in effect at the given time
+func (b *Ban) IsActive(at time.Time) bool {
+	if b.StartsAt.After(at) || b.LiftedAt != nil {
+		return false
+	}
+	return b.ExpiresAt == nil || b.ExpiresAt.After(at)
 }
 
 type PostAnswerRequest struct {
@@ -108,6 +173,9 @@ type Image struct {
 
 	UserID uint `gorm:"index; not null; foreignKey:User; references:ID"`
 	Size   uint `gorm:"not null"`
+	// QuarantinedAt is set when the garbage collector soft-deletes an unused
+	// image, its file is removed once the quarantine is over
+	QuarantinedAt *time.Time `gorm:"index"`
 }
 
 type Proposal struct {
@@ -125,13 +193,244 @@ type Proposal struct {
 	UserID uint `gorm:"index; not null;"`
 }
 
+type ReportTargetType string
+
+const (
+	ReportTargetAnswer   ReportTargetType = "answer"
+	ReportTargetQuestion ReportTargetType = "question"
+	ReportTargetImage    ReportTargetType = "image"
+	ReportTargetUser     ReportTargetType = "user"
+)
+
 type Report struct {
 	ID        uint `gorm:"primarykey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 
-	AnswerID uint `gorm:"index; not null;"`
-	Cause    string
+	// TargetID is a string because images are identified by their UUID,
+	// numeric IDs of the other targets are stored in their decimal form
+	TargetType ReportTargetType `gorm:"index:idx_report_target; not null;"`
+	TargetID   string           `gorm:"index:idx_report_target; not null;"`
+	Cause      string
+	// UserID is the reporter, nil for the reports made by the system
+	UserID *uint `gorm:"index;"`
+}
+
+// ReporterID returns the ID of the reporter, zero for the system
+func (r *Report) ReporterID() uint {
+	if r.UserID == nil {
+		return 0
+	}
+	return *r.UserID
+}
+
+type Warning struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
 	UserID   uint `gorm:"index; not null;"`
+	IssuedBy uint `gorm:"not null;"`
+	Reason   string
+
+	// A warning is always tied to the answer or the report that caused it
+	AnswerID *uint
+	ReportID *uint
+
+	// ExpiresAt is when the warning stops counting as a strike
+	ExpiresAt time.Time `gorm:"index; not null;"`
+}
+
+// FilterHit records an answer which matched some content filter rules
+type FilterHit struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID uint `gorm:"index; not null;"`
+	// AnswerID is nil for rejected answers, as they are never saved
+	AnswerID *uint
+	Verdict  string
+	Rules    string
+	Details  string
+}
+
+// ModeratorScope grants moderator rights on the questions whose document path
+// starts with PathPrefix, such as a single degree or course
+type ModeratorScope struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	UserID     uint   `gorm:"index; not null; uniqueIndex:idx_moderator_scopes_user_path,where:deleted_at IS NULL"`
+	PathPrefix string `gorm:"not null; uniqueIndex:idx_moderator_scopes_user_path,where:deleted_at IS NULL"`
+	GrantedBy  uint   `gorm:"not null;"`
+}
+
+type AppealStatus string
+
+const (
+	AppealStatusPending  AppealStatus = "pending"
+	AppealStatusAccepted AppealStatus = "accepted"
+	AppealStatusRejected AppealStatus = "rejected"
+)
+
+// Appeal is the request of a banned user to lift their ban, only one appeal
+// can be submitted for each ban
+type Appeal struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	BanID   uint `gorm:"uniqueIndex; not null;"`
+	UserID  uint `gorm:"index; not null;"`
+	Message string
+	Status  AppealStatus `gorm:"index; not null; default:pending"`
+
+	Reply      string
+	ReviewedBy *uint
+	ReviewedAt *time.Time
+}
+
+type AuditTargetType string
+
+const (
+	AuditTargetAnswer         AuditTargetType = "answer"
+	AuditTargetQuestion       AuditTargetType = "question"
+	AuditTargetDocument       AuditTargetType = "document"
+	AuditTargetImage          AuditTargetType = "image"
+	AuditTargetUser           AuditTargetType = "user"
+	AuditTargetProposal       AuditTargetType = "proposal"
+	AuditTargetReport         AuditTargetType = "report"
+	AuditTargetWarning        AuditTargetType = "warning"
+	AuditTargetAppeal         AuditTargetType = "appeal"
+	AuditTargetModeratorScope AuditTargetType = "moderator-scope"
+	AuditTargetSetting        AuditTargetType = "setting"
+)
+
+type AuditAction string
+
+const (
+	AuditActionCreated        AuditAction = "created"
+	AuditActionUpdated        AuditAction = "updated"
+	AuditActionDeleted        AuditAction = "deleted"
+	AuditActionRestored       AuditAction = "restored"
+	AuditActionApproved       AuditAction = "approved"
+	AuditActionRejected       AuditAction = "rejected"
+	AuditActionDismissed      AuditAction = "dismissed"
+	AuditActionVoted          AuditAction = "voted"
+	AuditActionBanned         AuditAction = "banned"
+	AuditActionUnbanned       AuditAction = "unbanned"
+	AuditActionShadowBanned   AuditAction = "shadow-banned"
+	AuditActionShadowUnbanned AuditAction = "shadow-unbanned"
+	AuditActionWarned         AuditAction = "warned"
+	AuditActionGranted        AuditAction = "granted"
+	AuditActionRevoked        AuditAction = "revoked"
+)
+
+var ErrAuditEventImmutable = errors.New("audit events cannot be modified")
+
+// AuditEvent records a change to the data, who made it and in which request.
+// Before and After are JSON summaries of the target. Events are append-only.
+type AuditEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	ActorID    uint            `gorm:"index; not null;"`
+	Action     AuditAction     `gorm:"index; not null;"`
+	TargetType AuditTargetType `gorm:"index:idx_audit_events_target; not null;"`
+	TargetID   string          `gorm:"index:idx_audit_events_target; not null;"`
+	Before     string
+	After      string
+	RequestID  string `gorm:"index"`
+
+	// Moderation and admin events are linked in a hash chain: Hash is the
+	// SHA-256 of the event and of PrevHash, the hash of the previous chained
+	// event. Both are empty for the events outside of the chain.
+	PrevHash string
+	Hash     string `gorm:"index"`
+	// Chain is set before recording the event to add it to the hash chain
+	Chain bool `gorm:"-"`
+}
+
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+type JobOutcome string
+
+const (
+	JobOutcomeRunning JobOutcome = "running"
+	JobOutcomeSuccess JobOutcome = "success"
+	JobOutcomeFailed  JobOutcome = "failed"
+	JobOutcomeTimeout JobOutcome = "timeout"
+	// JobOutcomeCancelled runs were interrupted by a shutdown
+	JobOutcomeCancelled JobOutcome = "cancelled"
+	// JobOutcomeSkipped runs were triggered manually while another replica
+	// was running the job
+	JobOutcomeSkipped JobOutcome = "skipped"
+)
+
+type JobTrigger string
+
+const (
+	JobTriggerSchedule JobTrigger = "schedule"
+	JobTriggerStartup  JobTrigger = "startup"
+	JobTriggerManual   JobTrigger = "manual"
+)
+
+// JobRun is an execution of a background job by one of the replicas
+type JobRun struct {
+	ID        uint      `gorm:"primarykey"`
+	StartedAt time.Time `gorm:"index"`
+
+	Job     string     `gorm:"index; not null; uniqueIndex:idx_job_runs_slot"`
+	Trigger JobTrigger `gorm:"not null;"`
+	// ScheduledAt is the slot of the scheduled runs, each slot is run once
+	// by whichever replica claims it first
+	ScheduledAt *time.Time `gorm:"uniqueIndex:idx_job_runs_slot"`
+	// TriggeredBy is the admin who triggered a manual run
+	TriggeredBy *uint
+	Host        string
+
+	FinishedAt *time.Time
+	Duration   time.Duration
+	Outcome    JobOutcome `gorm:"index; not null;"`
+	Error      string
+	// Report is the JSON summary returned by the job, if any
+	Report string
+}
+
+// SchemaMigration is a version of the schema applied to the database
+type SchemaMigration struct {
+	Version   uint `gorm:"primarykey; autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Setting is the value of a runtime setting. The global value has an empty
+// Role and a zero UserID, the overrides of the quotas set one of them.
+type Setting struct {
+	Key    string `gorm:"primarykey"`
+	Role   string `gorm:"primarykey"`
+	UserID uint   `gorm:"primarykey; autoIncrement:false"`
+	Value  int64  `gorm:"not null;"`
+
+	UpdatedAt time.Time
+	UpdatedBy uint `gorm:"not null;"`
+}
+
+// RateLimitBucket is a token bucket of the rate limiter, shared by the
+// replicas. Allowed tells whether the last request took a token.
+type RateLimitBucket struct {
+	Key       string    `gorm:"primarykey"`
+	Tokens    float64   `gorm:"not null;"`
+	Allowed   bool      `gorm:"not null;"`
+	UpdatedAt time.Time `gorm:"index; not null;"`
 }
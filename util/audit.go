@@ -0,0 +1,166 @@
+package util
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// AuditSummary marshals a summary of a target for the Before and After fields
+// of an audit event, nil summaries are stored as empty strings
+func AuditSummary(summary any) string {
+	if summary == nil {
+		return ""
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		slog.With("summary", summary, "err", err).Error("could not marshal audit summary")
+		return ""
+	}
+	return string(data)
+}
+
+// RecordAuditEvent appends an event to the audit log, linking it to the hash
+// chain if its Chain field is set. It should be called within the same
+// transaction as the change it records.
+func RecordAuditEvent(db *gorm.DB, event *models.AuditEvent) error {
+	if !event.Chain {
+		return db.Create(event).Error
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := chainAuditEvent(tx, event); err != nil {
+			return err
+		}
+		return tx.Create(event).Error
+	})
+}
+
+func formatID(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// BackfillAuditEvents reconstructs the audit log from the existing tables
+// when it is still empty, so that the history before its introduction is not
+// lost. Actors of deletions are unknown and recorded as the system user.
+func BackfillAuditEvents(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.AuditEvent{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var events []models.AuditEvent
+	event := func(at time.Time, actorID uint, action models.AuditAction, targetType models.AuditTargetType, targetID string) {
+		events = append(events, models.AuditEvent{
+			CreatedAt:  at,
+			ActorID:    actorID,
+			Action:     action,
+			TargetType: targetType,
+			TargetID:   targetID,
+			RequestID:  "backfill",
+		})
+	}
+
+	var images []models.Image
+	if err := db.Unscoped().Find(&images).Error; err != nil {
+		return err
+	}
+	for _, img := range images {
+		event(img.CreatedAt, img.UserID, models.AuditActionCreated, models.AuditTargetImage, img.ID)
+		if img.DeletedAt.Valid {
+			event(img.DeletedAt.Time, 0, models.AuditActionDeleted, models.AuditTargetImage, img.ID)
+		}
+	}
+
+	var answers []models.Answer
+	if err := db.Unscoped().Find(&answers).Error; err != nil {
+		return err
+	}
+	answerAuthors := make(map[uint]uint, len(answers))
+	for _, ans := range answers {
+		answerAuthors[ans.ID] = ans.UserId
+		event(ans.CreatedAt, ans.UserId, models.AuditActionCreated, models.AuditTargetAnswer, formatID(ans.ID))
+		if ans.DeletedAt.Valid {
+			// the moderator who removed it is unknown
+			var actorID uint
+			if ans.State != models.AnswerStateDeletedByAdmin {
+				actorID = ans.UserId
+			}
+			event(ans.DeletedAt.Time, actorID, models.AuditActionDeleted, models.AuditTargetAnswer, formatID(ans.ID))
+		}
+	}
+
+	var versions []models.AnswerVersion
+	if err := db.Find(&versions).Error; err != nil {
+		return err
+	}
+	for _, v := range versions {
+		event(v.CreatedAt, answerAuthors[v.AnswerID], models.AuditActionUpdated, models.AuditTargetAnswer, formatID(v.AnswerID))
+	}
+
+	var changes []models.AnswerStateChange
+	if err := db.Find(&changes).Error; err != nil {
+		return err
+	}
+	for _, c := range changes {
+		action := models.AuditActionDeleted
+		if c.ToState == models.AnswerStateVisible {
+			action = models.AuditActionRestored
+		}
+		event(c.CreatedAt, c.UserID, action, models.AuditTargetAnswer, formatID(c.AnswerID))
+	}
+
+	var users []models.User
+	if err := db.Unscoped().Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		event(u.CreatedAt, u.ID, models.AuditActionCreated, models.AuditTargetUser, formatID(u.ID))
+		if u.DeletedAt.Valid {
+			event(u.DeletedAt.Time, 0, models.AuditActionDeleted, models.AuditTargetUser, formatID(u.ID))
+		}
+	}
+
+	var bans []models.Ban
+	if err := db.Find(&bans).Error; err != nil {
+		return err
+	}
+	for _, b := range bans {
+		event(b.StartsAt, b.IssuedBy, models.AuditActionBanned, models.AuditTargetUser, formatID(b.UserID))
+		if b.LiftedAt != nil {
+			var liftedBy uint
+			if b.LiftedBy != nil {
+				liftedBy = *b.LiftedBy
+			}
+			event(*b.LiftedAt, liftedBy, models.AuditActionUnbanned, models.AuditTargetUser, formatID(b.UserID))
+		}
+	}
+
+	var proposals []models.Proposal
+	if err := db.Unscoped().Find(&proposals).Error; err != nil {
+		return err
+	}
+	for _, p := range proposals {
+		event(p.CreatedAt, p.UserID, models.AuditActionCreated, models.AuditTargetProposal, strconv.FormatUint(p.ID, 10))
+		if p.DeletedAt.Valid {
+			event(p.DeletedAt.Time, 0, models.AuditActionDeleted, models.AuditTargetProposal, strconv.FormatUint(p.ID, 10))
+		}
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(events, func(a, b models.AuditEvent) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	slog.Info("backfilling the audit log", "events", len(events))
+	return db.CreateInBatches(&events, 500).Error
+}
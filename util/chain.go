@@ -0,0 +1,372 @@
+package util
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// auditChainLockID is the key of the advisory lock serializing the appends to
+// the hash chain
+const auditChainLockID = 0x706f6c6c6567
+
+// chainedEvent holds the fields covered by the hash, in a fixed order. The ID
+// is not included as it is assigned by the database on insert, the order of
+// the chain is given by PrevHash instead.
+type chainedEvent struct {
+	PrevHash   string `json:"prev_hash"`
+	CreatedAt  string `json:"created_at"`
+	ActorID    uint   `json:"actor_id"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	RequestID  string `json:"request_id"`
+}
+
+// AuditEventHash computes the hash of a chained event
+func AuditEventHash(e *models.AuditEvent) string {
+	data, _ := json.Marshal(chainedEvent{
+		PrevHash:   e.PrevHash,
+		CreatedAt:  e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ActorID:    e.ActorID,
+		Action:     string(e.Action),
+		TargetType: string(e.TargetType),
+		TargetID:   e.TargetID,
+		Before:     e.Before,
+		After:      e.After,
+		RequestID:  e.RequestID,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainAuditEvent links the event to the last one of the chain. The lock is
+// held until the transaction commits, so that concurrent appends can't fork
+// the chain.
+func chainAuditEvent(tx *gorm.DB, e *models.AuditEvent) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLockID).Error; err != nil {
+		return err
+	}
+
+	var last models.AuditEvent
+	err := tx.Where("hash <> ''").Order("id DESC").Take(&last).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	// the database stores microseconds, the hash must match what is read back
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash = last.Hash
+	e.Hash = AuditEventHash(e)
+	return nil
+}
+
+type AuditChainBreak struct {
+	EventID uint   `json:"event_id"`
+	Reason  string `json:"reason"`
+}
+
+type AuditChainVerification struct {
+	Events      int              `json:"events"`
+	Checkpoints int              `json:"checkpoints"`
+	FirstBroken *AuditChainBreak `json:"first_broken,omitempty"`
+}
+
+// VerifyAuditChain walks the hash chain from the first event, and checks it
+// against the signed checkpoints, if any. It stops at the first broken link.
+func VerifyAuditChain(db *gorm.DB, checkpoints []AuditCheckpoint, publicKey ed25519.PublicKey) (*AuditChainVerification, error) {
+	result := &AuditChainVerification{}
+
+	for _, c := range checkpoints {
+		if !c.Verify(publicKey) {
+			result.FirstBroken = &AuditChainBreak{c.EventID, fmt.Sprintf("invalid signature of the checkpoint of %s", c.Time.Format(time.RFC3339))}
+			return result, nil
+		}
+	}
+	slices.SortFunc(checkpoints, func(a, b AuditCheckpoint) int { return cmp.Compare(a.EventID, b.EventID) })
+
+	prevHash := ""
+	var batch []models.AuditEvent
+	err := db.Where("hash <> ''").FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+		for _, e := range batch {
+			result.Events++
+			switch {
+			case e.PrevHash != prevHash:
+				result.FirstBroken = &AuditChainBreak{e.ID, "the previous hash doesn't match, events have been removed or reordered"}
+			case AuditEventHash(&e) != e.Hash:
+				result.FirstBroken = &AuditChainBreak{e.ID, "the hash doesn't match, the event has been modified"}
+			}
+
+			for len(checkpoints) > 0 && result.FirstBroken == nil && checkpoints[0].EventID <= e.ID {
+				c := checkpoints[0]
+				if c.EventID != e.ID || c.Hash != e.Hash || c.Count != result.Events {
+					result.FirstBroken = &AuditChainBreak{c.EventID, fmt.Sprintf("the chain doesn't match the checkpoint of %s", c.Time.Format(time.RFC3339))}
+				}
+				checkpoints = checkpoints[1:]
+				result.Checkpoints++
+			}
+
+			if result.FirstBroken != nil {
+				return errStopVerification
+			}
+			prevHash = e.Hash
+		}
+		return nil
+	}).Error
+	if err != nil && !errors.Is(err, errStopVerification) {
+		return nil, err
+	}
+
+	// checkpoints after the end of the chain mean the last events have been
+	// removed
+	if result.FirstBroken == nil && len(checkpoints) > 0 {
+		c := checkpoints[0]
+		result.FirstBroken = &AuditChainBreak{c.EventID, fmt.Sprintf("the event of the checkpoint of %s is missing", c.Time.Format(time.RFC3339))}
+	}
+
+	return result, nil
+}
+
+var errStopVerification = errors.New("stop verification")
+
+// AuditCheckpoint is a signed snapshot of the head of the hash chain, written
+// outside of the database so that truncating the chain can be detected
+type AuditCheckpoint struct {
+	Time      time.Time `json:"time"`
+	EventID   uint      `json:"event_id"`
+	Hash      string    `json:"hash"`
+	Count     int       `json:"count"`
+	Signature string    `json:"signature"`
+}
+
+func (c *AuditCheckpoint) signedData() []byte {
+	return fmt.Appendf(nil, "%s|%d|%s|%d", c.Time.UTC().Format(time.RFC3339Nano), c.EventID, c.Hash, c.Count)
+}
+
+func (c *AuditCheckpoint) Verify(publicKey ed25519.PublicKey) bool {
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, c.signedData(), signature)
+}
+
+// LoadAuditCheckpoints reads the checkpoints file, one JSON checkpoint per
+// line. A missing file has no checkpoints.
+func LoadAuditCheckpoints(path string) ([]AuditCheckpoint, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var checkpoints []AuditCheckpoint
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c AuditCheckpoint
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint at line %d: %w", line, err)
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, scanner.Err()
+}
+
+// AuditConfig enables the signed checkpoints of the hash chain when
+// CheckpointPath is set
+type AuditConfig struct {
+	CheckpointPath     string   `toml:"checkpoint_path"`
+	CheckpointKeyPath  string   `toml:"checkpoint_key_path"`
+	CheckpointInterval Duration `toml:"checkpoint_interval"`
+}
+
+// Validate checks the audit config, the paths are checked only if the
+// checkpoints are enabled
+func (c AuditConfig) Validate() error {
+	if c.CheckpointPath == "" {
+		return nil
+	}
+	var errs []error
+	if err := CheckWritableDir(filepath.Dir(c.CheckpointPath)); err != nil {
+		errs = append(errs, &ConfigError{Key: "checkpoint_path", Err: err})
+	}
+	if _, err := os.Stat(c.CheckpointKeyPath); errors.Is(err, os.ErrNotExist) {
+		// the key is generated on startup
+		if err := CheckWritableDir(filepath.Dir(c.CheckpointKeyPath)); err != nil {
+			errs = append(errs, &ConfigError{Key: "checkpoint_key_path", Err: err})
+		}
+	} else if err != nil {
+		errs = append(errs, &ConfigError{Key: "checkpoint_key_path", Err: err})
+	}
+	if c.CheckpointInterval <= 0 {
+		errs = append(errs, configErrorf("checkpoint_interval", "must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// LoadCheckpoints reads the checkpoints and the key to verify them. Both are
+// empty if checkpoints are disabled.
+func (c AuditConfig) LoadCheckpoints() ([]AuditCheckpoint, ed25519.PublicKey, error) {
+	if c.CheckpointPath == "" {
+		return nil, nil, nil
+	}
+
+	key, err := LoadCheckpointKey(c.CheckpointKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	checkpoints, err := LoadAuditCheckpoints(c.CheckpointPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return checkpoints, key.Public().(ed25519.PublicKey), nil
+}
+
+// LoadCheckpointKey reads the base64 encoded ed25519 seed used to sign the
+// checkpoints
+func LoadCheckpointKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid checkpoint key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LoadOrCreateCheckpointKey is like LoadCheckpointKey, but generates a new key
+// if the file doesn't exist
+func LoadOrCreateCheckpointKey(path string) (ed25519.PrivateKey, error) {
+	key, err := LoadCheckpointKey(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	slog.Info("generated a new audit checkpoint key", "path", path,
+		"public_key", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return key, nil
+}
+
+// AuditCheckpointer periodically appends a signed checkpoint of the hash chain
+// to a file
+type AuditCheckpointer struct {
+	path string
+	key  ed25519.PrivateKey
+
+	lastEventID uint
+}
+
+func NewAuditCheckpointer(path string, key ed25519.PrivateKey) (*AuditCheckpointer, error) {
+	checkpoints, err := LoadAuditCheckpoints(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &AuditCheckpointer{path: path, key: key}
+	if len(checkpoints) > 0 {
+		c.lastEventID = checkpoints[len(checkpoints)-1].EventID
+	}
+	return c, nil
+}
+
+// Write appends a checkpoint of the current head of the chain, unless the
+// chain hasn't changed since the last one
+func (c *AuditCheckpointer) Write(db *gorm.DB) error {
+	var head models.AuditEvent
+	err := db.Where("hash <> ''").Order("id DESC").Take(&head).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if head.ID == c.lastEventID {
+		return nil
+	}
+
+	var count int64
+	if err := db.Model(&models.AuditEvent{}).Where("hash <> '' AND id <= ?", head.ID).Count(&count).Error; err != nil {
+		return err
+	}
+
+	checkpoint := AuditCheckpoint{
+		Time:    time.Now().UTC(),
+		EventID: head.ID,
+		Hash:    head.Hash,
+		Count:   int(count),
+	}
+	checkpoint.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, checkpoint.signedData()))
+
+	line, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	c.lastEventID = head.ID
+	return nil
+}
+
+// Run writes a checkpoint every interval, and a last one when ctx is done so
+// that the events recorded before shutting down are covered too
+func (c *AuditCheckpointer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Write(GetDb()); err != nil {
+				slog.With("path", c.path, "err", err).Error("could not write audit checkpoint")
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.Write(GetDbContext(ctx)); err != nil {
+			slog.With("path", c.path, "err", err).Error("could not write audit checkpoint")
+		}
+	}
+}
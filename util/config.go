@@ -0,0 +1,296 @@
+package util
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration wraps time.Duration so that it can be decoded from strings like
+// "24h" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// ConfigError is an invalid value of a config key
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configErrorf returns a ConfigError for key
+func configErrorf(key string, format string, args ...any) error {
+	return &ConfigError{Key: key, Err: fmt.Errorf(format, args...)}
+}
+
+// InSection prefixes the keys of the config errors joined in err with the
+// section they belong to, the other errors are attributed to the section
+func InSection(section string, err error) error {
+	if err == nil {
+		return nil
+	}
+	list := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		list = joined.Unwrap()
+	}
+
+	errs := make([]error, 0, len(list))
+	for _, e := range list {
+		var configErr *ConfigError
+		if errors.As(e, &configErr) {
+			errs = append(errs, &ConfigError{Key: section + "." + configErr.Key, Err: configErr.Err})
+		} else {
+			errs = append(errs, &ConfigError{Key: section, Err: e})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// walkConfig calls fn for each field of the config struct v, identified by
+// its dotted TOML key. The nested structs are walked rather than passed to
+// fn, unless they are decoded from text.
+func walkConfig(v reflect.Value, prefix string, fn func(key string, value reflect.Value, field reflect.StructField)) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		value := v.Field(i)
+		if _, ok := value.Addr().Interface().(encoding.TextUnmarshaler); !ok && value.Kind() == reflect.Struct {
+			walkConfig(value, key, fn)
+			continue
+		}
+		fn(key, value, field)
+	}
+}
+
+// EnvName returns the name of the environment variable overriding a config key
+func EnvName(prefix string, key string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// ApplyEnv overrides the fields of the config struct pointed by v with the
+// environment variables named after their keys by EnvName, or with the
+// content of the file named by the same variable with the _FILE suffix, for
+// secrets. Lists are comma separated, lists of tables can't be overridden.
+// The variables with the prefix which don't match any key are errors too.
+func ApplyEnv(prefix string, v any, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, prefix+"_") {
+			env[name] = value
+		}
+	}
+
+	var errs []error
+	used := make(map[string]bool)
+	walkConfig(reflect.ValueOf(v).Elem(), "", func(key string, value reflect.Value, _ reflect.StructField) {
+		name := EnvName(prefix, key)
+		raw, ok := env[name]
+		path, fromFile := env[name+"_FILE"]
+		used[name], used[name+"_FILE"] = true, true
+		switch {
+		case !ok && !fromFile:
+			return
+		case ok && fromFile:
+			errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", name, name))
+			return
+		case fromFile:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %w", name, err))
+				return
+			}
+			raw = strings.TrimRight(string(data), "\r\n")
+		}
+		if err := setConfigValue(value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+
+	var unknown []string
+	for name := range env {
+		if !used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	slices.Sort(unknown)
+	for _, name := range unknown {
+		errs = append(errs, fmt.Errorf("unknown environment variable %s", name))
+	}
+	return errors.Join(errs...)
+}
+
+func setConfigValue(value reflect.Value, raw string) error {
+	if u, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return errors.New("can't be set from the environment")
+		}
+		items := []string{}
+		for item := range strings.SplitSeq(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items).Convert(value.Type()))
+	default:
+		return errors.New("can't be set from the environment")
+	}
+	return nil
+}
+
+// CheckRequired returns an error for each empty field of the config struct
+// pointed by v tagged with required:"true"
+func CheckRequired(v any) error {
+	var errs []error
+	walkConfig(reflect.ValueOf(v).Elem(), "", func(key string, value reflect.Value, field reflect.StructField) {
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			errs = append(errs, configErrorf(key, "is required"))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+const redacted = "REDACTED"
+
+var dsnPasswordRegex = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactSecrets hides the values of the fields of the config struct pointed
+// by v tagged with secret:"true". The fields tagged with secret:"dsn" are
+// Postgres connection strings, only their password is hidden.
+func RedactSecrets(v any) {
+	walkConfig(reflect.ValueOf(v).Elem(), "", func(key string, value reflect.Value, field reflect.StructField) {
+		if value.Kind() != reflect.String || value.String() == "" {
+			return
+		}
+		switch field.Tag.Get("secret") {
+		case "true":
+			value.SetString(redacted)
+		case "dsn":
+			dsn := value.String()
+			if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), redacted)
+				}
+				value.SetString(u.String())
+			} else {
+				value.SetString(dsnPasswordRegex.ReplaceAllString(dsn, "${1}"+redacted))
+			}
+		}
+	})
+}
+
+// CheckHTTPURL checks that rawURL is an absolute http or https URL
+func CheckHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", rawURL)
+	}
+	return nil
+}
+
+// CheckListenAddress checks that addr is a host:port address to listen on
+func CheckListenAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// CheckWritableDir checks that files can be created in the directory, or in
+// its parent if it doesn't exist yet
+func CheckWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		path = filepath.Dir(path)
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	file, err := os.CreateTemp(path, ".polleg-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", path)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -1,44 +1,101 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/cartabinaria/polleg/models"
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	gorm_logger "gorm.io/gorm/logger"
 )
 
 var db *gorm.DB = nil
 
 func ConnectDb(ConnStr string) error {
+	// queries are logged through the default logger, with the request ID of
+	// the context they run with, all of them when debugging
+	logLevel := gorm_logger.Error
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		logLevel = gorm_logger.Info
+	}
 	config := &gorm.Config{
 		PrepareStmt: true, // optimize raw queries
-		Logger: gorm_logger.New(
-			log.New(os.Stdout, "\r\n", log.LstdFlags),
-			gorm_logger.Config{
-				SlowThreshold:             time.Second,
-				LogLevel:                  gorm_logger.Error,
-				IgnoreRecordNotFoundError: true,
-				Colorful:                  true,
-			},
-		),
+		Logger: gorm_logger.NewSlogLogger(slog.Default(), gorm_logger.Config{
+			SlowThreshold:             time.Second,
+			LogLevel:                  logLevel,
+			IgnoreRecordNotFoundError: true,
+		}),
 	}
 	var err error
 	db, err = gorm.Open(postgres.Open(ConnStr), config)
 	if err != nil {
 		return fmt.Errorf("failed to open db connection: %w", err)
 	}
+	if err := registerDbMetrics(db); err != nil {
+		return fmt.Errorf("failed to register db metrics: %w", err)
+	}
+	if err := db.Use(tracingPlugin{}); err != nil {
+		return fmt.Errorf("failed to register db tracing: %w", err)
+	}
 	return nil
 }
 
+// registerQueryCallbacks registers the callbacks returned by before and after
+// around every kind of query, they are given the name of the operation
+func registerQueryCallbacks(db *gorm.DB, name string, before, after func(operation string) func(*gorm.DB)) error {
+	callback := db.Callback()
+	return errors.Join(
+		callback.Create().Before("gorm:create").Register(name+":before_create", before("create")),
+		callback.Create().After("gorm:create").Register(name+":after_create", after("create")),
+		callback.Query().Before("gorm:query").Register(name+":before_query", before("query")),
+		callback.Query().After("gorm:query").Register(name+":after_query", after("query")),
+		callback.Update().Before("gorm:update").Register(name+":before_update", before("update")),
+		callback.Update().After("gorm:update").Register(name+":after_update", after("update")),
+		callback.Delete().Before("gorm:delete").Register(name+":before_delete", before("delete")),
+		callback.Delete().After("gorm:delete").Register(name+":after_delete", after("delete")),
+		callback.Row().Before("gorm:row").Register(name+":before_row", before("row")),
+		callback.Row().After("gorm:row").Register(name+":after_row", after("row")),
+		callback.Raw().Before("gorm:raw").Register(name+":before_raw", before("raw")),
+		callback.Raw().After("gorm:raw").Register(name+":after_raw", after("raw")),
+	)
+}
+
 func GetDb() *gorm.DB {
 	return db
 }
 
+// PingDb checks that the database is reachable
+func PingDb(ctx context.Context) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CloseDb closes the connection pool, once nothing uses the db anymore
+func CloseDb() error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// GetDbContext returns the db bound to ctx, so that the queries are logged
+// with the request they belong to
+func GetDbContext(ctx context.Context) *gorm.DB {
+	return db.WithContext(ctx)
+}
+
 func GetUserByID(db *gorm.DB, id uint) (*models.User, error) {
 	var user models.User
 	if err := db.First(&user, id).Error; err != nil {
@@ -47,6 +104,14 @@ func GetUserByID(db *gorm.DB, id uint) (*models.User, error) {
 	return &user, nil
 }
 
+// GetQuestionDocument returns the document of a question, even if it has been
+// deleted
+func GetQuestionDocument(db *gorm.DB, questionID uint) (string, error) {
+	var question models.Question
+	err := db.Unscoped().Select("document").First(&question, questionID).Error
+	return question.Document, err
+}
+
 func GetUserByUsername(db *gorm.DB, username string) (*models.User, error) {
 	var user models.User
 	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
@@ -75,13 +140,54 @@ func GetOrCreateUserByID(db *gorm.DB, id uint, username string) (*models.User, e
 		Alias:    alias,
 	}
 
-	if err := db.Create(user).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, &models.AuditEvent{
+			ActorID:    id,
+			Action:     models.AuditActionCreated,
+			TargetType: models.AuditTargetUser,
+			TargetID:   formatID(id),
+			After:      AuditSummary(map[string]string{"username": username, "alias": alias}),
+		})
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
 
+// ChangeAnswerState updates the state of an answer, recording who changed it
+// and why. The reason is stored as the removal or hold reason too, so that the
+// author can see it, and cleared when the answer becomes visible again.
+func ChangeAnswerState(db *gorm.DB, answer *models.Answer, state models.AnswerState, userID uint, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		change := models.AnswerStateChange{
+			AnswerID:  answer.ID,
+			UserID:    userID,
+			FromState: answer.State,
+			ToState:   state,
+			Reason:    reason,
+		}
+		if err := tx.Create(&change).Error; err != nil {
+			return err
+		}
+
+		answer.State = state
+		answer.RemovalReason = ""
+		answer.HoldReason = ""
+		switch state {
+		case models.AnswerStateDeletedByAdmin:
+			answer.RemovalReason = reason
+		case models.AnswerStatePending:
+			answer.HoldReason = reason
+		}
+		return tx.Model(answer).Select("state", "removal_reason", "hold_reason").Updates(answer).Error
+	})
+}
+
 func CreateImage(db *gorm.DB, id string, userID uint, size uint) (*models.Image, error) {
 	image := models.Image{
 		ID:     id,
@@ -95,6 +201,14 @@ func CreateImage(db *gorm.DB, id string, userID uint, size uint) (*models.Image,
 	return &image, nil
 }
 
+func GetImageByID(db *gorm.DB, id string) (*models.Image, error) {
+	var image models.Image
+	if err := db.Where("id = ?", id).First(&image).Error; err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
 func GetTotalSizeOfImagesByUser(db *gorm.DB, userID uint) (uint64, error) {
 	var totalSize uint64
 	err := db.Model(&models.Image{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&totalSize).Error
@@ -113,51 +227,364 @@ func GetNumberOfImagesByUser(db *gorm.DB, userID uint) (int64, error) {
 	return count, nil
 }
 
-func SaveNewReport(db *gorm.DB, answerID uint, cause string, userID uint) error {
+// SaveNewReport stores a report made by userID, or by the system if it is zero
+func SaveNewReport(db *gorm.DB, targetType models.ReportTargetType, targetID string, cause string, userID uint) (*models.Report, error) {
 	report := models.Report{
-		AnswerID: answerID,
-		Cause:    cause,
-		UserID:   userID,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Cause:      cause,
+	}
+	if userID != 0 {
+		report.UserID = &userID
 	}
 	if err := db.Create(&report).Error; err != nil {
-		return err
+		return nil, err
+	}
+	return &report, nil
+}
+
+func GetReportByID(db *gorm.DB, id uint) (*models.Report, error) {
+	var report models.Report
+	if err := db.First(&report, id).Error; err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CloseReportsByTarget deletes every open report about the given target, it
+// is used once a moderation action has been taken on it
+func CloseReportsByTarget(db *gorm.DB, targetType models.ReportTargetType, targetID string) error {
+	return db.Where("target_type = ? AND target_id = ?", targetType, targetID).Delete(&models.Report{}).Error
+}
+
+// MigrateReportTargets moves reports created before polymorphic targets were
+// introduced, which could only reference an answer, to the new target
+// columns. It must run before AutoMigrate, which would otherwise fail to add
+// the non-nullable target columns to a non-empty table.
+func MigrateReportTargets(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Report{}) || !db.Migrator().HasColumn(&models.Report{}, "answer_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("ALTER TABLE reports ADD COLUMN IF NOT EXISTS target_type text, ADD COLUMN IF NOT EXISTS target_id text").Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("UPDATE reports SET target_type = ?, target_id = answer_id::text", models.ReportTargetAnswer).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&models.Report{}, "answer_id")
+	})
+}
+
+// ShadowBannedUsersSubquery selects the IDs of the shadow-banned users
+func ShadowBannedUsersSubquery(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).Model(&models.User{}).Select("id").Where("shadow_banned")
+}
+
+func GetShadowBannedUsers(db *gorm.DB) ([]models.User, error) {
+	var users []models.User
+	if err := db.Where("shadow_banned").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func SetShadowBan(db *gorm.DB, username string, shadowBan bool) error {
+	result := db.Model(&models.User{}).Where("username = ?", username).Update("shadow_banned", shadowBan)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
 	return nil
 }
 
+// GetAllReports returns the open reports, hiding the ones made by
+// shadow-banned users
 func GetAllReports(db *gorm.DB) ([]models.Report, error) {
 	var reports []models.Report
-	if err := db.Find(&reports).Error; err != nil {
+	err := db.Where("user_id IS NULL OR user_id NOT IN (?)", ShadowBannedUsersSubquery(db)).Find(&reports).Error
+	if err != nil {
 		return nil, err
 	}
 	return reports, nil
 }
 
-func GetBannedUsers(db *gorm.DB) ([]models.User, error) {
-	var users []models.User
-	if err := db.Where("banned = ?", true).Find(&users).Error; err != nil {
+var (
+	ErrUserAlreadyBanned = errors.New("user is already banned")
+	ErrUserNotBanned     = errors.New("user is not banned")
+)
+
+// activeBansScope selects the bans that are currently in effect
+func activeBansScope(db *gorm.DB) *gorm.DB {
+	now := time.Now()
+	return db.Where("lifted_at IS NULL AND starts_at <= ? AND (expires_at IS NULL OR expires_at > ?)", now, now)
+}
+
+// GetActiveBan returns the ban currently in effect for the given user, or
+// gorm.ErrRecordNotFound if the user is not banned
+func GetActiveBan(db *gorm.DB, userID uint) (*models.Ban, error) {
+	var ban models.Ban
+	if err := db.Scopes(activeBansScope).Where("user_id = ?", userID).Order("starts_at DESC").First(&ban).Error; err != nil {
 		return nil, err
 	}
-	return users, nil
+	return &ban, nil
 }
 
-func BanUnbanUser(db *gorm.DB, username string, ban bool) error {
-	var user models.User
-	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+func GetActiveBans(db *gorm.DB) ([]models.Ban, error) {
+	var bans []models.Ban
+	if err := db.Scopes(activeBansScope).Order("starts_at DESC").Find(&bans).Error; err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func GetBanHistory(db *gorm.DB, userID uint) ([]models.Ban, error) {
+	var bans []models.Ban
+	if err := db.Where("user_id = ?", userID).Order("starts_at DESC").Find(&bans).Error; err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// BanUser bans a user until expiresAt, or forever if expiresAt is nil
+func BanUser(db *gorm.DB, userID uint, issuedBy uint, reason string, expiresAt *time.Time) (*models.Ban, error) {
+	var ban models.Ban
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := GetActiveBan(tx, userID)
+		if err == nil {
+			return ErrUserAlreadyBanned
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		ban = models.Ban{
+			UserID:    userID,
+			IssuedBy:  issuedBy,
+			Reason:    reason,
+			StartsAt:  time.Now(),
+			ExpiresAt: expiresAt,
+		}
+		return tx.Create(&ban).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+// LiftBan revokes the ban currently in effect for the given user
+func LiftBan(db *gorm.DB, userID uint, liftedBy uint, reason string) error {
+	ban, err := GetActiveBan(db, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotBanned
+	} else if err != nil {
 		return err
 	}
 
-	if ban {
-		now := time.Now()
-		user.Banned = true
-		user.BannedAt = &now
-	} else {
-		user.Banned = false
-		user.BannedAt = nil
+	now := time.Now()
+	ban.LiftedAt = &now
+	ban.LiftedBy = &liftedBy
+	ban.LiftReason = reason
+	return db.Save(ban).Error
+}
+
+func BanUnbanUser(db *gorm.DB, username string, ban bool, adminID uint, reason string, expiresAt *time.Time) error {
+	user, err := GetUserByUsername(db, username)
+	if err != nil {
+		return err
 	}
 
-	if err := db.Save(&user).Error; err != nil {
+	if ban {
+		_, err = BanUser(db, user.ID, adminID, reason, expiresAt)
 		return err
 	}
-	return nil
+	return LiftBan(db, user.ID, adminID, reason)
+}
+
+// MigrateUserBans moves bans stored with the old banned flag on users to the
+// bans table, it must run after AutoMigrate has created the table
+func MigrateUserBans(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.User{}, "banned") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO bans (created_at, updated_at, user_id, issued_by, reason, starts_at)
+			SELECT NOW(), NOW(), id, 0, '', COALESCE(banned_at, updated_at) FROM users WHERE banned`).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Migrator().DropColumn(&models.User{}, "banned"); err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&models.User{}, "banned_at")
+	})
+}
+
+func GetModeratorScopes(db *gorm.DB) ([]models.ModeratorScope, error) {
+	var scopes []models.ModeratorScope
+	if err := db.Order("path_prefix").Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+func GetModeratorScopesByUser(db *gorm.DB, userID uint) ([]models.ModeratorScope, error) {
+	var scopes []models.ModeratorScope
+	if err := db.Where("user_id = ?", userID).Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+// NormalizePathPrefix cleans the path prefix of a moderator scope and strips
+// its trailing slash, an empty result means that the prefix is invalid
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.TrimRight(path.Clean(prefix), "/")
+	if prefix == "." {
+		return ""
+	}
+	return prefix
+}
+
+// ScopeContainsPath reports whether a document path is in the moderator scope
+// of prefix, which covers whole path segments: a/b contains a/b/c but not
+// a/bc
+func ScopeContainsPath(prefix, documentPath string) bool {
+	return documentPath != "" && (documentPath == prefix || strings.HasPrefix(documentPath, prefix+"/"))
+}
+
+// IsScopedModerator reports whether the user has moderator rights on the
+// given document path
+func IsScopedModerator(db *gorm.DB, userID uint, documentPath string) (bool, error) {
+	if documentPath == "" {
+		return false, nil
+	}
+
+	// the same check as ScopeContainsPath
+	var count int64
+	err := db.Model(&models.ModeratorScope{}).
+		Where("user_id = ? AND (path_prefix = ? OR starts_with(?, path_prefix || '/'))", userID, documentPath, documentPath).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// IsUniqueViolation reports whether the error is caused by a unique
+// constraint of the database
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+var (
+	ErrAppealAlreadySubmitted = errors.New("an appeal has already been submitted for this ban")
+	ErrAppealAlreadyReviewed  = errors.New("the appeal has already been reviewed")
+)
+
+// SubmitAppeal creates an appeal against the ban currently in effect for the
+// given user
+func SubmitAppeal(db *gorm.DB, userID uint, message string) (*models.Appeal, error) {
+	ban, err := GetActiveBan(db, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotBanned
+	} else if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := db.Model(&models.Appeal{}).Where("ban_id = ?", ban.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAppealAlreadySubmitted
+	}
+
+	appeal := models.Appeal{
+		BanID:   ban.ID,
+		UserID:  userID,
+		Message: message,
+		Status:  models.AppealStatusPending,
+	}
+	// a concurrent submission may have won the race since the count
+	if err := db.Create(&appeal).Error; IsUniqueViolation(err) {
+		return nil, ErrAppealAlreadySubmitted
+	} else if err != nil {
+		return nil, err
+	}
+	return &appeal, nil
+}
+
+func GetAppeals(db *gorm.DB, status models.AppealStatus) ([]models.Appeal, error) {
+	var appeals []models.Appeal
+	query := db.Order("created_at")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Find(&appeals).Error; err != nil {
+		return nil, err
+	}
+	return appeals, nil
+}
+
+func GetAppealsByUser(db *gorm.DB, userID uint) ([]models.Appeal, error) {
+	var appeals []models.Appeal
+	if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&appeals).Error; err != nil {
+		return nil, err
+	}
+	return appeals, nil
+}
+
+// ReviewAppeal accepts or rejects a pending appeal. Accepting it lifts the
+// ban, if it is still in effect.
+func ReviewAppeal(db *gorm.DB, appealID uint, reviewerID uint, accept bool, reply string) (*models.Appeal, error) {
+	var appeal models.Appeal
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// locked, so that concurrent reviews see each other's decision
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&appeal, appealID).Error; err != nil {
+			return err
+		}
+		if appeal.Status != models.AppealStatusPending {
+			return ErrAppealAlreadyReviewed
+		}
+
+		now := time.Now()
+		appeal.Status = models.AppealStatusRejected
+		if accept {
+			appeal.Status = models.AppealStatusAccepted
+		}
+		appeal.Reply = reply
+		appeal.ReviewedBy = &reviewerID
+		appeal.ReviewedAt = &now
+		if err := tx.Save(&appeal).Error; err != nil {
+			return err
+		}
+
+		if !accept {
+			return nil
+		}
+
+		var ban models.Ban
+		if err := tx.First(&ban, appeal.BanID).Error; err != nil {
+			return err
+		}
+		if !ban.IsActive(now) {
+			return nil
+		}
+		ban.LiftedAt = &now
+		ban.LiftedBy = &reviewerID
+		ban.LiftReason = fmt.Sprintf("appeal accepted: %s", reply)
+		return tx.Save(&ban).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &appeal, nil
 }
@@ -0,0 +1,224 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The exports are JSON lines: a header, followed by a line for each row of
+// the exported tables in the order of exportTables. The images files are not
+// part of the export, images_path is copied separately.
+
+const exportFormat = "polleg-export"
+
+var ErrDatabaseNotEmpty = errors.New("the database is not empty")
+
+type exportHeader struct {
+	Format string `json:"format"`
+	// Schema is the version of the last migration applied to the exported
+	// database, the import requires the same one
+	Schema     uint      `json:"schema"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type exportLine struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+type exportTable interface {
+	name() string
+	// export calls write for each row of the table, the deleted ones too
+	export(db *gorm.DB, write func(row any) error) error
+	decode(data []byte) (any, error)
+	// serial tells whether the table has a serial ID, whose sequence must
+	// be moved past the imported rows
+	serial() bool
+}
+
+type modelTable[T any] struct {
+	table    string
+	order    string
+	isSerial bool
+}
+
+func (t modelTable[T]) name() string {
+	return t.table
+}
+
+func (t modelTable[T]) serial() bool {
+	return t.isSerial
+}
+
+func (t modelTable[T]) export(db *gorm.DB, write func(row any) error) error {
+	rows, err := db.Unscoped().Model(new(T)).Order(t.order).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row T
+		if err := db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		if err := write(&row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (t modelTable[T]) decode(data []byte) (any, error) {
+	var row T
+	if err := json.Unmarshal(data, &row); err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// exportTables are ordered so that the rows referenced by foreign keys are
+// imported first. The job runs are not exported.
+var exportTables = []exportTable{
+	modelTable[models.User]{"users", "id", true},
+	modelTable[models.Proposal]{"proposals", "id", true},
+	modelTable[models.Question]{"questions", "id", true},
+	modelTable[models.Answer]{"answers", "id", true},
+	modelTable[models.AnswerVersion]{"answer_versions", "id", true},
+	modelTable[models.Vote]{"votes", "answer_id, user_id", false},
+	modelTable[models.Image]{"images", "id", false},
+	modelTable[models.Report]{"reports", "id", true},
+	modelTable[models.Ban]{"bans", "id", true},
+	modelTable[models.Warning]{"warnings", "id", true},
+	modelTable[models.AnswerStateChange]{"answer_state_changes", "id", true},
+	modelTable[models.FilterHit]{"filter_hits", "id", true},
+	modelTable[models.ModeratorScope]{"moderator_scopes", "id", true},
+	modelTable[models.Appeal]{"appeals", "id", true},
+	modelTable[models.AuditEvent]{"audit_events", "id", true},
+	modelTable[models.Setting]{"settings", "key, role, user_id", false},
+}
+
+// ExportSummary counts the exported or imported rows by table
+type ExportSummary map[string]int
+
+// Export writes the content of the database to w. It runs in a repeatable
+// read transaction, so that the export is consistent.
+func Export(ctx context.Context, db *gorm.DB, w io.Writer) (ExportSummary, error) {
+	summary := make(ExportSummary)
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY").Error; err != nil {
+			return err
+		}
+		schema, err := GetSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(exportHeader{Format: exportFormat, Schema: schema, ExportedAt: time.Now()}); err != nil {
+			return err
+		}
+
+		for _, table := range exportTables {
+			err := table.export(tx, func(row any) error {
+				data, err := json.Marshal(row)
+				if err != nil {
+					return err
+				}
+				summary[table.name()]++
+				return enc.Encode(exportLine{Table: table.name(), Row: data})
+			})
+			if err != nil {
+				return fmt.Errorf("failed to export %s: %w", table.name(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	return summary, buf.Flush()
+}
+
+// Import loads an export into an empty database, migrated to the same schema
+// version as the exported one. It runs in a single transaction.
+func Import(ctx context.Context, db *gorm.DB, r io.Reader) (ExportSummary, error) {
+	summary := make(ExportSummary)
+	tables := make(map[string]exportTable, len(exportTables))
+	for _, table := range exportTables {
+		tables[table.name()] = table
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return summary, fmt.Errorf("failed to read the export header: %w", err)
+	}
+	if header.Format != exportFormat {
+		return summary, fmt.Errorf("not a polleg export")
+	}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		schema, err := GetSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if schema != header.Schema {
+			return fmt.Errorf("the export has schema version %d, the database %d", header.Schema, schema)
+		}
+		for _, table := range exportTables {
+			var exists bool
+			if err := tx.Raw("SELECT EXISTS (SELECT 1 FROM " + tx.Statement.Quote(table.name()) + ")").Scan(&exists).Error; err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("%w: %s has rows", ErrDatabaseNotEmpty, table.name())
+			}
+		}
+
+		for line := 1; ; line++ {
+			var entry exportLine
+			if err := dec.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("line %d: %w", line+1, err)
+			}
+			table, ok := tables[entry.Table]
+			if !ok {
+				return fmt.Errorf("line %d: unknown table %q", line+1, entry.Table)
+			}
+			row, err := table.decode(entry.Row)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line+1, err)
+			}
+			if err := tx.Table(table.name()).Omit(clause.Associations).Create(row).Error; err != nil {
+				return fmt.Errorf("line %d: %w", line+1, err)
+			}
+			summary[table.name()]++
+		}
+
+		for _, table := range exportTables {
+			if !table.serial() {
+				continue
+			}
+			name := tx.Statement.Quote(table.name())
+			err := tx.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), COALESCE((SELECT MAX(id) FROM "+name+"), 0) + 1, false)",
+				table.name()).Error
+			if err != nil {
+				return fmt.Errorf("failed to reset the sequence of %s: %w", table.name(), err)
+			}
+		}
+		return nil
+	})
+	return summary, err
+}
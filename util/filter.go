@@ -0,0 +1,349 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+type FilterVerdict string
+
+const (
+	FilterVerdictAllow FilterVerdict = "allow"
+	// FilterVerdictFlag publishes the content, but reports it to the admins
+	FilterVerdictFlag FilterVerdict = "flag"
+	// FilterVerdictHold hides the content until an admin reviews it
+	FilterVerdictHold FilterVerdict = "hold"
+	// FilterVerdictReject refuses the content altogether
+	FilterVerdictReject FilterVerdict = "reject"
+)
+
+func (v FilterVerdict) severity() int {
+	switch v {
+	case FilterVerdictFlag:
+		return 1
+	case FilterVerdictHold:
+		return 2
+	case FilterVerdictReject:
+		return 3
+	}
+	return 0
+}
+
+func (v FilterVerdict) validate() error {
+	switch v {
+	case FilterVerdictFlag, FilterVerdictHold, FilterVerdictReject:
+		return nil
+	}
+	return fmt.Errorf("invalid verdict %q, must be one of flag, hold or reject", v)
+}
+
+// BlocklistRule matches words (case insensitive, on word boundaries) and
+// regular expressions
+type BlocklistRule struct {
+	Name     string        `toml:"name"`
+	Words    []string      `toml:"words"`
+	Patterns []string      `toml:"patterns"`
+	Verdict  FilterVerdict `toml:"verdict"`
+
+	compiled []*regexp.Regexp
+}
+
+// LinksRule limits the number of links, and the domains they can point to.
+// An empty AllowedDomains list allows every domain.
+type LinksRule struct {
+	Max            int           `toml:"max"`
+	AllowedDomains []string      `toml:"allowed_domains"`
+	Verdict        FilterVerdict `toml:"verdict"`
+}
+
+// RepeatedCharsRule matches content with more than Max consecutive
+// occurrences of the same character
+type RepeatedCharsRule struct {
+	Max     int           `toml:"max"`
+	Verdict FilterVerdict `toml:"verdict"`
+}
+
+// CapsRule matches content with at least MinLength letters, of which more
+// than MaxRatio are uppercase
+type CapsRule struct {
+	MinLength int           `toml:"min_length"`
+	MaxRatio  float64       `toml:"max_ratio"`
+	Verdict   FilterVerdict `toml:"verdict"`
+}
+
+type LengthRule struct {
+	Max     int           `toml:"max"`
+	Verdict FilterVerdict `toml:"verdict"`
+}
+
+type ContentFilterConfig struct {
+	Blocklists    []BlocklistRule    `toml:"blocklist"`
+	Links         *LinksRule         `toml:"links"`
+	RepeatedChars *RepeatedCharsRule `toml:"repeated_chars"`
+	Caps          *CapsRule          `toml:"caps"`
+	Length        *LengthRule        `toml:"length"`
+}
+
+// compile validates the config and compiles the blocklists
+func (c *ContentFilterConfig) compile() error {
+	for i := range c.Blocklists {
+		rule := &c.Blocklists[i]
+		if err := rule.Verdict.validate(); err != nil {
+			return fmt.Errorf("blocklist %q: %w", rule.Name, err)
+		}
+
+		for _, word := range rule.Words {
+			rule.compiled = append(rule.compiled, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(word)+`\b`))
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("blocklist %q: invalid pattern %q: %w", rule.Name, pattern, err)
+			}
+			rule.compiled = append(rule.compiled, re)
+		}
+	}
+
+	verdicts := map[string]*FilterVerdict{}
+	if c.Links != nil {
+		verdicts["links"] = &c.Links.Verdict
+	}
+	if c.RepeatedChars != nil {
+		verdicts["repeated_chars"] = &c.RepeatedChars.Verdict
+	}
+	if c.Caps != nil {
+		verdicts["caps"] = &c.Caps.Verdict
+	}
+	if c.Length != nil {
+		verdicts["length"] = &c.Length.Verdict
+	}
+	for name, verdict := range verdicts {
+		if err := verdict.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+type FilterHit struct {
+	Rule    string        `json:"rule"`
+	Verdict FilterVerdict `json:"verdict"`
+	Detail  string        `json:"detail"`
+}
+
+type FilterResult struct {
+	// Verdict is the most severe verdict among the hits
+	Verdict FilterVerdict
+	Hits    []FilterHit
+}
+
+func (r *FilterResult) add(hit FilterHit) {
+	r.Hits = append(r.Hits, hit)
+	if hit.Verdict.severity() > r.Verdict.severity() {
+		r.Verdict = hit.Verdict
+	}
+}
+
+// Rules returns the names of the rules which matched, comma separated
+func (r *FilterResult) Rules() string {
+	names := make([]string, 0, len(r.Hits))
+	for _, hit := range r.Hits {
+		names = append(names, hit.Rule)
+	}
+	return strings.Join(names, ", ")
+}
+
+var linkRegex = regexp.MustCompile(`https?://[^\s)\]>"']+`)
+
+// Check runs every rule against the content
+func (c *ContentFilterConfig) Check(content string) FilterResult {
+	result := FilterResult{Verdict: FilterVerdictAllow}
+
+	if c.Length != nil && c.Length.Max > 0 {
+		if length := len([]rune(content)); length > c.Length.Max {
+			result.add(FilterHit{"length", c.Length.Verdict, fmt.Sprintf("%d characters", length)})
+		}
+	}
+
+	for _, rule := range c.Blocklists {
+		for _, re := range rule.compiled {
+			if match := re.FindString(content); match != "" {
+				result.add(FilterHit{rule.Name, rule.Verdict, match})
+				break
+			}
+		}
+	}
+
+	if c.Links != nil {
+		links := linkRegex.FindAllString(content, -1)
+		if c.Links.Max > 0 && len(links) > c.Links.Max {
+			result.add(FilterHit{"links", c.Links.Verdict, fmt.Sprintf("%d links", len(links))})
+		}
+		if len(c.Links.AllowedDomains) > 0 {
+			for _, link := range links {
+				if u, err := url.Parse(link); err != nil || !isAllowedDomain(u.Hostname(), c.Links.AllowedDomains) {
+					result.add(FilterHit{"links", c.Links.Verdict, link})
+					break
+				}
+			}
+		}
+	}
+
+	if c.RepeatedChars != nil && c.RepeatedChars.Max > 0 {
+		if char, n := longestRun(content); n > c.RepeatedChars.Max {
+			result.add(FilterHit{"repeated_chars", c.RepeatedChars.Verdict, strings.Repeat(string(char), n)})
+		}
+	}
+
+	if c.Caps != nil && c.Caps.MaxRatio > 0 {
+		letters, upper := 0, 0
+		for _, r := range content {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		if letters > 0 && letters >= c.Caps.MinLength && float64(upper)/float64(letters) > c.Caps.MaxRatio {
+			result.add(FilterHit{"caps", c.Caps.Verdict, fmt.Sprintf("%d of %d letters are uppercase", upper, letters)})
+		}
+	}
+
+	return result
+}
+
+func isAllowedDomain(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range allowed {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// longestRun returns the character repeated the most times in a row, ignoring
+// whitespace, and the length of the run
+func longestRun(content string) (rune, int) {
+	var best, current rune
+	bestN, currentN := 0, 0
+	for _, r := range content {
+		if r == current {
+			currentN++
+		} else {
+			current, currentN = r, 1
+		}
+		if currentN > bestN && !unicode.IsSpace(r) {
+			best, bestN = current, currentN
+		}
+	}
+	return best, bestN
+}
+
+// ContentFilter holds the rules loaded from a file, reloading them whenever
+// the file changes
+type ContentFilter struct {
+	path string
+
+	mu      sync.RWMutex
+	config  *ContentFilterConfig
+	modTime time.Time
+}
+
+var contentFilter = &ContentFilter{config: &ContentFilterConfig{}}
+
+func GetContentFilter() *ContentFilter {
+	return contentFilter
+}
+
+// LoadContentFilter reads the rules from path and makes them the ones used
+// by GetContentFilter
+func LoadContentFilter(path string) (*ContentFilter, error) {
+	filter := &ContentFilter{path: path}
+	if err := filter.reload(); err != nil {
+		return nil, err
+	}
+	contentFilter = filter
+	return filter, nil
+}
+
+func (f *ContentFilter) reload() error {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat content filter file: %w", err)
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open content filter file: %w", err)
+	}
+	defer file.Close()
+
+	var config ContentFilterConfig
+	if err := toml.NewDecoder(file).DisallowUnknownFields().Decode(&config); err != nil {
+		return fmt.Errorf("failed to decode content filter file: %w", err)
+	}
+	if err := config.compile(); err != nil {
+		return fmt.Errorf("invalid content filter: %w", err)
+	}
+
+	f.mu.Lock()
+	f.config = &config
+	f.modTime = stat.ModTime()
+	f.mu.Unlock()
+	return nil
+}
+
+// Watch checks the rules file for changes every interval, and reloads it.
+// Invalid rules are logged and the previous ones are kept.
+func (f *ContentFilter) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stat, err := os.Stat(f.path)
+		if err != nil {
+			slog.With("path", f.path, "err", err).Error("could not stat content filter file")
+			continue
+		}
+
+		f.mu.RLock()
+		changed := !stat.ModTime().Equal(f.modTime)
+		f.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := f.reload(); err != nil {
+			slog.With("path", f.path, "err", err).Error("could not reload content filter, keeping the previous rules")
+			continue
+		}
+		slog.With("path", f.path).Info("reloaded content filter")
+	}
+}
+
+func (f *ContentFilter) Check(content string) FilterResult {
+	f.mu.RLock()
+	config := f.config
+	f.mu.RUnlock()
+	return config.Check(content)
+}
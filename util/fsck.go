@@ -0,0 +1,223 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// The images are saved to images_path before their record is created, and
+// their records are removed after their files, so a crash in between leaves
+// the two out of sync. The consistency checker compares them and reports:
+//   - orphan files, which have no record or whose image was deleted
+//   - dangling records, of images which are not deleted but have no file
+//   - size mismatches, between the file and the size in its record
+//
+// Quarantined images still have their file, so they are checked like the
+// images in use.
+
+// FsckConfig configures the consistency checker, its schedule is the one of
+// the fsck job
+type FsckConfig struct {
+	// Repair removes the orphan files and deletes the dangling records
+	Repair bool `toml:"repair"`
+	// MinFileAge is how old a file without a record must be to be an
+	// orphan, so that the uploads in progress are left alone
+	MinFileAge Duration `toml:"min_file_age"`
+}
+
+func (c FsckConfig) Validate() error {
+	if c.MinFileAge < 0 {
+		return configErrorf("min_file_age", "must not be negative")
+	}
+	return nil
+}
+
+const FsckJobName = "fsck"
+
+type FsckIssue struct {
+	ID       string `json:"id"`
+	Reason   string `json:"reason"`
+	Repaired bool   `json:"repaired"`
+}
+
+// FsckReport lists the inconsistencies found by the consistency checker
+type FsckReport struct {
+	Repair bool `json:"repair"`
+	// Files and Records are the number of files and records checked
+	Files           int         `json:"files"`
+	Records         int         `json:"records"`
+	OrphanFiles     []FsckIssue `json:"orphan_files"`
+	DanglingRecords []FsckIssue `json:"dangling_records"`
+	SizeMismatches  []FsckIssue `json:"size_mismatches"`
+	Errors          []string    `json:"errors"`
+}
+
+// Unrepaired returns the number of inconsistencies which are still there
+func (r *FsckReport) Unrepaired() int {
+	n := len(r.SizeMismatches)
+	for _, issues := range [][]FsckIssue{r.OrphanFiles, r.DanglingRecords} {
+		for _, issue := range issues {
+			if !issue.Repaired {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// FsckJob is the job checking the consistency of the images storage
+func FsckJob(imagesPath string, config FsckConfig) JobFunc {
+	return func(ctx context.Context) (any, error) {
+		report, err := CheckImages(ctx, imagesPath, config)
+		if err != nil {
+			return report, err
+		}
+		slog.With("repair", report.Repair, "orphan_files", len(report.OrphanFiles), "dangling_records", len(report.DanglingRecords),
+			"size_mismatches", len(report.SizeMismatches), "errors", len(report.Errors)).Info("images consistency check completed")
+		return report, nil
+	}
+}
+
+// CheckImages compares the files in imagesPath with the images table, and
+// repairs the orphan files and dangling records if config.Repair is set.
+// Failures on single images are listed in the report.
+func CheckImages(ctx context.Context, imagesPath string, config FsckConfig) (*FsckReport, error) {
+	now := time.Now()
+	db := GetDbContext(ctx)
+	report := &FsckReport{
+		Repair:          config.Repair,
+		OrphanFiles:     []FsckIssue{},
+		DanglingRecords: []FsckIssue{},
+		SizeMismatches:  []FsckIssue{},
+		Errors:          []string{},
+	}
+
+	var images []models.Image
+	err := db.Unscoped().Select("id", "size", "deleted_at", "quarantined_at").Find(&images).Error
+	if err != nil {
+		return report, err
+	}
+	records := make(map[string]*models.Image, len(images))
+	for i := range images {
+		records[images[i].ID] = &images[i]
+	}
+	// hasFile tells whether the image of a record is supposed to have a file
+	hasFile := func(img *models.Image) bool {
+		return !img.DeletedAt.Valid || img.QuarantinedAt != nil
+	}
+
+	entries, err := os.ReadDir(imagesPath)
+	if err != nil {
+		return report, err
+	}
+
+	// repairs are not interrupted halfway
+	repairDb := db.WithContext(context.WithoutCancel(ctx))
+	fail := func(id string, what string, err error) {
+		slog.With("image", id, "err", err).Error("error while " + what)
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %s: %v", id, what, err))
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		// hidden files are temporary, such as the ones of the readiness probe
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			fail(entry.Name(), "reading file info", err)
+			continue
+		}
+		report.Files++
+
+		id := entry.Name()
+		img, ok := records[id]
+		if ok && hasFile(img) {
+			seen[id] = true
+			if uint64(info.Size()) != uint64(img.Size) {
+				report.SizeMismatches = append(report.SizeMismatches, FsckIssue{ID: id,
+					Reason: fmt.Sprintf("the file has %d bytes, its record %d", info.Size(), img.Size)})
+			}
+			continue
+		}
+		if now.Sub(info.ModTime()) < time.Duration(config.MinFileAge) {
+			continue
+		}
+
+		issue := FsckIssue{ID: id, Reason: "no image record"}
+		if ok {
+			issue.Reason = fmt.Sprintf("the image was deleted at %s", img.DeletedAt.Time.Format(time.RFC3339))
+		}
+		if config.Repair {
+			if err := RemoveImageFile(repairDb.Statement.Context, imagesPath, id); err != nil {
+				fail(id, "removing orphan file", err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		report.OrphanFiles = append(report.OrphanFiles, issue)
+	}
+
+	for i := range images {
+		img := &images[i]
+		if !hasFile(img) {
+			continue
+		}
+		report.Records++
+		if seen[img.ID] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		issue := FsckIssue{ID: img.ID, Reason: "the file is missing"}
+		if config.Repair {
+			if err := tombstoneImage(repairDb, img, now); err != nil {
+				fail(img.ID, "deleting dangling record", err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		report.DanglingRecords = append(report.DanglingRecords, issue)
+	}
+
+	fsckIssues.WithLabelValues("orphan_file").Set(float64(len(report.OrphanFiles)))
+	fsckIssues.WithLabelValues("dangling_record").Set(float64(len(report.DanglingRecords)))
+	fsckIssues.WithLabelValues("size_mismatch").Set(float64(len(report.SizeMismatches)))
+	return report, nil
+}
+
+// tombstoneImage soft-deletes the record of an image whose file is missing,
+// like the images deleted by the moderators. It is taken out of the
+// quarantine, so that the garbage collector doesn't restore it.
+func tombstoneImage(db *gorm.DB, img *models.Image, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(img).Updates(map[string]any{
+			"quarantined_at": nil,
+			"deleted_at":     gorm.Expr("COALESCE(deleted_at, ?)", now),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, &models.AuditEvent{
+			Action:     models.AuditActionDeleted,
+			TargetType: models.AuditTargetImage,
+			TargetID:   img.ID,
+			Before:     AuditSummary(map[string]any{"size": img.Size, "reason": "file missing"}),
+		})
+	})
+}
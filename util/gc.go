@@ -1,73 +1,277 @@
 package util
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
-	"os"
-	"path/filepath"
 	"regexp"
-	"slices"
 	"time"
 
 	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
 )
 
 // Images are uploaded before being posted in a answer, so we could end
-// up with unused images. This garbage collector removes images that are in the
-// database for more than 24 hours but not attached to any question. To check
+// up with unused images. This garbage collector quarantines the images that
+// are in the database for more than the grace period but not attached to any
+// answer, by soft-deleting them. Their files are removed once the quarantine
+// is over, unless an answer starts using them again in the meantime. To check
 // if an image is attached to a answer, we check if its URL is present in
-// the Content field of any answer.
+// the Content field of the latest version of any answer.
 
-func GarbageCollector(imagesPath string) {
-	slog.Info("starting garbage collector")
-	ticker := time.NewTicker(24 * time.Hour)
+// GarbageCollectorConfig configures the garbage collector, its schedule is
+// the one of the garbage_collector job
+type GarbageCollectorConfig struct {
+	// GracePeriod is how long an image can be unused after its upload
+	GracePeriod Duration `toml:"grace_period"`
+	// QuarantinePeriod is how long unused images are soft-deleted before
+	// their files are removed, zero removes them right away
+	QuarantinePeriod Duration `toml:"quarantine_period"`
+	// BatchSize is the number of images loaded at a time
+	BatchSize int `toml:"batch_size"`
+	// DryRun only reports what would be done
+	DryRun bool `toml:"dry_run"`
+}
 
-	for range ticker.C {
-		slog.Info("running garbage collector")
-		if err := cleanUnusedImages(imagesPath); err != nil {
-			slog.With("err", err).Error("error while cleaning unused images")
-		}
+func (c GarbageCollectorConfig) Validate() error {
+	var errs []error
+	if c.GracePeriod < 0 {
+		errs = append(errs, configErrorf("grace_period", "must not be negative"))
+	}
+	if c.QuarantinePeriod < 0 {
+		errs = append(errs, configErrorf("quarantine_period", "must not be negative"))
 	}
+	if c.BatchSize <= 0 {
+		errs = append(errs, configErrorf("batch_size", "must be positive"))
+	}
+	return errors.Join(errs...)
 }
 
-func cleanUnusedImages(imagesPath string) error {
-	cutoff := time.Now().Add(-24 * time.Hour)
-	db := GetDb()
+const GarbageCollectorJobName = "garbage_collector"
 
-	var oldImages []models.Image
-	if err := db.Where("created_at < ?", cutoff).Find(&oldImages).Error; err != nil {
-		return err
+type GCImage struct {
+	ID        string    `json:"id"`
+	UserID    uint      `json:"user_id"`
+	Size      uint      `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+}
+
+// GCReport lists what the garbage collector did, or would do in a dry run
+type GCReport struct {
+	DryRun           bool   `json:"dry_run"`
+	GracePeriod      string `json:"grace_period"`
+	QuarantinePeriod string `json:"quarantine_period"`
+	// Scanned is the number of images past the grace period
+	Scanned     int       `json:"scanned"`
+	Quarantined []GCImage `json:"quarantined"`
+	Restored    []GCImage `json:"restored"`
+	Purged      []GCImage `json:"purged"`
+	Errors      []string  `json:"errors"`
+}
+
+func newGCImage(img *models.Image, reason string) GCImage {
+	return GCImage{ID: img.ID, UserID: img.UserID, Size: img.Size, CreatedAt: img.CreatedAt, Reason: reason}
+}
+
+// GarbageCollectorJob is the job collecting the unused images
+func GarbageCollectorJob(imagesPath string, config GarbageCollectorConfig) JobFunc {
+	return func(ctx context.Context) (any, error) {
+		start := time.Now()
+		report, err := CollectGarbage(ctx, imagesPath, config)
+		gcLastRun.SetToCurrentTime()
+		gcLastDuration.Set(time.Since(start).Seconds())
+		// nothing is deleted by a dry run
+		if report != nil && !report.DryRun {
+			gcDeletedImages.Add(float64(len(report.Purged)))
+		}
+		if err != nil {
+			gcRuns.WithLabelValues("error").Inc()
+			return report, err
+		}
+		gcRuns.WithLabelValues("success").Inc()
+		slog.With("dry_run", report.DryRun, "quarantined", len(report.Quarantined), "restored", len(report.Restored),
+			"purged", len(report.Purged), "errors", len(report.Errors)).Info("garbage collector completed")
+		return report, nil
 	}
+}
 
+// imageReferenceRegex matches the images embedded in the answers, capturing
+// their ID
+var imageReferenceRegex = regexp.MustCompile(`!\[[^\]]*\]\(\s*https://[^\s)]+/images/([0-9a-fA-F-]{36})`)
+
+// referencedImages returns the IDs of the images used by the latest version
+// of any answer
+func referencedImages(db *gorm.DB) (map[string]bool, error) {
 	var answersContent []string
 	err := db.Table("answer_versions av1").
 		Select("av1.content").
 		Joins("INNER JOIN (SELECT answer_id, MAX(id) as max_id FROM answer_versions GROUP BY answer_id) av2 ON av1.answer_id = av2.answer_id AND av1.id = av2.max_id").
 		Pluck("content", &answersContent).Error
+	if err != nil {
+		return nil, err
+	}
 
+	referenced := make(map[string]bool)
+	for _, content := range answersContent {
+		for _, match := range imageReferenceRegex.FindAllStringSubmatch(content, -1) {
+			referenced[match[1]] = true
+		}
+	}
+	return referenced, nil
+}
+
+// CollectGarbage quarantines the unused images, then restores the
+// quarantined images which are used again and purges the ones whose
+// quarantine is over. Failures on single images are listed in the report, it
+// stops between two images when ctx is done.
+func CollectGarbage(ctx context.Context, imagesPath string, config GarbageCollectorConfig) (*GCReport, error) {
+	now := time.Now()
+	db := GetDbContext(ctx)
+	report := &GCReport{
+		DryRun:           config.DryRun,
+		GracePeriod:      time.Duration(config.GracePeriod).String(),
+		QuarantinePeriod: time.Duration(config.QuarantinePeriod).String(),
+		Quarantined:      []GCImage{},
+		Restored:         []GCImage{},
+		Purged:           []GCImage{},
+		Errors:           []string{},
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	referenced, err := referencedImages(db)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	for _, img := range oldImages {
-		// Maybe this regex is too much, we'll see
-		containsRegex := regexp.MustCompile(`\!\[.*\]\(\s*https:\/\/[^\s]+\/images\/` + img.ID + `.*\)`)
+	// the changes to an image are not interrupted halfway, so that its
+	// record doesn't outlive the file
+	imgDb := db.WithContext(context.WithoutCancel(ctx))
+	fail := func(img *models.Image, what string, err error) {
+		slog.With("image", img.ID, "err", err).Error("error while " + what)
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %s: %v", img.ID, what, err))
+	}
+
+	cutoff := now.Add(-time.Duration(config.GracePeriod))
+	var batch []models.Image
+	err = db.Where("created_at < ?", cutoff).FindInBatches(&batch, batchSize, func(_ *gorm.DB, _ int) error {
+		for _, img := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			report.Scanned++
+			if referenced[img.ID] {
+				continue
+			}
 
-		if slices.ContainsFunc(answersContent, func(content string) bool {
-			return containsRegex.MatchString(content)
-		}) {
-			continue
+			report.Quarantined = append(report.Quarantined, newGCImage(&img,
+				fmt.Sprintf("not used by any answer %s after its upload", report.GracePeriod)))
+			if config.DryRun {
+				continue
+			}
+			if err := quarantineImage(imgDb, &img, now); err != nil {
+				fail(&img, "quarantining unused image", err)
+			}
 		}
+		return nil
+	}).Error
+	if err != nil {
+		return report, err
+	}
+
+	quarantineCutoff := now.Add(-time.Duration(config.QuarantinePeriod))
+	err = db.Unscoped().Where("quarantined_at IS NOT NULL").FindInBatches(&batch, batchSize, func(_ *gorm.DB, _ int) error {
+		for _, img := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			switch {
+			case referenced[img.ID]:
+				report.Restored = append(report.Restored, newGCImage(&img, "used again by an answer during the quarantine"))
+				if config.DryRun {
+					continue
+				}
+				if err := restoreImage(imgDb, &img); err != nil {
+					fail(&img, "restoring quarantined image", err)
+				}
+			case !img.QuarantinedAt.After(quarantineCutoff):
+				report.Purged = append(report.Purged, newGCImage(&img,
+					fmt.Sprintf("quarantined since %s", img.QuarantinedAt.Format(time.RFC3339))))
+				if config.DryRun {
+					continue
+				}
+				if err := purgeImage(imgDb, imagesPath, &img); err != nil {
+					fail(&img, "purging quarantined image", err)
+				}
+			}
+		}
+		return nil
+	}).Error
+	return report, err
+}
 
-		err := os.Remove(filepath.Join(imagesPath, img.ID))
-		if err != nil && !os.IsNotExist(err) {
-			slog.With("image", img, "err", err).Error("error while deleting unused image file")
+// quarantineImage soft-deletes an unused image
+func quarantineImage(db *gorm.DB, img *models.Image, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(img).Update("quarantined_at", now).Error; err != nil {
+			return err
 		}
-		if err := db.Delete(&img).Error; err != nil {
-			slog.With("image", img, "err", err).Error("error while deleting unused image")
-			continue
+		if err := tx.Delete(img).Error; err != nil {
+			return err
 		}
-		slog.With("image", img).Info("deleted unused image")
+		return RecordAuditEvent(tx, &models.AuditEvent{
+			Action:     models.AuditActionDeleted,
+			TargetType: models.AuditTargetImage,
+			TargetID:   img.ID,
+			Before:     AuditSummary(map[string]any{"user_id": img.UserID, "size": img.Size, "reason": "unused"}),
+		})
+	})
+}
+
+// restoreImage undoes the quarantine of an image
+func restoreImage(db *gorm.DB, img *models.Image) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(img).Updates(map[string]any{"quarantined_at": nil, "deleted_at": nil}).Error
+		if err != nil {
+			return err
+		}
+		return RecordAuditEvent(tx, &models.AuditEvent{
+			Action:     models.AuditActionRestored,
+			TargetType: models.AuditTargetImage,
+			TargetID:   img.ID,
+			After:      AuditSummary(map[string]any{"user_id": img.UserID, "size": img.Size, "reason": "used again"}),
+		})
+	})
+}
+
+// purgeImage removes the file of a quarantined image and its record
+func purgeImage(db *gorm.DB, imagesPath string, img *models.Image) error {
+	if err := RemoveImageFile(db.Statement.Context, imagesPath, img.ID); err != nil {
+		return err
 	}
+	return db.Unscoped().Delete(img).Error
+}
 
-	return nil
+// GetLastGCReport returns the report of the last run of the garbage collector
+// which produced one, or nil if there is none
+func GetLastGCReport(db *gorm.DB) (*models.JobRun, *GCReport, error) {
+	var run models.JobRun
+	err := db.Where("job = ? AND report <> ''", GarbageCollectorJobName).Order("started_at DESC").Take(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var report GCReport
+	if err := json.Unmarshal([]byte(run.Report), &report); err != nil {
+		return nil, nil, err
+	}
+	return &run, &report, nil
 }
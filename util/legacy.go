@@ -0,0 +1,264 @@
+package util
+
+import (
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// The models as they were when the initial migration was written. The
+// databases created by AutoMigrate are brought to the schema of the initial
+// migration by running AutoMigrate with them, the later changes to the models
+// are applied by the migrations which follow. They must not be changed.
+
+type legacyAnswer struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	Question uint `gorm:"foreignKey:Question;references:ID"`
+	Parent   *uint
+
+	UserId        uint
+	Upvotes       uint32         `gorm:"->"`
+	Downvotes     uint32         `gorm:"->"`
+	Replies       []legacyAnswer `gorm:"foreignKey:Parent;references:ID"`
+	Votes         []legacyVote   `gorm:"foreignKey:AnswerID;references:ID"`
+	Anonymous     bool
+	State         models.AnswerState
+	RemovalReason string
+	HoldReason    string
+}
+
+func (legacyAnswer) TableName() string { return "answers" }
+
+type legacyAnswerVersion struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	AnswerID uint `gorm:"foreignKey:Answer;references:ID;index;not null"`
+	Content  string
+}
+
+func (legacyAnswerVersion) TableName() string { return "answer_versions" }
+
+type legacyAnswerStateChange struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	AnswerID  uint `gorm:"index; not null;"`
+	UserID    uint `gorm:"not null;"`
+	FromState models.AnswerState
+	ToState   models.AnswerState
+	Reason    string
+}
+
+func (legacyAnswerStateChange) TableName() string { return "answer_state_changes" }
+
+type legacyQuestion struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	Document     string
+	DocumentPath string
+	Start        uint32
+	End          uint32
+	Answers      []legacyAnswer `gorm:"foreignKey:Question;references:ID"`
+
+	UserID uint `gorm:"index; not null;"`
+}
+
+func (legacyQuestion) TableName() string { return "questions" }
+
+type legacyVote struct {
+	AnswerID uint `gorm:"primaryKey"`
+	UserId   uint `gorm:"primaryKey"`
+	Vote     int8
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (legacyVote) TableName() string { return "votes" }
+
+type legacyUser struct {
+	ID       uint `gorm:"primarykey"`
+	Username string
+	Alias    string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	ShadowBanned bool `gorm:"default:false"`
+
+	Questions []legacyQuestion `gorm:"foreignKey:UserID;references:ID"`
+	Proposals []legacyProposal `gorm:"foreignKey:UserID;references:ID"`
+	Reports   []legacyReport   `gorm:"foreignKey:UserID;references:ID"`
+	Bans      []legacyBan      `gorm:"foreignKey:UserID;references:ID"`
+	Warnings  []legacyWarning  `gorm:"foreignKey:UserID;references:ID"`
+}
+
+func (legacyUser) TableName() string { return "users" }
+
+type legacyBan struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID     uint `gorm:"index; not null;"`
+	IssuedBy   uint `gorm:"not null;"`
+	Reason     string
+	StartsAt   time.Time `gorm:"not null;"`
+	ExpiresAt  *time.Time
+	LiftedAt   *time.Time
+	LiftedBy   *uint
+	LiftReason string
+}
+
+func (legacyBan) TableName() string { return "bans" }
+
+type legacyImage struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt
+
+	UserID        uint       `gorm:"index; not null; foreignKey:User; references:ID"`
+	Size          uint       `gorm:"not null"`
+	QuarantinedAt *time.Time `gorm:"index"`
+}
+
+func (legacyImage) TableName() string { return "images" }
+
+type legacyProposal struct {
+	ID        uint64 `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	DocumentID   string
+	DocumentPath string
+	Start        uint32
+	End          uint32
+
+	UserID uint `gorm:"index; not null;"`
+}
+
+func (legacyProposal) TableName() string { return "proposals" }
+
+type legacyReport struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	TargetType models.ReportTargetType `gorm:"index:idx_report_target; not null;"`
+	TargetID   string                  `gorm:"index:idx_report_target; not null;"`
+	Cause      string
+	UserID     uint `gorm:"index; not null;"`
+}
+
+func (legacyReport) TableName() string { return "reports" }
+
+type legacyWarning struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	UserID    uint `gorm:"index; not null;"`
+	IssuedBy  uint `gorm:"not null;"`
+	Reason    string
+	AnswerID  *uint
+	ReportID  *uint
+	ExpiresAt time.Time `gorm:"index; not null;"`
+}
+
+func (legacyWarning) TableName() string { return "warnings" }
+
+type legacyFilterHit struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID   uint `gorm:"index; not null;"`
+	AnswerID *uint
+	Verdict  string
+	Rules    string
+	Details  string
+}
+
+func (legacyFilterHit) TableName() string { return "filter_hits" }
+
+type legacyModeratorScope struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	UserID     uint   `gorm:"index; not null;"`
+	PathPrefix string `gorm:"not null;"`
+	GrantedBy  uint   `gorm:"not null;"`
+}
+
+func (legacyModeratorScope) TableName() string { return "moderator_scopes" }
+
+type legacyAppeal struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	BanID      uint `gorm:"uniqueIndex; not null;"`
+	UserID     uint `gorm:"index; not null;"`
+	Message    string
+	Status     models.AppealStatus `gorm:"index; not null; default:pending"`
+	Reply      string
+	ReviewedBy *uint
+	ReviewedAt *time.Time
+}
+
+func (legacyAppeal) TableName() string { return "appeals" }
+
+type legacyAuditEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	ActorID    uint                   `gorm:"index; not null;"`
+	Action     models.AuditAction     `gorm:"index; not null;"`
+	TargetType models.AuditTargetType `gorm:"index:idx_audit_events_target; not null;"`
+	TargetID   string                 `gorm:"index:idx_audit_events_target; not null;"`
+	Before     string
+	After      string
+	RequestID  string `gorm:"index"`
+	PrevHash   string
+	Hash       string `gorm:"index"`
+}
+
+func (legacyAuditEvent) TableName() string { return "audit_events" }
+
+type legacyJobRun struct {
+	ID        uint      `gorm:"primarykey"`
+	StartedAt time.Time `gorm:"index"`
+
+	Job         string            `gorm:"index; not null;"`
+	Trigger     models.JobTrigger `gorm:"not null;"`
+	TriggeredBy *uint
+	Host        string
+	FinishedAt  *time.Time
+	Duration    time.Duration
+	Outcome     models.JobOutcome `gorm:"index; not null;"`
+	Error       string
+	Report      string
+}
+
+func (legacyJobRun) TableName() string { return "job_runs" }
+
+// legacyModels are the models which AutoMigrate managed before the versioned
+// migrations, their schema is the one of the initial migration
+var legacyModels = []any{&legacyUser{}, &legacyProposal{}, &legacyQuestion{}, &legacyAnswer{}, &legacyVote{}, &legacyImage{},
+	&legacyAnswerVersion{}, &legacyReport{}, &legacyBan{}, &legacyWarning{}, &legacyAnswerStateChange{}, &legacyFilterHit{},
+	&legacyModeratorScope{}, &legacyAppeal{}, &legacyAuditEvent{}, &legacyJobRun{}}
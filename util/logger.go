@@ -1,19 +1,223 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/kataras/muxie"
-	"golang.org/x/exp/slog"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// wrapper that records the status code
+// RequestIDHeader carries the ID of the request. It is taken from the reverse
+// proxy when present, and echoed in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// LogConfig configures the output of the logs and how the client IP is
+// resolved
+type LogConfig struct {
+	// Format is either "text" or "json"
+	Format string `toml:"format"`
+	// Level is one of "debug", "info", "warn" or "error"
+	Level string `toml:"level"`
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies
+	// whose X-Forwarded-For header is trusted
+	TrustedProxies []string `toml:"trusted_proxies"`
+}
+
+var trustedProxies []netip.Prefix
+
+// Validate checks the log config, SetupLogger fails on the same errors
+func (c LogConfig) Validate() error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		errs = append(errs, configErrorf("level", "must be one of debug, info, warn or error"))
+	}
+	if c.Format != "text" && c.Format != "json" {
+		errs = append(errs, configErrorf("format", "must be either text or json"))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, &ConfigError{Key: "trusted_proxies", Err: err})
+	}
+	return errors.Join(errs...)
+}
+
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// SetupLogger replaces the default logger with one following the config,
+// which adds the request ID to the records logged with a request context
+func SetupLogger(config LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q", config.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch config.Format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", config.Format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = proxies
+
+	return nil
+}
+
+// contextHandler adds the request ID and the trace found in the context to
+// the records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestInfo is shared between the logger middleware and the ones after it,
+// which fill in what is known only once the request has been authenticated
+type requestInfo struct {
+	id     string
+	userID *uint
+}
+
+type requestInfoKey struct{}
+
+// RequestIDFromContext returns the ID of the request the context belongs to,
+// or an empty string outside of a request
+func RequestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// SetRequestUser records the authenticated user in the request log and span
+func SetRequestUser(ctx context.Context, userID uint, role string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = &userID
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		semconv.EnduserID(strconv.FormatUint(uint64(userID), 10)),
+		attribute.String("enduser.role", role),
+	)
+}
+
+// validRequestID accepts the IDs generated by the common reverse proxies,
+// rejecting anything which could be used to forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only
+// followed through the trusted proxies, starting from the closest one.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+// wrapper that records the status code and the size of the response
 type MuxieStatusRecorder struct {
 	*muxie.Writer
 	StatusCode int
+	Size       int
 }
 
 func NewMuxieStatusRecorder(w http.ResponseWriter) *MuxieStatusRecorder {
+	// the recorder is shared by the middlewares wrapping each other
+	if rec, ok := w.(*MuxieStatusRecorder); ok {
+		return rec
+	}
 	rec := &MuxieStatusRecorder{
 		Writer: w.(*muxie.Writer),
 	}
@@ -32,15 +236,21 @@ func (r *MuxieStatusRecorder) Write(b []byte) (int, error) {
 		r.StatusCode = http.StatusOK
 	}
 	n, err := r.ResponseWriter.Write(b)
+	r.Size += n
 	return n, err
 }
 
 func NewLoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.Header.Get("X-Forwarded-For")
-		if ip == "" {
-			ip = r.RemoteAddr
+		start := time.Now()
+
+		info := &requestInfo{id: r.Header.Get(RequestIDHeader)}
+		if !validRequestID(info.id) {
+			info.id = uuid.NewString()
 		}
+		w.Header().Set(RequestIDHeader, info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
 		rec := NewMuxieStatusRecorder(w)
 		next.ServeHTTP(rec, r)
 
@@ -49,11 +259,17 @@ func NewLoggerMiddleware(next http.Handler) http.Handler {
 			rec.StatusCode = http.StatusOK
 		}
 
-		slog.Info("HTTP request",
+		attrs := []slog.Attr{
 			slog.String("method", r.Method),
 			slog.Int("status", rec.StatusCode),
 			slog.String("path", r.URL.Path),
-			slog.String("ip", ip),
-		)
+			slog.String("ip", ClientIP(r)),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("size", rec.Size),
+		}
+		if info.userID != nil {
+			attrs = append(attrs, slog.Uint64("user_id", uint64(*info.userID)))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "HTTP request", attrs...)
 	})
 }
@@ -0,0 +1,232 @@
+package util
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"github.com/kataras/muxie"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// MetricsConfig enables the /metrics endpoint. When Listen is set the metrics
+// are served on their own address, otherwise they are served by the API and
+// require Token as a bearer token.
+type MetricsConfig struct {
+	Listen string `toml:"listen"`
+	Token  string `toml:"token" secret:"true"`
+}
+
+func (c MetricsConfig) Validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if err := CheckListenAddress(c.Listen); err != nil {
+		return &ConfigError{Key: "listen", Err: err}
+	}
+	return nil
+}
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polleg_http_requests_total",
+		Help: "Number of HTTP requests by route pattern, method and status",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polleg_http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests by route pattern, method and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "polleg_db_query_duration_seconds",
+		Help:    "Duration of the database queries by operation",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	ImageUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "polleg_image_uploads_total",
+		Help: "Number of images uploaded",
+	})
+	ImageUploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "polleg_image_upload_bytes_total",
+		Help: "Size of the images uploaded",
+	})
+	// ImageUploadRejections is labelled with the reason of the rejection
+	ImageUploadRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polleg_image_upload_rejections_total",
+		Help: "Number of image uploads rejected by reason",
+	}, []string{"reason"})
+
+	responseCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polleg_response_cache_requests_total",
+		Help: "Number of lookups in the cache of the anonymous responses by result",
+	}, []string{"result"})
+	responseCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "polleg_response_cache_size_bytes",
+		Help: "Size of the bodies in the cache of the anonymous responses",
+	})
+
+	rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polleg_rate_limited_requests_total",
+		Help: "Number of requests rejected by the rate limiter by route class",
+	}, []string{"class"})
+
+	gcRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "polleg_gc_runs_total",
+		Help: "Number of garbage collector runs by result",
+	}, []string{"result"})
+	gcDeletedImages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "polleg_gc_deleted_images_total",
+		Help: "Number of unused images deleted by the garbage collector",
+	})
+	gcLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "polleg_gc_last_run_timestamp_seconds",
+		Help: "Time of the last garbage collector run",
+	})
+	gcLastDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "polleg_gc_last_run_duration_seconds",
+		Help: "Duration of the last garbage collector run",
+	})
+	fsckIssues = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "polleg_fsck_issues",
+		Help: "Number of inconsistencies between the images storage and the database found by the last check, by kind",
+	}, []string{"kind"})
+)
+
+// NewMetricsMiddleware counts the requests and their latency by the route
+// pattern they matched, to keep the cardinality of the labels bounded
+func NewMetricsMiddleware(mux *muxie.Mux) muxie.Wrapper {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := NewMuxieStatusRecorder(w)
+			next.ServeHTTP(rec, r)
+
+			if rec.StatusCode == 0 {
+				rec.StatusCode = http.StatusOK
+			}
+			route := "unmatched"
+			if node := mux.Routes.Search(r.URL.Path, noParams{}); node != nil {
+				route = node.String()
+			}
+			status := strconv.Itoa(rec.StatusCode)
+			httpRequests.WithLabelValues(route, r.Method, status).Inc()
+			httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// noParams discards the parameters of the route search
+type noParams struct{}
+
+func (noParams) Set(string, string) {}
+
+const dbQueryStartKey = "polleg:query_start"
+
+// registerDbMetrics times the queries through the gorm callbacks, and exports
+// the stats of the connection pool and the domain gauges
+func registerDbMetrics(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := prometheus.Register(collectors.NewDBStatsCollector(sqlDB, "polleg")); err != nil {
+		return err
+	}
+	if err := prometheus.Register(newDomainCollector()); err != nil {
+		return err
+	}
+
+	before := func(string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			db.InstanceSet(dbQueryStartKey, time.Now())
+		}
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			if start, ok := db.InstanceGet(dbQueryStartKey); ok {
+				dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start.(time.Time)).Seconds())
+			}
+		}
+	}
+	return registerQueryCallbacks(db, "metrics", before, after)
+}
+
+// domainCollector reads the domain gauges from the database on every scrape
+type domainCollector struct {
+	answers     *prometheus.Desc
+	openReports *prometheus.Desc
+	bannedUsers *prometheus.Desc
+}
+
+func newDomainCollector() *domainCollector {
+	return &domainCollector{
+		answers:     prometheus.NewDesc("polleg_answers", "Number of answers by state", []string{"state"}, nil),
+		openReports: prometheus.NewDesc("polleg_open_reports", "Number of open reports", nil, nil),
+		bannedUsers: prometheus.NewDesc("polleg_banned_users", "Number of users currently banned", nil, nil),
+	}
+}
+
+func (c *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.answers
+	ch <- c.openReports
+	ch <- c.bannedUsers
+}
+
+func (c *domainCollector) Collect(ch chan<- prometheus.Metric) {
+	db := GetDb()
+
+	var answers []struct {
+		State models.AnswerState
+		Count int64
+	}
+	if err := db.Model(&models.Answer{}).Select("state, COUNT(*) AS count").Group("state").Scan(&answers).Error; err != nil {
+		slog.With("err", err).Error("could not count answers for metrics")
+		ch <- prometheus.NewInvalidMetric(c.answers, err)
+	} else {
+		for _, a := range answers {
+			ch <- prometheus.MustNewConstMetric(c.answers, prometheus.GaugeValue, float64(a.Count), a.State.String())
+		}
+	}
+
+	var openReports int64
+	if err := db.Model(&models.Report{}).Count(&openReports).Error; err != nil {
+		slog.With("err", err).Error("could not count open reports for metrics")
+		ch <- prometheus.NewInvalidMetric(c.openReports, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.openReports, prometheus.GaugeValue, float64(openReports))
+	}
+
+	var bannedUsers int64
+	if err := db.Model(&models.Ban{}).Scopes(activeBansScope).Distinct("user_id").Count(&bannedUsers).Error; err != nil {
+		slog.With("err", err).Error("could not count banned users for metrics")
+		ch <- prometheus.NewInvalidMetric(c.bannedUsers, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.bannedUsers, prometheus.GaugeValue, float64(bannedUsers))
+	}
+}
+
+// MetricsHandler serves the metrics, requiring the bearer token if set
+func MetricsHandler(token string) http.Handler {
+	handler := promhttp.Handler()
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
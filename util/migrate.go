@@ -0,0 +1,303 @@
+package util
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// Migration is a version of the schema, with the SQL applying and reverting it
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// LoadMigrations reads the migrations in fsys, sorted by version. Each
+// version must have both the up and the down file.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		match := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[m.Version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both the up and the down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+	return migrations, nil
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS "schema_migrations" (
+	"version" bigint PRIMARY KEY,
+	"name" text NOT NULL,
+	"applied_at" timestamptz NOT NULL
+)`
+
+// execScript runs the statements of a migration in the transaction tx. The
+// statements prepared by gorm can hold a single command, so the script is run
+// on the underlying transaction, which uses the simple query protocol when
+// there are no arguments.
+func execScript(tx *gorm.DB, script string) error {
+	conn := tx.Statement.ConnPool
+	if prepared, ok := conn.(*gorm.PreparedStmtTX); ok {
+		conn = prepared.Tx
+	}
+	_, err := conn.ExecContext(tx.Statement.Context, script)
+	return err
+}
+
+// withMigrationsLock runs fn while holding the advisory lock of the
+// migrations, so that the replicas starting together migrate one at a time
+func withMigrationsLock(ctx context.Context, db *gorm.DB, fn func(db *gorm.DB) error) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := advisoryLockKey("migrations")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		return fmt.Errorf("could not take the migrations lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			slog.With("err", err).Error("could not release the migrations lock")
+		}
+	}()
+
+	db = db.WithContext(ctx)
+	if err := db.Exec(createSchemaMigrations).Error; err != nil {
+		return err
+	}
+	return fn(db)
+}
+
+func getAppliedMigrations(db *gorm.DB) (map[uint]models.SchemaMigration, error) {
+	var rows []models.SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[uint]models.SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// isLegacySchema reports whether the schema was created by AutoMigrate, before
+// the versioned migrations
+func isLegacySchema(db *gorm.DB, applied map[uint]models.SchemaMigration) bool {
+	return len(applied) == 0 && db.Migrator().HasTable(&models.User{})
+}
+
+// adoptLegacySchema brings a schema created by AutoMigrate to the one of the
+// initial migration, running the data migrations it needed, and records the
+// initial migration as applied
+func adoptLegacySchema(db *gorm.DB, initial Migration) error {
+	slog.Info("upgrading the schema created by AutoMigrate")
+	if err := MigrateReportTargets(db); err != nil {
+		return fmt.Errorf("failed to migrate reports: %w", err)
+	}
+	if err := db.AutoMigrate(legacyModels...); err != nil {
+		return fmt.Errorf("AutoMigrate failed: %w", err)
+	}
+	if err := MigrateUserBans(db); err != nil {
+		return fmt.Errorf("failed to migrate bans: %w", err)
+	}
+	if err := BackfillAuditEvents(db); err != nil {
+		return fmt.Errorf("failed to backfill the audit log: %w", err)
+	}
+	return db.Create(&models.SchemaMigration{Version: initial.Version, Name: initial.Name, AppliedAt: time.Now()}).Error
+}
+
+// MigrateUp applies the pending migrations in order, each one in its own
+// transaction, and returns the ones it applied
+func MigrateUp(ctx context.Context, db *gorm.DB, migrations []Migration) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationsLock(ctx, db, func(db *gorm.DB) error {
+		applied, err := getAppliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		if len(migrations) > 0 && isLegacySchema(db, applied) {
+			if err := adoptLegacySchema(db, migrations[0]); err != nil {
+				return err
+			}
+			applied[migrations[0].Version] = models.SchemaMigration{}
+		}
+
+		known := make(map[uint]bool, len(migrations))
+		for _, m := range migrations {
+			known[m.Version] = true
+		}
+		for version := range applied {
+			if !known[version] {
+				slog.With("version", version).Warn("the database has a migration unknown to this release")
+			}
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			slog.With("version", m.Version, "name", m.Name).Info("applying migration")
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := execScript(tx, m.Up); err != nil {
+					return err
+				}
+				return tx.Create(&models.SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted
+func MigrateDown(ctx context.Context, db *gorm.DB, migrations []Migration, steps int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationsLock(ctx, db, func(db *gorm.DB) error {
+		applied, err := getAppliedMigrations(db)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]uint, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		slices.Sort(versions)
+		slices.Reverse(versions)
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+
+		for _, version := range versions {
+			i := slices.IndexFunc(migrations, func(m Migration) bool { return m.Version == version })
+			if i < 0 {
+				return fmt.Errorf("migration %d is unknown to this release", version)
+			}
+			m := migrations[i]
+			slog.With("version", m.Version, "name", m.Name).Info("reverting migration")
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := execScript(tx, m.Down); err != nil {
+					return err
+				}
+				return tx.Delete(&models.SchemaMigration{}, m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrationState tells whether a migration is applied to the database
+type MigrationState struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+	// Unknown is set for the migrations applied to the database but missing
+	// from this release
+	Unknown bool
+}
+
+type MigrationStatus struct {
+	Migrations []MigrationState
+	// Legacy is set when the schema was created by AutoMigrate, the next
+	// MigrateUp adopts it without running the initial migration
+	Legacy bool
+}
+
+// GetMigrationStatus returns the state of the known migrations and of the
+// unknown ones applied to the database, sorted by version
+func GetMigrationStatus(db *gorm.DB, migrations []Migration) (*MigrationStatus, error) {
+	applied := make(map[uint]models.SchemaMigration)
+	if db.Migrator().HasTable(&models.SchemaMigration{}) {
+		var err error
+		if applied, err = getAppliedMigrations(db); err != nil {
+			return nil, err
+		}
+	}
+
+	status := &MigrationStatus{Legacy: isLegacySchema(db, applied)}
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if row, ok := applied[m.Version]; ok {
+			state.AppliedAt = &row.AppliedAt
+			delete(applied, m.Version)
+		}
+		status.Migrations = append(status.Migrations, state)
+	}
+	for _, row := range applied {
+		status.Migrations = append(status.Migrations, MigrationState{Version: row.Version, Name: row.Name, AppliedAt: &row.AppliedAt, Unknown: true})
+	}
+	slices.SortFunc(status.Migrations, func(a, b MigrationState) int { return cmp.Compare(a.Version, b.Version) })
+	return status, nil
+}
+
+// GetSchemaVersion returns the version of the last migration applied to the
+// database
+func GetSchemaVersion(db *gorm.DB) (uint, error) {
+	var version uint
+	err := db.Model(&models.SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
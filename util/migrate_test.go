@@ -0,0 +1,163 @@
+package util
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cartabinaria/polleg/migrations"
+	"github.com/cartabinaria/polleg/models"
+)
+
+// TestMigrations applies every migration and then reverts them all. It needs
+// an empty Postgres database, given by POLLEG_TEST_DB_URI.
+func TestMigrations(t *testing.T) {
+	uri := os.Getenv("POLLEG_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("POLLEG_TEST_DB_URI is not set")
+	}
+	if err := ConnectDb(uri); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDb() })
+
+	all, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	db := GetDb()
+
+	status, err := GetMigrationStatus(db, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status.Migrations {
+		if m.AppliedAt != nil {
+			t.Fatalf("the database is not empty, migration %d is applied", m.Version)
+		}
+	}
+
+	// twice, so that the down migrations are checked to leave nothing behind
+	for range 2 {
+		applied, err := MigrateUp(ctx, db, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(all) {
+			t.Fatalf("applied %d migrations, want %d", len(applied), len(all))
+		}
+
+		reverted, err := MigrateDown(ctx, db, all, len(all))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reverted) != len(all) {
+			t.Fatalf("reverted %d migrations, want %d", len(reverted), len(all))
+		}
+	}
+
+	var tables []string
+	err = db.Raw(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`).Scan(&tables).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) > 0 {
+		t.Fatalf("tables left after reverting all the migrations: %v", tables)
+	}
+}
+
+// TestAdoptLegacySchema creates a schema as AutoMigrate left it before the
+// versioned migrations, applies every migration and then reverts them all. It
+// needs an empty Postgres database, given by POLLEG_TEST_DB_URI.
+func TestAdoptLegacySchema(t *testing.T) {
+	uri := os.Getenv("POLLEG_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("POLLEG_TEST_DB_URI is not set")
+	}
+	if err := ConnectDb(uri); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDb() })
+
+	all, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	db := GetDb()
+
+	if db.Migrator().HasTable("users") {
+		t.Fatal("the database is not empty")
+	}
+	legacy := []string{
+		`CREATE TABLE "users" ("id" bigserial, "username" text, "alias" text,
+			"created_at" timestamptz, "updated_at" timestamptz, "deleted_at" timestamptz,
+			"banned" boolean, "banned_at" timestamptz, PRIMARY KEY ("id"))`,
+		`CREATE TABLE "questions" ("id" bigserial, "created_at" timestamptz, "updated_at" timestamptz,
+			"deleted_at" timestamptz, "document" text, "start" bigint, "end" bigint,
+			"user_id" bigint NOT NULL, PRIMARY KEY ("id"))`,
+		`CREATE TABLE "answers" ("id" bigserial, "created_at" timestamptz, "updated_at" timestamptz,
+			"deleted_at" timestamptz, "question" bigint, "parent" bigint, "user_id" bigint,
+			"upvotes" bigint, "downvotes" bigint, "anonymous" boolean, PRIMARY KEY ("id"))`,
+		`CREATE TABLE "reports" ("id" bigserial, "created_at" timestamptz, "updated_at" timestamptz,
+			"deleted_at" timestamptz, "answer_id" bigint, "cause" text, "user_id" bigint NOT NULL,
+			PRIMARY KEY ("id"))`,
+		`INSERT INTO "users" ("id", "username", "created_at", "updated_at", "banned", "banned_at")
+			VALUES (1, 'alice', NOW(), NOW(), false, NULL), (2, 'bob', NOW(), NOW(), true, NOW())`,
+		`INSERT INTO "questions" ("id", "created_at", "updated_at", "document", "start", "end", "user_id")
+			VALUES (1, NOW(), NOW(), 'doc', 0, 10, 1)`,
+		`INSERT INTO "answers" ("id", "created_at", "updated_at", "question", "user_id", "anonymous")
+			VALUES (1, NOW(), NOW(), 1, 2, false)`,
+		`INSERT INTO "reports" ("created_at", "updated_at", "answer_id", "cause", "user_id")
+			VALUES (NOW(), NOW(), 1, 'spam', 1)`,
+	}
+	for _, stmt := range legacy {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied, err := MigrateUp(ctx, db, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initial migration is recorded by the adoption, not applied
+	if len(applied) != len(all)-1 {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(all)-1)
+	}
+
+	var bans int64
+	if err := db.Model(&models.Ban{}).Where("user_id = ?", 2).Count(&bans).Error; err != nil {
+		t.Fatal(err)
+	}
+	if bans != 1 {
+		t.Fatalf("found %d bans of the banned user, want 1", bans)
+	}
+	var report models.Report
+	if err := db.First(&report).Error; err != nil {
+		t.Fatal(err)
+	}
+	if report.TargetType != models.ReportTargetAnswer || report.TargetID != "1" {
+		t.Fatalf("the report targets %s %s, want answer 1", report.TargetType, report.TargetID)
+	}
+
+	reverted, err := MigrateDown(ctx, db, all, len(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(all) {
+		t.Fatalf("reverted %d migrations, want %d", len(reverted), len(all))
+	}
+
+	var tables []string
+	err = db.Raw(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`).Scan(&tables).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) > 0 {
+		t.Fatalf("tables left after reverting all the migrations: %v", tables)
+	}
+}
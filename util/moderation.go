@@ -0,0 +1,141 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// EscalationStep bans a user when they reach the given number of active
+// warnings. A zero BanDuration means a permanent ban.
+type EscalationStep struct {
+	Strikes     int      `toml:"strikes"`
+	BanDuration Duration `toml:"ban_duration"`
+}
+
+type ModerationConfig struct {
+	// StrikeExpiry is how long a warning counts towards the escalation policy
+	StrikeExpiry Duration         `toml:"strike_expiry"`
+	Escalation   []EscalationStep `toml:"escalation"`
+}
+
+func (c ModerationConfig) Validate() error {
+	var errs []error
+	if c.StrikeExpiry <= 0 {
+		errs = append(errs, configErrorf("strike_expiry", "must be positive"))
+	}
+	for i, step := range c.Escalation {
+		if step.Strikes <= 0 {
+			errs = append(errs, configErrorf(fmt.Sprintf("escalation[%d].strikes", i), "must be positive"))
+		}
+		if step.BanDuration < 0 {
+			errs = append(errs, configErrorf(fmt.Sprintf("escalation[%d].ban_duration", i), "must not be negative"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var moderationConfig = ModerationConfig{
+	StrikeExpiry: Duration(90 * 24 * time.Hour),
+	Escalation: []EscalationStep{
+		{Strikes: 3, BanDuration: Duration(7 * 24 * time.Hour)},
+		{Strikes: 5},
+	},
+}
+
+func SetModerationConfig(config ModerationConfig) {
+	moderationConfig = config
+}
+
+func GetModerationConfig() ModerationConfig {
+	return moderationConfig
+}
+
+func activeWarningsScope(db *gorm.DB) *gorm.DB {
+	return db.Where("expires_at > ?", time.Now())
+}
+
+func GetActiveWarnings(db *gorm.DB, userID uint) ([]models.Warning, error) {
+	var warnings []models.Warning
+	if err := db.Scopes(activeWarningsScope).Where("user_id = ?", userID).Order("created_at DESC").Find(&warnings).Error; err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
+
+func GetWarnings(db *gorm.DB, userID uint) ([]models.Warning, error) {
+	var warnings []models.Warning
+	if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&warnings).Error; err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
+
+// IssueWarning stores a new warning for the user and applies the escalation
+// policy. If the warning causes the user to be banned, the new ban is
+// returned too.
+func IssueWarning(db *gorm.DB, warning *models.Warning) (*models.Ban, error) {
+	warning.ExpiresAt = time.Now().Add(time.Duration(moderationConfig.StrikeExpiry))
+
+	var ban *models.Ban
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(warning).Error; err != nil {
+			return err
+		}
+
+		var strikes int64
+		if err := tx.Model(&models.Warning{}).Scopes(activeWarningsScope).Where("user_id = ?", warning.UserID).Count(&strikes).Error; err != nil {
+			return err
+		}
+
+		var err error
+		ban, err = applyEscalationPolicy(tx, warning.UserID, int(strikes))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// applyEscalationPolicy bans the user according to the highest step of the
+// policy their active strikes have reached. Bans are issued by the system
+// user. A ban at least as severe as the one of the step is left untouched, a
+// shorter one is replaced.
+func applyEscalationPolicy(db *gorm.DB, userID uint, strikes int) (*models.Ban, error) {
+	// the steps may be in any order
+	var step *EscalationStep
+	for i, s := range moderationConfig.Escalation {
+		if strikes >= s.Strikes && (step == nil || s.Strikes > step.Strikes) {
+			step = &moderationConfig.Escalation[i]
+		}
+	}
+	if step == nil {
+		return nil, nil
+	}
+
+	active, err := GetActiveBan(db, userID)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return nil, err
+	case active.ExpiresAt == nil,
+		step.BanDuration > 0 && active.ExpiresAt.Sub(active.StartsAt) >= time.Duration(step.BanDuration):
+		return nil, nil
+	default:
+		if err := LiftBan(db, userID, 0, "replaced by a longer automatic ban"); err != nil {
+			return nil, err
+		}
+	}
+
+	var expiresAt *time.Time
+	if step.BanDuration > 0 {
+		t := time.Now().Add(time.Duration(step.BanDuration))
+		expiresAt = &t
+	}
+	reason := fmt.Sprintf("automatic ban: %d active warnings", strikes)
+	return BanUser(db, userID, 0, reason, expiresAt)
+}
@@ -0,0 +1,287 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// The requests are limited with token buckets: each user, or each client IP
+// for the anonymous requests, has a bucket per class of routes holding up to
+// Burst tokens, refilled at Requests per Period. Every request takes a token,
+// and is rejected when the bucket is empty.
+
+type RateLimitClass string
+
+const (
+	RateLimitAnswers RateLimitClass = "answers"
+	RateLimitImages  RateLimitClass = "images"
+	RateLimitVotes   RateLimitClass = "votes"
+	RateLimitReports RateLimitClass = "reports"
+	// RateLimitReads are the read-only queries reachable without logging in
+	RateLimitReads RateLimitClass = "reads"
+)
+
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStorePostgres = "postgres"
+)
+
+// RateLimit allows Burst requests at once, refilled at Requests per Period.
+// Zero Requests disable the limit.
+type RateLimit struct {
+	Requests int      `toml:"requests"`
+	Period   Duration `toml:"period"`
+	Burst    int      `toml:"burst"`
+}
+
+func (l RateLimit) Validate() error {
+	if l.Requests == 0 {
+		return nil
+	}
+	var errs []error
+	if l.Requests < 0 {
+		errs = append(errs, configErrorf("requests", "must not be negative"))
+	}
+	if l.Period <= 0 {
+		errs = append(errs, configErrorf("period", "must be positive"))
+	}
+	if l.Burst < 1 {
+		errs = append(errs, configErrorf("burst", "must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// rate returns the tokens refilled per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / time.Duration(l.Period).Seconds()
+}
+
+// refillTime returns how long an empty bucket takes to be full again
+func (l RateLimit) refillTime() time.Duration {
+	return time.Duration(float64(l.Burst) / l.rate() * float64(time.Second))
+}
+
+// RateLimitConfig configures the limits of each class of routes. The buckets
+// are kept in memory, so each replica has its own, or in Postgres, shared by
+// all the replicas at the cost of a query per request.
+type RateLimitConfig struct {
+	Disabled bool   `toml:"disabled"`
+	Store    string `toml:"store"`
+
+	Answers RateLimit `toml:"answers"`
+	Images  RateLimit `toml:"images"`
+	Votes   RateLimit `toml:"votes"`
+	Reports RateLimit `toml:"reports"`
+	Reads   RateLimit `toml:"reads"`
+}
+
+func (c RateLimitConfig) limits() map[RateLimitClass]RateLimit {
+	return map[RateLimitClass]RateLimit{
+		RateLimitAnswers: c.Answers,
+		RateLimitImages:  c.Images,
+		RateLimitVotes:   c.Votes,
+		RateLimitReports: c.Reports,
+		RateLimitReads:   c.Reads,
+	}
+}
+
+func (c RateLimitConfig) Validate() error {
+	errs := []error{}
+	if c.Store != RateLimitStoreMemory && c.Store != RateLimitStorePostgres {
+		errs = append(errs, configErrorf("store", "must be %q or %q", RateLimitStoreMemory, RateLimitStorePostgres))
+	}
+	for class, limit := range c.limits() {
+		errs = append(errs, InSection(string(class), limit.Validate()))
+	}
+	return errors.Join(errs...)
+}
+
+// RateLimitStore keeps the token buckets
+type RateLimitStore interface {
+	// Take refills the bucket of key and takes a token from it if there is
+	// one, returning whether it did and the tokens left
+	Take(ctx context.Context, key string, limit RateLimit) (allowed bool, tokens float64, err error)
+	// Cleanup removes the buckets not used since before t
+	Cleanup(ctx context.Context, t time.Time) error
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimitStore keeps the buckets of a single replica
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (bool, float64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limit.rate())
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false, bucket.tokens, nil
+	}
+	bucket.tokens--
+	return true, bucket.tokens, nil
+}
+
+func (s *MemoryRateLimitStore) Cleanup(_ context.Context, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, bucket := range s.buckets {
+		if bucket.updatedAt.Before(t) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// rateLimitRefill is the number of tokens of the bucket b once refilled, the
+// time is the one of the database so that the clocks of the replicas don't
+// matter
+const rateLimitRefill = `LEAST(@burst::double precision, b.tokens +
+	EXTRACT(EPOCH FROM EXCLUDED.updated_at - b.updated_at)::double precision * @rate::double precision)`
+
+// the SET expressions see the bucket as it was before the update
+var rateLimitTake = fmt.Sprintf(`INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+VALUES (@key, @burst::double precision - 1, true, now())
+ON CONFLICT (key) DO UPDATE SET
+	tokens = CASE WHEN %[1]s >= 1 THEN %[1]s - 1 ELSE %[1]s END,
+	allowed = %[1]s >= 1,
+	updated_at = EXCLUDED.updated_at
+RETURNING allowed, tokens`, rateLimitRefill)
+
+// PostgresRateLimitStore keeps the buckets in the rate_limit_buckets table,
+// shared by the replicas. Each request takes a token with a single upsert.
+type PostgresRateLimitStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresRateLimitStore(db *gorm.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db: db}
+}
+
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, float64, error) {
+	var bucket models.RateLimitBucket
+	err := s.db.WithContext(ctx).Raw(rateLimitTake, map[string]any{
+		"key":   key,
+		"burst": limit.Burst,
+		"rate":  limit.rate(),
+	}).Scan(&bucket).Error
+	return bucket.Allowed, bucket.Tokens, err
+}
+
+func (s *PostgresRateLimitStore) Cleanup(ctx context.Context, t time.Time) error {
+	return s.db.WithContext(ctx).Where("updated_at < ?", t).Delete(&models.RateLimitBucket{}).Error
+}
+
+// RateLimitResult is the state of a bucket after a request, to be reported
+// to the client
+type RateLimitResult struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// RetryAfter is how long until the next token, if Remaining is zero
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimiter limits the requests of each class of routes
+type RateLimiter struct {
+	store  RateLimitStore
+	limits map[RateLimitClass]RateLimit
+}
+
+func NewRateLimiter(config RateLimitConfig, db *gorm.DB) *RateLimiter {
+	limits := config.limits()
+	if config.Disabled {
+		limits = map[RateLimitClass]RateLimit{}
+	}
+	var store RateLimitStore = NewMemoryRateLimitStore()
+	if config.Store == RateLimitStorePostgres {
+		store = NewPostgresRateLimitStore(db)
+	}
+	return &RateLimiter{store: store, limits: limits}
+}
+
+// Take takes a token from the bucket of key for a class of routes. The
+// result is nil when the class has no limit. If the store fails the request
+// is allowed, so that the rate limiter can't take the service down.
+func (l *RateLimiter) Take(ctx context.Context, class RateLimitClass, key string) *RateLimitResult {
+	limit, ok := l.limits[class]
+	if !ok || limit.Requests == 0 {
+		return nil
+	}
+
+	allowed, tokens, err := l.store.Take(ctx, string(class)+":"+key, limit)
+	if err != nil {
+		slog.With("class", class, "err", err).ErrorContext(ctx, "failed to take a rate limit token, allowing the request")
+		return nil
+	}
+	if !allowed {
+		rateLimitedRequests.WithLabelValues(string(class)).Inc()
+	}
+
+	// refillDuration is how long the given tokens take to be refilled
+	refillDuration := func(tokens float64) time.Duration {
+		return time.Duration(math.Max(tokens, 0) / limit.rate() * float64(time.Second))
+	}
+	return &RateLimitResult{
+		Allowed:    allowed,
+		Limit:      limit.Burst,
+		Remaining:  int(tokens),
+		RetryAfter: refillDuration(1 - tokens),
+		Reset:      refillDuration(float64(limit.Burst) - tokens),
+	}
+}
+
+// Run removes the unused buckets every interval, until ctx is done. Buckets
+// unused for longer than their refill time are full, so they can be dropped.
+func (l *RateLimiter) Run(ctx context.Context, interval time.Duration) {
+	var idle time.Duration
+	for _, limit := range l.limits {
+		if limit.Requests > 0 {
+			idle = max(idle, limit.refillTime())
+		}
+	}
+	if idle == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.store.Cleanup(ctx, time.Now().Add(-idle)); err != nil {
+			slog.With("err", err).Error("failed to clean up the rate limit buckets")
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package util
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The anonymous responses of the public read endpoints are cached in memory,
+// tagged with the documents they show. The handlers changing the questions,
+// the answers or the votes of a document invalidate its responses once their
+// transaction is committed. The changes made by the other replicas don't, so
+// the responses are also dropped after MaxAge.
+
+// ResponseCacheConfig bounds the cache of the anonymous responses
+type ResponseCacheConfig struct {
+	// MaxSize is the total size of the cached bodies in bytes, zero disables
+	// the cache
+	MaxSize int64 `toml:"max_size"`
+	// MaxAge is how long a response is cached
+	MaxAge Duration `toml:"max_age"`
+}
+
+func (c ResponseCacheConfig) Validate() error {
+	var errs []error
+	if c.MaxSize < 0 {
+		errs = append(errs, configErrorf("max_size", "must not be negative"))
+	}
+	if c.MaxSize > 0 && c.MaxAge <= 0 {
+		errs = append(errs, configErrorf("max_age", "must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// DocumentListTag tags the responses listing the documents, which change when
+// questions are added or deleted
+const DocumentListTag = "documents"
+
+func DocumentTag(documentID string) string {
+	return "document:" + documentID
+}
+
+// CachedResponse is a response body with its validators
+type CachedResponse struct {
+	Body         []byte
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// NewCachedResponse returns a response whose ETag is the hash of its body
+func NewCachedResponse(body []byte, contentType string, lastModified time.Time) *CachedResponse {
+	hash := sha256.Sum256(body)
+	return &CachedResponse{
+		Body:         body,
+		ContentType:  contentType,
+		ETag:         `"` + hex.EncodeToString(hash[:16]) + `"`,
+		LastModified: lastModified,
+	}
+}
+
+type responseCacheEntry struct {
+	key      string
+	tags     []string
+	response *CachedResponse
+	storedAt time.Time
+}
+
+// ResponseCache is a cache of responses bounded by the size of their bodies,
+// the least recently used ones are evicted first
+type ResponseCache struct {
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	// generation is incremented by every invalidation, the responses
+	// computed across one are not stored since they may be stale
+	generation uint64
+}
+
+func NewResponseCache(config ResponseCacheConfig) *ResponseCache {
+	return &ResponseCache{
+		maxSize: config.MaxSize,
+		maxAge:  time.Duration(config.MaxAge),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+var responseCache = NewResponseCache(ResponseCacheConfig{})
+
+func SetupResponseCache(config ResponseCacheConfig) {
+	responseCache = NewResponseCache(config)
+}
+
+func GetResponseCache() *ResponseCache {
+	return responseCache
+}
+
+// Enabled tells whether the responses are cached
+func (c *ResponseCache) Enabled() bool {
+	return c.maxSize > 0
+}
+
+// Generation returns the current generation, to be passed to Put along with
+// the response computed afterwards
+func (c *ResponseCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Get returns the response cached for key, nil if there is none
+func (c *ResponseCache) Get(key string) *CachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		responseCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	entry := elem.Value.(*responseCacheEntry)
+	if time.Since(entry.storedAt) > c.maxAge {
+		c.remove(elem)
+		responseCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	responseCacheRequests.WithLabelValues("hit").Inc()
+	return entry.response
+}
+
+// Put caches the response for key, unless the cache has been invalidated
+// since generation or the response is larger than the whole cache
+func (c *ResponseCache) Put(key string, tags []string, generation uint64, response *CachedResponse) {
+	size := int64(len(response.Body))
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&responseCacheEntry{
+		key:      key,
+		tags:     tags,
+		response: response,
+		storedAt: time.Now(),
+	})
+	c.size += size
+	responseCacheSize.Set(float64(c.size))
+}
+
+func (c *ResponseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*responseCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.response.Body))
+	responseCacheSize.Set(float64(c.size))
+}
+
+// Invalidate drops the responses with any of the tags
+func (c *ResponseCache) Invalidate(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*responseCacheEntry)
+		if slices.ContainsFunc(tags, func(tag string) bool { return slices.Contains(entry.tags, tag) }) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// InvalidateAll drops all the responses, for the changes which affect every
+// document such as the bans
+func (c *ResponseCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Init()
+	clear(c.entries)
+	c.size = 0
+	responseCacheSize.Set(0)
+}
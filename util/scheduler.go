@@ -0,0 +1,362 @@
+package util
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobLocked is returned when another replica is running the job
+	ErrJobLocked = errors.New("the job is running on another replica")
+)
+
+// JobConfig configures a background job. Schedule is a standard five fields
+// cron expression, or a descriptor such as "@daily" or "@every 1h".
+type JobConfig struct {
+	Schedule     string   `toml:"schedule"`
+	Timeout      Duration `toml:"timeout"`
+	RunAtStartup bool     `toml:"run_at_startup"`
+	Disabled     bool     `toml:"disabled"`
+}
+
+func (c JobConfig) Validate() error {
+	var errs []error
+	if _, err := cron.ParseStandard(c.Schedule); err != nil {
+		errs = append(errs, &ConfigError{Key: "schedule", Err: err})
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, configErrorf("timeout", "must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// JobFunc runs a job, the report it returns is stored as JSON in the run
+type JobFunc func(ctx context.Context) (report any, err error)
+
+type Job struct {
+	Name     string
+	Config   JobConfig
+	schedule cron.Schedule
+	run      JobFunc
+}
+
+// Scheduler runs the background jobs on their schedule. Each run takes a
+// Postgres advisory lock first, so that a job is executed by one replica at a
+// time: the other replicas skip the run. The scheduled runs also claim their
+// slot under the lock, so that a replica whose timer fires after the run of
+// another one has finished doesn't run the same slot again.
+type Scheduler struct {
+	ctx  context.Context
+	db   *gorm.DB
+	jobs map[string]*Job
+	host string
+
+	runs sync.WaitGroup
+}
+
+// NewScheduler returns a scheduler whose jobs are cancelled when ctx is done
+func NewScheduler(ctx context.Context, db *gorm.DB) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		ctx:  ctx,
+		db:   db,
+		jobs: make(map[string]*Job),
+		host: host,
+	}
+}
+
+// Register adds a job, disabled jobs can still be triggered manually
+func (s *Scheduler) Register(name string, config JobConfig, run JobFunc) error {
+	schedule, err := cron.ParseStandard(config.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule of job %s: %w", name, err)
+	}
+	if every, ok := schedule.(cron.ConstantDelaySchedule); ok {
+		schedule = alignedSchedule{every.Delay}
+	}
+	s.jobs[name] = &Job{Name: name, Config: config, schedule: schedule, run: run}
+	return nil
+}
+
+// Jobs returns the registered jobs sorted by name
+func (s *Scheduler) Jobs() []*Job {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	slices.SortFunc(jobs, func(a, b *Job) int { return cmp.Compare(a.Name, b.Name) })
+	return jobs
+}
+
+func (s *Scheduler) HasJob(name string) bool {
+	_, ok := s.jobs[name]
+	return ok
+}
+
+// alignedSchedule runs every Delay like the "@every" schedules, at multiples
+// of Delay since the zero time, so that the replicas agree on the slots
+type alignedSchedule struct {
+	Delay time.Duration
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.Delay).Add(s.Delay)
+}
+
+// NextRun returns when the job is going to run next, or nil if it is disabled
+func (j *Job) NextRun() *time.Time {
+	if j.Config.Disabled {
+		return nil
+	}
+	next := j.schedule.Next(time.Now())
+	return &next
+}
+
+// Run starts the jobs and blocks until the context of the scheduler is done
+// and the runs in progress have returned
+func (s *Scheduler) Run() {
+	for _, job := range s.jobs {
+		if job.Config.Disabled {
+			continue
+		}
+		s.runs.Add(1)
+		go func() {
+			defer s.runs.Done()
+			s.loop(job)
+		}()
+	}
+	<-s.ctx.Done()
+	s.runs.Wait()
+}
+
+func (s *Scheduler) loop(job *Job) {
+	if job.Config.RunAtStartup {
+		s.execute(job, models.JobTriggerStartup, nil, nil)
+	}
+
+	for {
+		next := job.schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.execute(job, models.JobTriggerSchedule, nil, &next)
+	}
+}
+
+// Trigger runs a job in the background on behalf of an admin. The run is
+// recorded as skipped if another replica is running the job.
+func (s *Scheduler) Trigger(name string, userID uint) error {
+	job, ok := s.jobs[name]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		s.execute(job, models.JobTriggerManual, &userID, nil)
+	}()
+	return nil
+}
+
+// RunJob runs a job now and waits for it to return, on behalf of the
+// operator running a command. ErrJobLocked is returned, with the skipped
+// run, if another replica is running the job.
+func (s *Scheduler) RunJob(name string) (*models.JobRun, error) {
+	job, ok := s.jobs[name]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return s.execute(job, models.JobTriggerManual, nil, nil)
+}
+
+// advisoryLockKey derives the key of an advisory lock from its name
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("polleg:" + name))
+	return int64(h.Sum64())
+}
+
+// ranRecently reports whether the job has succeeded within the last period of
+// its schedule, so that a startup run would be redundant
+func (s *Scheduler) ranRecently(db *gorm.DB, job *Job) (bool, error) {
+	next := job.schedule.Next(time.Now())
+	period := job.schedule.Next(next).Sub(next)
+
+	var count int64
+	err := db.Model(&models.JobRun{}).
+		Where("job = ? AND outcome = ? AND started_at > ?", job.Name, models.JobOutcomeSuccess, time.Now().Add(-period)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// execute runs the job while holding its advisory lock, and records the run.
+// The scheduled runs are given their slot, and are skipped if it has already
+// been claimed. The errors are logged too, since the scheduled runs have no
+// one to report them to.
+func (s *Scheduler) execute(job *Job, trigger models.JobTrigger, triggeredBy *uint, scheduledAt *time.Time) (*models.JobRun, error) {
+	logger := slog.With("job", job.Name, "trigger", trigger)
+
+	// the lock is held by the session, so the whole run must use the same
+	// connection to release it
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		logger.With("err", err).Error("could not get the db connection pool")
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(s.ctx)
+	if err != nil {
+		logger.With("err", err).Error("could not get a db connection")
+		return nil, err
+	}
+	defer conn.Close()
+
+	// runs are recorded even when the scheduler is being stopped
+	db := s.db.WithContext(context.WithoutCancel(s.ctx))
+	run := models.JobRun{
+		StartedAt:   time.Now(),
+		Job:         job.Name,
+		Trigger:     trigger,
+		TriggeredBy: triggeredBy,
+		ScheduledAt: scheduledAt,
+		Host:        s.host,
+		Outcome:     models.JobOutcomeRunning,
+	}
+
+	key := advisoryLockKey("job:" + job.Name)
+	var locked bool
+	if err := conn.QueryRowContext(s.ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		logger.With("err", err).Error("could not take the job lock")
+		return nil, err
+	}
+	if !locked {
+		logger.Debug("job is running on another replica, skipping")
+		if trigger == models.JobTriggerManual {
+			run.Outcome = models.JobOutcomeSkipped
+			run.Error = ErrJobLocked.Error()
+			if err := db.Create(&run).Error; err != nil {
+				logger.With("err", err).Error("could not record the job run")
+			}
+		}
+		return &run, ErrJobLocked
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(s.ctx), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			logger.With("err", err).Error("could not release the job lock")
+		}
+	}()
+
+	if trigger == models.JobTriggerStartup {
+		recent, err := s.ranRecently(db, job)
+		if err != nil {
+			logger.With("err", err).Error("could not get the last runs of the job")
+			return nil, err
+		}
+		if recent {
+			logger.Info("job has run recently, skipping the startup run")
+			return nil, nil
+		}
+	}
+
+	// the slot is claimed by inserting the run, the unique index on it
+	// rejects the replicas coming later
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&run)
+	if result.Error != nil {
+		logger.With("err", result.Error).Error("could not record the job run")
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		logger.With("scheduled_at", scheduledAt).Debug("job slot has been run by another replica, skipping")
+		return nil, nil
+	}
+
+	ctx := s.ctx
+	if job.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(job.Config.Timeout))
+		defer cancel()
+	}
+
+	logger.Info("running job")
+	report, err := job.run(ctx)
+	if report != nil {
+		if data, err := json.Marshal(report); err != nil {
+			logger.With("err", err).Error("could not marshal the job report")
+		} else {
+			run.Report = string(data)
+		}
+	}
+
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.Duration = finishedAt.Sub(run.StartedAt)
+	switch {
+	case err == nil:
+		run.Outcome = models.JobOutcomeSuccess
+	case errors.Is(err, context.DeadlineExceeded):
+		run.Outcome = models.JobOutcomeTimeout
+	case errors.Is(err, context.Canceled):
+		run.Outcome = models.JobOutcomeCancelled
+	default:
+		run.Outcome = models.JobOutcomeFailed
+	}
+	if err != nil {
+		run.Error = err.Error()
+		logger.With("outcome", run.Outcome, "duration", run.Duration, "err", err).Error("job failed")
+	} else {
+		logger.With("duration", run.Duration).Info("job completed")
+	}
+
+	if err := db.Select("finished_at", "duration", "outcome", "error", "report").Updates(&run).Error; err != nil {
+		logger.With("err", err).Error("could not record the job run")
+	}
+	return &run, nil
+}
+
+// GetJobRuns returns the most recent runs of a job, or of every job if name
+// is empty
+func GetJobRuns(db *gorm.DB, name string, limit int) ([]models.JobRun, error) {
+	query := db.Order("started_at DESC").Limit(limit)
+	if name != "" {
+		query = query.Where("job = ?", name)
+	}
+	var runs []models.JobRun
+	if err := query.Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// GetLastJobRun returns the most recent run of a job, or nil if it never ran
+func GetLastJobRun(db *gorm.DB, name string) (*models.JobRun, error) {
+	var run models.JobRun
+	err := db.Where("job = ? AND outcome <> ?", name, models.JobOutcomeSkipped).Order("started_at DESC").Take(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+// seedUsers are created by Seed, their IDs are the ones of the users of the
+// auth server in development
+var seedUsers = []struct {
+	ID       uint
+	Username string
+}{
+	{1, "alice"},
+	{2, "bob"},
+	{3, "carol"},
+}
+
+const (
+	SeedDocumentID   = "seed-document"
+	seedDocumentPath = "/seed/analisi/esame-2024-01-15.pdf"
+)
+
+var seedAnswers = []string{
+	"The limit is **1**, since $\\sin(x) \\sim x$ as $x \\to 0$.",
+	"Apply de l'Hôpital once: $\\lim_{x \\to 0} \\cos(x) = 1$.",
+	"The series converges by the ratio test, the ratio tends to $\\frac{1}{2}$.",
+}
+
+// Seed fills an empty database with some users, the questions of a document,
+// answers, replies and votes, to develop the frontend against. It returns
+// ErrDatabaseNotEmpty if there are users already.
+func Seed(ctx context.Context, db *gorm.DB) error {
+	db = db.WithContext(ctx)
+	var users int64
+	if err := db.Unscoped().Model(&models.User{}).Count(&users).Error; err != nil {
+		return err
+	}
+	if users > 0 {
+		return fmt.Errorf("%w: users has rows", ErrDatabaseNotEmpty)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, u := range seedUsers {
+			if _, err := GetOrCreateUserByID(tx, u.ID, u.Username); err != nil {
+				return err
+			}
+		}
+
+		questions := make([]models.Question, 3)
+		for i := range questions {
+			questions[i] = models.Question{
+				Document:     SeedDocumentID,
+				DocumentPath: seedDocumentPath,
+				Start:        uint32(i * 300),
+				End:          uint32((i + 1) * 300),
+				UserID:       seedUsers[0].ID,
+			}
+		}
+		if err := tx.Create(&questions).Error; err != nil {
+			return err
+		}
+
+		for i, question := range questions {
+			author := seedUsers[i%len(seedUsers)].ID
+			answer, err := seedAnswer(tx, question.ID, nil, author, seedAnswers[i])
+			if err != nil {
+				return err
+			}
+			replier := seedUsers[(i+1)%len(seedUsers)].ID
+			if _, err := seedAnswer(tx, question.ID, &answer.ID, replier, "Thanks, this helped!"); err != nil {
+				return err
+			}
+
+			for _, u := range seedUsers {
+				if u.ID == author {
+					continue
+				}
+				vote := models.Vote{AnswerID: answer.ID, UserId: u.ID, Vote: 1}
+				if err := tx.Create(&vote).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func seedAnswer(db *gorm.DB, question uint, parent *uint, userID uint, content string) (*models.Answer, error) {
+	answer := models.Answer{
+		Question: question,
+		Parent:   parent,
+		UserId:   userID,
+		State:    models.AnswerStateVisible,
+	}
+	if err := db.Create(&answer).Error; err != nil {
+		return nil, err
+	}
+	version := models.AnswerVersion{AnswerID: answer.ID, Content: content}
+	if err := db.Create(&version).Error; err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
@@ -0,0 +1,199 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The settings are limits tuned by the admins at runtime. The settings table
+// only holds the values which have been changed, the others take their
+// default. Quotas can be overridden for the users with a role or for single
+// users: the value of the user wins over the one of its role, which wins over
+// the global one.
+
+type SettingKey string
+
+const (
+	SettingMaxImageSize  SettingKey = "images.max_size"
+	SettingMaxImagesSize SettingKey = "images.max_total_size"
+	SettingMaxImages     SettingKey = "images.max_number"
+	SettingRepliesDepth  SettingKey = "answers.replies_depth"
+)
+
+// SettingDefinition describes a setting, all settings are integers
+type SettingDefinition struct {
+	Key         SettingKey `json:"key"`
+	Description string     `json:"description"`
+	Unit        string     `json:"unit"`
+	Default     int64      `json:"default"`
+	Min         int64      `json:"min"`
+	Max         int64      `json:"max"`
+	// Quota settings can be overridden per role and per user
+	Quota bool `json:"quota"`
+}
+
+var SettingDefinitions = []SettingDefinition{
+	{SettingMaxImageSize, "maximum size of an uploaded image", "bytes", 5 * 1024 * 1024, 1024, 100 * 1024 * 1024, true},
+	{SettingMaxImagesSize, "maximum total size of the images of a user", "bytes", 200 * 1024 * 1024, 0, 100 * 1024 * 1024 * 1024, true},
+	{SettingMaxImages, "maximum number of images of a user", "images", 100, 0, 100000, true},
+	{SettingRepliesDepth, "levels of replies returned with the answers", "levels", 2, 1, 10, false},
+}
+
+var (
+	ErrUnknownSetting        = errors.New("unknown setting")
+	ErrSettingNotOverridable = errors.New("the setting can't be overridden per role or user")
+	ErrSettingScope          = errors.New("a setting can be overridden for a role or for a user, not both")
+)
+
+// SettingRangeError is a value out of the range of a setting
+type SettingRangeError struct {
+	Definition SettingDefinition
+	Value      int64
+}
+
+func (e *SettingRangeError) Error() string {
+	return fmt.Sprintf("%s must be between %d and %d", e.Definition.Key, e.Definition.Min, e.Definition.Max)
+}
+
+func GetSettingDefinition(key SettingKey) (SettingDefinition, error) {
+	for _, def := range SettingDefinitions {
+		if def.Key == key {
+			return def, nil
+		}
+	}
+	return SettingDefinition{}, ErrUnknownSetting
+}
+
+// Validate checks that value is in the range of the setting
+func (d SettingDefinition) Validate(value int64) error {
+	if value < d.Min || value > d.Max {
+		return &SettingRangeError{Definition: d, Value: value}
+	}
+	return nil
+}
+
+// SettingsCacheTTL is how long the settings are cached, the changes made on
+// another replica are seen within it
+const SettingsCacheTTL = 30 * time.Second
+
+type settingScope struct {
+	key    SettingKey
+	role   string
+	userID uint
+}
+
+type settingsCache struct {
+	mu       sync.Mutex
+	values   map[settingScope]int64
+	loadedAt time.Time
+}
+
+var settings = &settingsCache{}
+
+// InvalidateSettingsCache makes the next read load the settings again, it is
+// called after changing them
+func InvalidateSettingsCache() {
+	settings.mu.Lock()
+	settings.values = nil
+	settings.mu.Unlock()
+}
+
+func (c *settingsCache) get(db *gorm.DB) (map[settingScope]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values != nil && time.Since(c.loadedAt) < SettingsCacheTTL {
+		return c.values, nil
+	}
+
+	rows, err := GetSettings(db)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[settingScope]int64, len(rows))
+	for _, row := range rows {
+		values[settingScope{SettingKey(row.Key), row.Role, row.UserID}] = row.Value
+	}
+	c.values, c.loadedAt = values, time.Now()
+	return values, nil
+}
+
+// GetSetting returns the value of a setting for a user with the given role,
+// through the cache. An empty role and a zero userID return the global value.
+func GetSetting(db *gorm.DB, key SettingKey, role string, userID uint) (int64, error) {
+	def, err := GetSettingDefinition(key)
+	if err != nil {
+		return 0, err
+	}
+	values, err := settings.get(db)
+	if err != nil {
+		return 0, err
+	}
+
+	scopes := []settingScope{{key, "", 0}}
+	if def.Quota {
+		scopes = []settingScope{{key, "", userID}, {key, role, 0}, {key, "", 0}}
+	}
+	for _, scope := range scopes {
+		if value, ok := values[scope]; ok {
+			return value, nil
+		}
+	}
+	return def.Default, nil
+}
+
+// GetSettings returns the values stored in the settings table, bypassing
+// the cache
+func GetSettings(db *gorm.DB) ([]models.Setting, error) {
+	var rows []models.Setting
+	err := db.Order("key, role, user_id").Find(&rows).Error
+	return rows, err
+}
+
+// SetSetting stores the value of a setting, globally or for a role or a user,
+// and returns the previous one, nil if it was not set. A nil value removes
+// it, so that the default or the global value applies again.
+func SetSetting(tx *gorm.DB, key SettingKey, role string, userID uint, value *int64, updatedBy uint) (*int64, error) {
+	def, err := GetSettingDefinition(key)
+	if err != nil {
+		return nil, err
+	}
+	if (role != "" || userID != 0) && !def.Quota {
+		return nil, ErrSettingNotOverridable
+	}
+	if role != "" && userID != 0 {
+		return nil, ErrSettingScope
+	}
+	if value != nil {
+		if err := def.Validate(*value); err != nil {
+			return nil, err
+		}
+	}
+
+	var previous *int64
+	var row models.Setting
+	const where = "key = ? AND role = ? AND user_id = ?"
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(where, key, role, userID).Take(&row).Error
+	if err == nil {
+		stored := row.Value
+		previous = &stored
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if value == nil {
+		if previous == nil {
+			return nil, nil
+		}
+		// the zero role and user ID would be left out of the conditions
+		// of a delete by primary key
+		return previous, tx.Where(where, key, role, userID).Delete(&models.Setting{}).Error
+	}
+	row = models.Setting{Key: string(key), Role: role, UserID: userID, Value: *value, UpdatedBy: updatedBy}
+	return previous, tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
@@ -0,0 +1,206 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/kataras/muxie"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// TracingConfig selects where the traces are exported, tracing is disabled
+// when Exporter is empty
+type TracingConfig struct {
+	// Exporter is either "otlp" or "stdout"
+	Exporter string `toml:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector, the
+	// OTEL_EXPORTER_OTLP_* environment variables are used when empty
+	Endpoint string `toml:"endpoint"`
+	Insecure bool   `toml:"insecure"`
+	// SampleRatio is the fraction of the traces started here which are
+	// recorded, traces started by the callers follow their decision
+	SampleRatio float64 `toml:"sample_ratio"`
+}
+
+func (c TracingConfig) Validate() error {
+	var errs []error
+	if c.Exporter != "" && c.Exporter != "otlp" && c.Exporter != "stdout" {
+		errs = append(errs, configErrorf("exporter", "must be empty, otlp or stdout"))
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		errs = append(errs, configErrorf("sample_ratio", "must be between 0 and 1"))
+	}
+	return errors.Join(errs...)
+}
+
+var tracer = otel.Tracer("github.com/cartabinaria/polleg")
+
+// SetupTracing installs the global tracer provider, the returned function
+// flushes the spans not exported yet
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %s exporter: %w", config.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("polleg")))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span for an internal operation, such as the ones on the
+// filesystem
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error, if any, and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// NewTracingMiddleware starts a span for each request, named after the route
+// pattern it matched. It continues the trace of the caller, if any.
+func NewTracingMiddleware(mux *muxie.Mux) muxie.Wrapper {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "unmatched"
+			if node := mux.Routes.Search(r.URL.Path, noParams{}); node != nil {
+				route = node.String()
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(r.URL.Path),
+					semconv.ClientAddress(ClientIP(r)),
+					attribute.String("polleg.request_id", RequestIDFromContext(r.Context())),
+				))
+			defer span.End()
+
+			rec := NewMuxieStatusRecorder(w)
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.StatusCode == 0 {
+				rec.StatusCode = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(rec.StatusCode))
+			if rec.StatusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.StatusCode))
+			}
+		})
+	}
+}
+
+const (
+	dbSpanKey          = "polleg:span"
+	dbParentContextKey = "polleg:parent_context"
+)
+
+// tracingPlugin starts a span for each query, as a child of the span in the
+// context of the query
+type tracingPlugin struct{}
+
+func (tracingPlugin) Name() string {
+	return "polleg:tracing"
+}
+
+func (tracingPlugin) Initialize(db *gorm.DB) error {
+	before := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			ctx, span := tracer.Start(db.Statement.Context, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(semconv.DBSystemNamePostgreSQL, semconv.DBOperationName(operation)))
+			db.InstanceSet(dbParentContextKey, db.Statement.Context)
+			db.InstanceSet(dbSpanKey, span)
+			db.Statement.Context = ctx
+		}
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			value, ok := db.InstanceGet(dbSpanKey)
+			if !ok {
+				return
+			}
+			span := value.(trace.Span)
+			if parent, ok := db.InstanceGet(dbParentContextKey); ok {
+				db.Statement.Context = parent.(context.Context)
+			}
+			span.SetAttributes(
+				semconv.DBQueryText(db.Statement.SQL.String()),
+				attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+			)
+			if db.Statement.Table != "" {
+				span.SetAttributes(semconv.DBCollectionName(db.Statement.Table))
+			}
+			err := db.Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				err = nil
+			}
+			EndSpan(span, err)
+		}
+	}
+	return registerQueryCallbacks(db, "tracing", before, after)
+}
+
+// RemoveImageFile removes the file of an image, a missing file is not an
+// error
+func RemoveImageFile(ctx context.Context, imagesPath, id string) error {
+	path := filepath.Join(imagesPath, id)
+	_, span := StartSpan(ctx, "image.remove", semconv.FilePath(path))
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	EndSpan(span, err)
+	return err
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/cartabinaria/polleg/models"
+	"gorm.io/gorm"
+)
+
+const (
+	HoldReasonContentFilter = "held by the content filter"
+	HoldReasonNewAccount    = "first answers of a new account"
+	HoldReasonLinks         = "contains external links"
+	HoldReasonImages        = "contains images"
+)
+
+// TrustConfig decides which answers of untrusted users are held for
+// approval. Users become trusted once they have TrustThreshold approved
+// answers, a zero TrustThreshold trusts everyone.
+type TrustConfig struct {
+	// PendingAnswers is the number of answers of a new account which are
+	// held, regardless of their content
+	PendingAnswers int  `toml:"pending_answers"`
+	HoldLinks      bool `toml:"hold_links"`
+	HoldImages     bool `toml:"hold_images"`
+	TrustThreshold int  `toml:"trust_threshold"`
+}
+
+func (c TrustConfig) Validate() error {
+	var errs []error
+	if c.PendingAnswers < 0 {
+		errs = append(errs, configErrorf("pending_answers", "must not be negative"))
+	}
+	if c.TrustThreshold < 0 {
+		errs = append(errs, configErrorf("trust_threshold", "must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+var trustConfig = TrustConfig{}
+
+func SetTrustConfig(config TrustConfig) {
+	trustConfig = config
+}
+
+func GetTrustConfig() TrustConfig {
+	return trustConfig
+}
+
+var imageRegex = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+
+// CountApprovedAnswers returns the number of visible answers of a user
+func CountApprovedAnswers(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.Answer{}).
+		Where("user_id = ? AND state = ?", userID, models.AnswerStateVisible).
+		Count(&count).Error
+	return count, err
+}
+
+// IsTrustedUser reports whether the answers of a user are published without
+// going through the pre-moderation queue
+func IsTrustedUser(db *gorm.DB, userID uint) (bool, error) {
+	if trustConfig.TrustThreshold <= 0 {
+		return true, nil
+	}
+	approved, err := CountApprovedAnswers(db, userID)
+	if err != nil {
+		return false, err
+	}
+	return approved >= int64(trustConfig.TrustThreshold), nil
+}
+
+// CheckTrustPolicy returns the reason why an answer of the user should be
+// held for approval, or an empty string if it can be published right away.
+// Edits of existing answers are only checked against their content.
+func CheckTrustPolicy(db *gorm.DB, userID uint, content string, newAnswer bool) (string, error) {
+	trusted, err := IsTrustedUser(db, userID)
+	if err != nil || trusted {
+		return "", err
+	}
+
+	if newAnswer && trustConfig.PendingAnswers > 0 {
+		var count int64
+		if err := db.Unscoped().Model(&models.Answer{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count < int64(trustConfig.PendingAnswers) {
+			return HoldReasonNewAccount, nil
+		}
+	}
+
+	if trustConfig.HoldImages && imageRegex.MatchString(content) {
+		return HoldReasonImages, nil
+	}
+	if trustConfig.HoldLinks && linkRegex.MatchString(imageRegex.ReplaceAllString(content, "")) {
+		return HoldReasonLinks, nil
+	}
+
+	return "", nil
+}
+
+// GetPendingAnswers returns the answers waiting for approval, oldest first
+func GetPendingAnswers(db *gorm.DB) ([]models.Answer, error) {
+	var answers []models.Answer
+	if err := db.Where("state = ?", models.AnswerStatePending).Order("created_at ASC").Find(&answers).Error; err != nil {
+		return nil, err
+	}
+	return answers, nil
+}
+
+// ApproveAnswer makes a pending answer visible. If this makes its author
+// trusted, the rest of their answers held by the trust policy are approved
+// too, while the ones held by the content filter still need a review. It
+// returns the IDs of the auto-approved answers.
+func ApproveAnswer(db *gorm.DB, answer *models.Answer, moderatorID uint) ([]uint, error) {
+	if answer.State != models.AnswerStatePending {
+		return nil, fmt.Errorf("answer %d is not pending", answer.ID)
+	}
+	if err := ChangeAnswerState(db, answer, models.AnswerStateVisible, moderatorID, ""); err != nil {
+		return nil, err
+	}
+
+	trusted, err := IsTrustedUser(db, answer.UserId)
+	if err != nil || !trusted || trustConfig.TrustThreshold <= 0 {
+		return nil, err
+	}
+
+	var held []models.Answer
+	err = db.Where("user_id = ? AND state = ? AND hold_reason IN ?", answer.UserId, models.AnswerStatePending,
+		[]string{HoldReasonNewAccount, HoldReasonLinks, HoldReasonImages}).Find(&held).Error
+	if err != nil {
+		return nil, err
+	}
+
+	approved := make([]uint, 0, len(held))
+	for _, a := range held {
+		if err := ChangeAnswerState(db, &a, models.AnswerStateVisible, 0, "author reached the trust threshold"); err != nil {
+			return approved, err
+		}
+		approved = append(approved, a.ID)
+	}
+	return approved, nil
+}